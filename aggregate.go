@@ -0,0 +1,159 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package celltree
+
+// Aggregate is a user-defined value, such as a sum, that is maintained for
+// every node in the tree. It allows for RangeAggregate to combine the values
+// for all the nodes that are fully inside of a range without visiting their
+// items.
+type Aggregate struct {
+	// Value returns the aggregate value for a single item.
+	Value func(cell uint64, data interface{}) interface{}
+	// Combine returns the combination of two aggregate values. The values
+	// are always combined in cell order, and Combine must be associative.
+	Combine func(a, b interface{}) interface{}
+}
+
+// WithAggregate maintains an aggregate value for every node in the tree.
+// See RangeAggregate. Each change to the tree recomputes the aggregates for
+// the nodes along the path to the changed items, which makes for slower
+// writes.
+func WithAggregate(agg Aggregate) Option {
+	return func(opts *Options) {
+		opts.Aggregate = &agg
+	}
+}
+
+// RangeAggregate returns the combined aggregate value for all items in the
+// inclusive [start,end] range. Nodes that are fully inside of the range use
+// their maintained value. Returns nil when there are no items in the range or
+// when the tree does not have an aggregate. See WithAggregate.
+func (tr *Tree) RangeAggregate(start, end uint64) interface{} {
+	if tr.agg == nil || tr.root == nil || start > end {
+		return nil
+	}
+	agg, _ := tr.root.rangeAggregate(tr, start, end, 64-tr.numBits, 0)
+	return agg
+}
+
+func (n *node) rangeAggregate(
+	tr *Tree, start, end uint64, bits uint, base uint64,
+) (agg interface{}, ok bool) {
+	if !n.branch {
+		for i := n.findLeafItemFirst(start); i < len(n.items); i++ {
+			if n.items[i].cell > end {
+				break
+			}
+			v := tr.agg.Value(n.items[i].cell, n.items[i].data)
+			agg, ok = tr.combineAgg(agg, ok, v)
+		}
+		return agg, ok
+	}
+	var i int
+	if start > base {
+		i, _ = n.findChild(tr.cellIndex(start, bits))
+	}
+	for ; i < len(n.nodes); i++ {
+		cellStart := base | uint64(n.nodes[i].index)<<bits
+		if cellStart > end {
+			break
+		}
+		if n.nodes[i].count == 0 {
+			continue
+		}
+		cellEnd := cellStart | (uint64(1)<<bits - 1)
+		if cellStart >= start && cellEnd <= end {
+			// the entire node is in the range
+			agg, ok = tr.combineAgg(agg, ok, n.nodes[i].agg)
+		} else if v, vok := n.nodes[i].rangeAggregate(tr, start, end,
+			bits-tr.numBits, cellStart); vok {
+			agg, ok = tr.combineAgg(agg, ok, v)
+		}
+	}
+	return agg, ok
+}
+
+// combineAgg combines the v value into agg. The ok param is false when agg
+// has no values yet.
+func (tr *Tree) combineAgg(agg interface{}, ok bool, v interface{},
+) (interface{}, bool) {
+	if !ok {
+		return v, true
+	}
+	return tr.agg.Combine(agg, v), true
+}
+
+// updateAggs recomputes the aggregates for all nodes that intersect the
+// inclusive [start,end] range. This should be called after items in the range
+// have been changed.
+func (tr *Tree) updateAggs(start, end uint64) {
+	if tr.agg != nil && tr.root != nil {
+		tr.root.updateAggs(tr, start, end, 64-tr.numBits, 0)
+	}
+}
+
+func (n *node) updateAggs(
+	tr *Tree, start, end uint64, bits uint, base uint64,
+) {
+	if n.branch {
+		var i int
+		if start > base {
+			i, _ = n.findChild(tr.cellIndex(start, bits))
+		}
+		for ; i < len(n.nodes); i++ {
+			cellStart := base | uint64(n.nodes[i].index)<<bits
+			if cellStart > end {
+				break
+			}
+			if n.nodes[i].count > 0 {
+				n.nodes[i].updateAggs(tr, start, end, bits-tr.numBits,
+					cellStart)
+			}
+		}
+	}
+	n.updateAgg(tr)
+}
+
+// computeAggs recomputes the aggregates for the node and all of it's
+// children.
+func (n *node) computeAggs(tr *Tree) {
+	if tr.agg == nil {
+		return
+	}
+	if n.branch {
+		for i := 0; i < len(n.nodes); i++ {
+			if n.nodes[i].count > 0 {
+				n.nodes[i].computeAggs(tr)
+			}
+		}
+	}
+	n.updateAgg(tr)
+}
+
+// updateAgg recomputes the aggregate for the node from it's items, or from
+// the aggregates of the child nodes for a branch.
+func (n *node) updateAgg(tr *Tree) {
+	if tr.agg == nil {
+		return
+	}
+	var agg interface{}
+	var ok bool
+	if !n.branch {
+		for i := 0; i < len(n.items); i++ {
+			v := tr.agg.Value(n.items[i].cell, n.items[i].data)
+			agg, ok = tr.combineAgg(agg, ok, v)
+		}
+	} else {
+		for i := 0; i < len(n.nodes); i++ {
+			if n.nodes[i].count > 0 {
+				agg, ok = tr.combineAgg(agg, ok, n.nodes[i].agg)
+			} else {
+				// do not hold onto the aggregate of an empty node
+				n.nodes[i].agg = nil
+			}
+		}
+	}
+	n.agg = agg
+}
@@ -0,0 +1,168 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package celltree
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+var sumAggregate = Aggregate{
+	Value: func(cell uint64, data interface{}) interface{} {
+		return data.(int)
+	},
+	Combine: func(a, b interface{}) interface{} {
+		return a.(int) + b.(int)
+	},
+}
+
+// saneAggs checks that the aggregate for every node matches it's items.
+func (tr *Tree) saneAggs(t *testing.T) {
+	t.Helper()
+	if tr.root == nil {
+		return
+	}
+	var check func(n *node) interface{}
+	check = func(n *node) interface{} {
+		var agg interface{}
+		var ok bool
+		if !n.branch {
+			for _, item := range n.items {
+				agg, ok = tr.combineAgg(agg, ok,
+					tr.agg.Value(item.cell, item.data))
+			}
+		} else {
+			for i := range n.nodes {
+				if n.nodes[i].count > 0 {
+					agg, ok = tr.combineAgg(agg, ok, check(&n.nodes[i]))
+				}
+			}
+		}
+		if n.agg != agg {
+			t.Fatalf("expected %v, got %v", agg, n.agg)
+		}
+		return agg
+	}
+	check(tr.root)
+}
+
+func TestRangeAggregate(t *testing.T) {
+	var tr Tree
+	if tr.RangeAggregate(0, math.MaxUint64) != nil {
+		t.Fatal("expected nil")
+	}
+	tr.Insert(10, 10)
+	if tr.RangeAggregate(0, math.MaxUint64) != nil {
+		t.Fatal("expected nil")
+	}
+	for i := 0; i < 10; i++ {
+		tr := New(WithAggregate(sumAggregate), WithMaxItems(16),
+			WithFanoutBits(uint(rand.Int()%8+1)))
+		if tr.RangeAggregate(0, math.MaxUint64) != nil {
+			t.Fatal("expected nil")
+		}
+		randCell := func() uint64 {
+			// clustered cells with some duplicates
+			return uint64(rand.Int()%1000) << (rand.Uint64() % 54)
+		}
+		for j := 0; j < 2000; j++ {
+			cell := randCell()
+			switch rand.Int() % 12 {
+			case 0, 1, 2, 3:
+				tr.Insert(cell, rand.Int()%100)
+			case 4:
+				tr.DeleteAll(cell)
+			case 5:
+				tr.Update(cell, func(data interface{}) (interface{}, bool) {
+					return data.(int) + 1, true
+				})
+			case 6:
+				tr.Replace(cell, 7)
+			case 7:
+				tr.InsertMany([]uint64{cell, randCell(), randCell()},
+					[]interface{}{1, 2, 3})
+			case 8:
+				tr.DeleteRange(cell, cell+rand.Uint64()%(1<<40),
+					func(cell uint64, data interface{}) bool {
+						return data.(int)%2 == 0
+					},
+				)
+			case 9:
+				tr.RangeDelete(cell, cell+rand.Uint64()%(1<<40), nil)
+			case 10:
+				tr.DeleteMany([]uint64{cell, randCell()}, []interface{}{1, 2})
+			case 11:
+				if min, ok := tr.Min(); ok {
+					tr.Delete(min, tr.root.first().data)
+				}
+			}
+			if j%100 == 0 {
+				tr.sane()
+				tr.saneAggs(t)
+			}
+		}
+		tr.sane()
+		tr.saneAggs(t)
+		// compare random ranges to the sum of the items
+		for j := 0; j < 1000; j++ {
+			start, end := randCell(), randCell()
+			if start > end {
+				start, end = end, start
+			}
+			if j == 0 {
+				start, end = 0, math.MaxUint64
+			}
+			var expect interface{}
+			var sum int
+			tr.RangeBetween(start, end,
+				func(cell uint64, data interface{}) bool {
+					sum += data.(int)
+					expect = sum
+					return true
+				},
+			)
+			if agg := tr.RangeAggregate(start, end); agg != expect {
+				t.Fatalf("expected %v, got %v", expect, agg)
+			}
+		}
+		// operations that change the structure of the tree
+		tr.Map(func(cell uint64, data interface{}) interface{} {
+			return data.(int) * 2
+		})
+		tr.saneAggs(t)
+		tr.RangeReplace(randCell(), randCell()<<8,
+			func(cell uint64, old interface{}) interface{} {
+				return old.(int) + 1
+			},
+		)
+		tr.saneAggs(t)
+		rtr := tr.SplitAt(randCell())
+		tr.saneAggs(t)
+		rtr.saneAggs(t)
+		rtr.DeletePrefix(randCell(), 20)
+		rtr.saneAggs(t)
+		rtr.Truncate(rtr.Count() / 2)
+		rtr.saneAggs(t)
+		tr.TruncateBefore(randCell())
+		tr.saneAggs(t)
+		tr.TruncateAfter(randCell() << 8)
+		tr.saneAggs(t)
+		start := randCell()
+		tr.ExtractRange(start, start+randCell())
+		tr.saneAggs(t)
+		rtr.Compact()
+		rtr.saneAggs(t)
+		ftr := rtr.Filter(func(cell uint64, data interface{}) bool {
+			return cell%2 == 0
+		})
+		ftr.saneAggs(t)
+		mtr := ftr.emptyCopy()
+		start = randCell()
+		ftr.MoveRange(mtr, start, start+randCell()<<8)
+		ftr.saneAggs(t)
+		mtr.saneAggs(t)
+	}
+}
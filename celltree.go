@@ -4,6 +4,15 @@
 
 package celltree
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// The default tree options. A Tree can override these using NewTree.
 const (
 	numBits  = 7   // [1,2,3,4...8]    match numNodes with the correct numBits
 	numNodes = 128 // [2,4,8,16...256] match numNodes with the correct numBits
@@ -13,22 +22,124 @@ const (
 	minItems = maxItems * 40 / 100 // min num of items in a branch
 )
 
+// Options for NewTree. The zero value for each field uses the default.
+type Options struct {
+	// MaxItems is the maximum number of items in a leaf before it's split
+	// into a branch. Default is 256.
+	MaxItems int
+	// FanoutBits is the number of cell bits that each branch consumes. A
+	// branch has up to 1<<FanoutBits child nodes, and only the non-empty
+	// child nodes are stored. Must be in the range [1,8]. Default is 7,
+	// which is up to 128 child nodes per branch.
+	FanoutBits uint
+	// NodePool enables reusing the memory of released nodes and items.
+	// See WithNodePool.
+	NodePool bool
+	// UniqueCells disallows items with duplicate cells. See WithUniqueCells.
+	UniqueCells bool
+	// Aggregate is maintained for every node. See WithAggregate.
+	Aggregate *Aggregate
+}
+
 type item struct {
 	cell uint64
 	data interface{}
 }
 
+// Item is a single cell and data pair.
+type Item struct {
+	Cell uint64
+	Data interface{}
+}
+
 type node struct {
-	branch bool   // is a branch (not a leaf)
-	items  []item // leaf items
-	nodes  []node // child nodes
-	count  int    // count of all cells for this node and children
+	branch bool        // is a branch (not a leaf)
+	index  uint8       // index of this node in the parent branch
+	items  []item      // leaf items
+	nodes  []node      // non-empty child nodes, sorted by index
+	count  int         // count of all cells for this node and children
+	agg    interface{} // aggregate of all cells, see WithAggregate
 }
 
 // Tree is a uint64 prefix tree
 type Tree struct {
-	count int   // number of items in tree
-	root  *node // root node
+	count    int        // number of items in tree
+	root     *node      // root node
+	numBits  uint       // number of cell bits per branch
+	maxItems int        // max num of items in a leaf
+	minItems int        // min num of items in a branch
+	pool     *nodePool  // free-list of nodes and items, optional
+	unique   bool       // no duplicate cells
+	agg      *Aggregate // aggregate for each node, optional
+}
+
+// NewTree returns a new tree using the provided options. A zero-value Tree
+// is the same as a tree returned by NewTree(Options{}).
+func NewTree(opts Options) *Tree {
+	if opts.MaxItems < 0 {
+		panic("celltree: invalid MaxItems")
+	}
+	if opts.FanoutBits > 8 {
+		panic("celltree: invalid FanoutBits")
+	}
+	tr := &Tree{numBits: opts.FanoutBits, maxItems: opts.MaxItems,
+		unique: opts.UniqueCells, agg: opts.Aggregate}
+	if opts.NodePool {
+		tr.pool = new(nodePool)
+	}
+	tr.init()
+	return tr
+}
+
+// Option is a functional option for New.
+type Option func(opts *Options)
+
+// WithMaxItems sets the maximum number of items in a leaf before it's split
+// into a branch. See Options.MaxItems.
+func WithMaxItems(n int) Option {
+	return func(opts *Options) {
+		opts.MaxItems = n
+	}
+}
+
+// WithFanoutBits sets the number of cell bits that each branch consumes.
+// Smaller values make for a deeper tree, and larger values make for wider
+// branches. See Options.FanoutBits.
+func WithFanoutBits(b uint) Option {
+	return func(opts *Options) {
+		opts.FanoutBits = b
+	}
+}
+
+// WithUniqueCells makes a tree that stores at most one item per cell.
+// Inserting a cell that already exists replaces the data of the existing
+// item, and Delete with nil data removes the item regardless of it's data.
+// For InsertOrReplace, when the cond func returns false the existing item is
+// kept and nothing is inserted.
+func WithUniqueCells() Option {
+	return func(opts *Options) {
+		opts.UniqueCells = true
+	}
+}
+
+// New returns a new tree using the provided functional options.
+func New(opts ...Option) *Tree {
+	var o Options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return NewTree(o)
+}
+
+// init fills in the defaults for any unset options.
+func (tr *Tree) init() {
+	if tr.numBits == 0 {
+		tr.numBits = numBits
+	}
+	if tr.maxItems == 0 {
+		tr.maxItems = maxItems
+	}
+	tr.minItems = tr.maxItems * 40 / 100
 }
 
 // Count returns the number of items in the tree.
@@ -40,6 +151,179 @@ func cellIndex(cell uint64, bits uint) int {
 	return int(cell >> bits & uint64(numNodes-1))
 }
 
+func (tr *Tree) cellIndex(cell uint64, bits uint) int {
+	return int(cell >> bits & (1<<tr.numBits - 1))
+}
+
+func (tr *Tree) maxDepth(bits uint) bool {
+	return bits < tr.numBits
+}
+
+// findChild returns the position of the child node for the index in the
+// branch's child nodes. The found param is false when the branch has no child
+// node for the index, and the position is where it would be inserted.
+func (n *node) findChild(index int) (i int, found bool) {
+	if index < len(n.nodes) && int(n.nodes[index].index) == index {
+		// all of the child nodes up to the index exist, which is always
+		// true for a full branch
+		return index, true
+	}
+	i, j := 0, len(n.nodes)
+	for i < j {
+		h := i + (j-i)/2
+		if index > int(n.nodes[h].index) {
+			i = h + 1
+		} else {
+			j = h
+		}
+	}
+	return i, i < len(n.nodes) && int(n.nodes[i].index) == index
+}
+
+// child returns the child node for the index, adding an empty child node to
+// the branch when it does not exist. Pointers to other child nodes of the
+// branch are invalid after adding a node.
+func (n *node) child(tr *Tree, index int) *node {
+	i, found := n.findChild(index)
+	if !found {
+		if tr.pool != nil && len(n.nodes) == cap(n.nodes) {
+			n.nodes = tr.growNodes(n.nodes)
+		}
+		n.nodes = append(n.nodes, node{})
+		copy(n.nodes[i+1:], n.nodes[i:len(n.nodes)-1])
+		n.nodes[i] = node{index: uint8(index)}
+	}
+	return &n.nodes[i]
+}
+
+// removeChild removes the child node at position i from the branch. The
+// child node must be empty.
+func (n *node) removeChild(tr *Tree, i int) {
+	copy(n.nodes[i:], n.nodes[i+1:])
+	n.nodes[len(n.nodes)-1] = node{}
+	n.nodes = n.nodes[:len(n.nodes)-1]
+	n.shrinkNodes(tr)
+}
+
+// removeEmptyChildren removes all of the child nodes that have no items
+// from the branch.
+func (n *node) removeEmptyChildren(tr *Tree) {
+	var j int
+	for i := 0; i < len(n.nodes); {
+		if n.nodes[i].count == 0 {
+			i++
+			continue
+		}
+		// move each run of non-empty nodes at once
+		k := i + 1
+		for k < len(n.nodes) && n.nodes[k].count > 0 {
+			k++
+		}
+		if j < i {
+			copy(n.nodes[j:], n.nodes[i:k])
+		}
+		j += k - i
+		i = k
+	}
+	if j == len(n.nodes) {
+		return
+	}
+	for i := j; i < len(n.nodes); i++ {
+		n.nodes[i] = node{}
+	}
+	n.nodes = n.nodes[:j]
+	n.shrinkNodes(tr)
+}
+
+// shrinkNodes reallocates the child nodes of a branch when the number of
+// nodes has fallen to a quarter or less of it's capacity.
+func (n *node) shrinkNodes(tr *Tree) {
+	if len(n.nodes) > cap(n.nodes)/4 {
+		return
+	}
+	nodes := tr.allocNodes(len(n.nodes))
+	copy(nodes, n.nodes)
+	tr.releaseNodes(n.nodes)
+	n.nodes = nodes
+}
+
+// load fills an empty tree with items that are already sorted by cell. For
+// unique trees only the last item of each duplicate cell is loaded.
+func (tr *Tree) load(items []item) {
+	if len(items) == 0 {
+		return
+	}
+	if tr.unique {
+		items = uniqueItems(items)
+	}
+	root := tr.buildNode(items, 64-tr.numBits)
+	tr.root = &root
+	tr.count = len(items)
+}
+
+// uniqueItems removes all but the last item of each duplicate cell from items
+// that are sorted by cell. The items array is reused.
+func uniqueItems(items []item) []item {
+	var j int
+	for i := 0; i < len(items); i++ {
+		if j > 0 && items[j-1].cell == items[i].cell {
+			j--
+		}
+		items[j] = items[i]
+		j++
+	}
+	return items[:j]
+}
+
+// buildNode creates a node from items that are sorted by cell. Each leaf is
+// given a copy of it's items.
+func (tr *Tree) buildNode(items []item, bits uint) node {
+	if len(items) <= tr.maxItems || tr.maxDepth(bits) {
+		// leaf node
+		var n node
+		if len(items) > 0 {
+			n.items = make([]item, len(items))
+			copy(n.items, items)
+			n.count = len(items)
+		}
+		n.updateAgg(tr)
+		return n
+	}
+	// branch node
+	n := node{branch: true, count: len(items)}
+	// count the child nodes first, so that they are allocated once
+	n.nodes = tr.allocNodes(tr.countChildren(items, bits))[:0]
+	for len(items) > 0 {
+		// group all of the items that belong to the same child node
+		index := tr.cellIndex(items[0].cell, bits)
+		i := 1
+		for ; i < len(items); i++ {
+			if tr.cellIndex(items[i].cell, bits) != index {
+				break
+			}
+		}
+		child := tr.buildNode(items[:i], bits-tr.numBits)
+		child.index = uint8(index)
+		n.nodes = append(n.nodes, child)
+		items = items[i:]
+	}
+	n.updateAgg(tr)
+	return n
+}
+
+// countChildren returns the number of child nodes that the sorted items
+// belong to in a branch.
+func (tr *Tree) countChildren(items []item, bits uint) int {
+	var count int
+	for i := 0; i < len(items); i++ {
+		if i == 0 || tr.cellIndex(items[i].cell, bits) !=
+			tr.cellIndex(items[i-1].cell, bits) {
+			count++
+		}
+	}
+	return count
+}
+
 // InsertOrReplace inserts an item into the tree. Items are ordered by it's
 // cell. The extra param is a simple user context value. The cond function is
 // used to allow for replacing an existing cell with a new cell. When the
@@ -50,12 +334,34 @@ func (tr *Tree) InsertOrReplace(
 	cell uint64, data interface{},
 	cond func(data interface{}) (newData interface{}, replace bool),
 ) {
+	tr.insert(cell, data, cond)
+}
+
+// InsertTracked inserts an item into the tree like Insert. The inserted
+// param is false when the item replaced the data of an existing cell in a
+// tree that uses WithUniqueCells. The split param is true when inserting the
+// item split a full leaf into a branch.
+func (tr *Tree) InsertTracked(cell uint64, data interface{}) (
+	inserted, split bool,
+) {
+	return tr.insert(cell, data, nil)
+}
+
+func (tr *Tree) insert(
+	cell uint64, data interface{},
+	cond func(data interface{}) (newData interface{}, replace bool),
+) (inserted, split bool) {
 	if tr.root == nil {
+		tr.init()
 		tr.root = new(node)
 	}
-	if tr.root.insert(cell, data, 64-numBits, cond) {
+	inserted, split = tr.root.insert(tr, cell, data, 64-tr.numBits, cond,
+		nil)
+	if inserted {
 		tr.count++
 	}
+	tr.updateAggs(cell, cell)
+	return inserted, split
 }
 
 // Insert inserts an item into the tree. Items are ordered by it's cell.
@@ -64,37 +370,277 @@ func (tr *Tree) Insert(cell uint64, data interface{}) {
 	tr.InsertOrReplace(cell, data, nil)
 }
 
-func (n *node) splitLeaf(bits uint) {
+// InsertIfAbsent inserts an item into the tree only when there are no items
+// with the same cell. Returns true if the item was inserted. The tree is not
+// modified when the cell already exists.
+func (tr *Tree) InsertIfAbsent(cell uint64, data interface{}) bool {
+	if n := tr.findLeaf(cell); n != nil {
+		if i := n.findLeafItemBin(cell); i > 0 && n.items[i-1].cell == cell {
+			return false
+		}
+	}
+	tr.Insert(cell, data)
+	return true
+}
+
+// Replace sets the data for the first item that has the provided cell. The
+// item is never inserted. Returns true if the item was found.
+func (tr *Tree) Replace(cell uint64, data interface{}) bool {
+	n := tr.findLeaf(cell)
+	if n == nil {
+		return false
+	}
+	i := n.findLeafItemFirst(cell)
+	if i == len(n.items) || n.items[i].cell != cell {
+		return false
+	}
+	n.items[i].data = data
+	tr.updateAggs(cell, cell)
+	return true
+}
+
+// GetOrInsert returns the data for the first item that has the provided
+// cell. When there are no items with the cell, then the create function is
+// called and it's result is inserted and returned. The loaded param is true
+// if the data was already in the tree.
+func (tr *Tree) GetOrInsert(
+	cell uint64, create func() interface{},
+) (data interface{}, loaded bool) {
+	if tr.root == nil {
+		tr.init()
+		tr.root = new(node)
+	}
+	// the cond is called for the duplicates from the last to the first, and
+	// never replaces, so it's left with the data of the first.
+	inserted, _ := tr.root.insert(tr, cell, nil, 64-tr.numBits,
+		func(existing interface{}) (interface{}, bool) {
+			data, loaded = existing, true
+			return nil, false
+		},
+		func() interface{} {
+			data = create()
+			return data
+		},
+	)
+	if inserted {
+		tr.count++
+		tr.updateAggs(cell, cell)
+	}
+	return data, loaded
+}
+
+// InsertItems inserts multiple items into the tree. When the tree is empty
+// and the items are already sorted by cell, the tree is bulk loaded.
+func (tr *Tree) InsertItems(items []Item) {
+	if tr.count == 0 && len(items) > 0 {
+		sorted := true
+		for i := 1; i < len(items); i++ {
+			if items[i].Cell < items[i-1].Cell {
+				sorted = false
+				break
+			}
+		}
+		if sorted {
+			litems := make([]item, len(items))
+			for i := range items {
+				litems[i] = item{cell: items[i].Cell, data: items[i].Data}
+			}
+			tr.init()
+			tr.load(litems)
+			return
+		}
+	}
+	for i := range items {
+		tr.Insert(items[i].Cell, items[i].Data)
+	}
+}
+
+// InsertMany inserts multiple items into the tree. The data param may be nil,
+// otherwise it must be the same length as cells. Inserting cells that are
+// sorted is faster, because the items for each leaf are inserted together.
+func (tr *Tree) InsertMany(cells []uint64, data []interface{}) {
+	if data != nil && len(data) != len(cells) {
+		panic("celltree: mismatched cells and data")
+	}
+	if len(cells) == 0 {
+		return
+	}
+	items := make([]item, len(cells))
+	sorted := true
+	for i := range cells {
+		items[i].cell = cells[i]
+		if data != nil {
+			items[i].data = data[i]
+		}
+		if i > 0 && cells[i] < cells[i-1] {
+			sorted = false
+		}
+	}
+	if !sorted {
+		// stable keeps duplicate cells in the same order as Insert would
+		sort.SliceStable(items, func(i, j int) bool {
+			return items[i].cell < items[j].cell
+		})
+	}
+	tr.insertSorted(items)
+}
+
+// insertSorted inserts items that are sorted by cell into the tree.
+func (tr *Tree) insertSorted(items []item) {
+	if tr.count == 0 {
+		tr.init()
+		tr.load(items)
+		return
+	}
+	if tr.unique {
+		// the items may replace existing items
+		for i := range items {
+			tr.Insert(items[i].cell, items[i].data)
+		}
+		return
+	}
+	tr.root.insertMany(tr, items, 64-tr.numBits)
+	tr.count += len(items)
+	tr.updateAggs(items[0].cell, items[len(items)-1].cell)
+}
+
+// insertMany inserts items that are sorted by cell into the node.
+func (n *node) insertMany(tr *Tree, items []item, bits uint) {
+	if n.branch {
+		n.count += len(items)
+		for len(items) > 0 {
+			// group all of the items that belong to the same child node
+			index := tr.cellIndex(items[0].cell, bits)
+			i := 1
+			for ; i < len(items); i++ {
+				if tr.cellIndex(items[i].cell, bits) != index {
+					break
+				}
+			}
+			n.child(tr, index).insertMany(tr, items[:i], bits-tr.numBits)
+			items = items[i:]
+		}
+		return
+	}
+	m := len(n.items)
+	if !tr.maxDepth(bits) && m+len(items) > tr.maxItems {
+		// too many items for the leaf, so merge all of the items and
+		// rebuild the node.
+		merged := make([]item, m+len(items))
+		mergeItems(merged, n.items, items)
+		tr.releaseItems(n.items)
+		index := n.index
+		*n = tr.buildNode(merged, bits)
+		n.index = index
+		return
+	}
+	if m+len(items) > cap(n.items) {
+		// grow the items array
+		if tr.pool != nil {
+			nitems := tr.allocItems(m + len(items))
+			copy(nitems, n.items)
+			tr.releaseItems(n.items)
+			n.items = nitems
+		} else {
+			n.items = append(n.items, items...)
+		}
+	}
+	n.items = n.items[:m+len(items)]
+	mergeItems(n.items, n.items[:m], items)
+	n.count = len(n.items)
+}
+
+// mergeItems merges the sorted a and b arrays into dst, which must have a
+// length of len(a)+len(b). The a array may be a prefix of dst. Items in b are
+// placed after any items in a with the same cell.
+func mergeItems(dst, a, b []item) {
+	i, j := len(a)-1, len(b)-1
+	for w := len(dst) - 1; j >= 0; w-- {
+		if i >= 0 && a[i].cell > b[j].cell {
+			dst[w] = a[i]
+			i--
+		} else {
+			dst[w] = b[j]
+			j--
+		}
+	}
+	if len(a) > 0 && &dst[0] != &a[0] {
+		copy(dst, a[:i+1])
+	}
+}
+
+// FromSortedSlice returns a new tree that is built from items that are
+// already sorted by cell. Returns an error if an item is out of order.
+func FromSortedSlice(items []Item) (*Tree, error) {
+	litems := make([]item, len(items))
+	for i := range items {
+		if i > 0 && items[i].Cell < items[i-1].Cell {
+			return nil, fmt.Errorf("celltree: item %d is out of order", i)
+		}
+		litems[i] = item{cell: items[i].Cell, data: items[i].Data}
+	}
+	tr := new(Tree)
+	tr.init()
+	tr.load(litems)
+	return tr, nil
+}
+
+func (n *node) splitLeaf(tr *Tree, bits uint) {
 	n.branch = true
 	// reset the node count to zero
 	n.count = 0
-	// create space for all of the nodes
-	n.nodes = make([]node, numNodes)
+	// only the child nodes that the items are routed to are created, and
+	// they are counted first so that they are allocated once.
+	n.nodes = tr.allocNodes(tr.countChildren(n.items, bits))[:0]
 	// reinsert all of leaf items
 	for i := 0; i < len(n.items); i++ {
-		n.insert(n.items[i].cell, n.items[i].data, bits, nil)
+		n.insert(tr, n.items[i].cell, n.items[i].data, bits, nil, nil)
 	}
 	// release the leaf items
+	tr.releaseItems(n.items)
 	n.items = nil
+	n.computeAggs(tr)
 }
 
 func maxDepth(bits uint) bool {
 	return bits < numBits
 }
 
+// insert inserts the cell into the node. The cond function is called for the
+// existing items with the same cell, from the last to the first, and can
+// replace the data of one of them instead of inserting. When create is not
+// nil, nothing is inserted if the cell already exists, otherwise the data of
+// the new item is the result of create. The create param requires a cond.
 func (n *node) insert(
-	cell uint64, data interface{}, bits uint,
+	tr *Tree, cell uint64, data interface{}, bits uint,
 	cond func(data interface{}) (newData interface{}, replace bool),
-) (inserted bool) {
+	create func() interface{},
+) (inserted, split bool) {
 	if !n.branch {
 		// leaf node
-		atcap := !maxDepth(bits) && len(n.items) >= maxItems
+		if tr.unique {
+			// replace the existing item instead of inserting a duplicate
+			i := n.findLeafItemBin(cell)
+			if i > 0 && n.items[i-1].cell == cell {
+				newData, replace := data, true
+				if cond != nil {
+					newData, replace = cond(n.items[i-1].data)
+				}
+				if replace {
+					n.items[i-1].data = newData
+				}
+				return false, false
+			}
+			cond = nil
+		}
+		atcap := !tr.maxDepth(bits) && len(n.items) >= tr.maxItems
 	insertAgain:
 		if atcap && cond == nil {
 			// split leaf. it's at capacity
-			n.splitLeaf(bits)
+			n.splitLeaf(tr, bits)
 			// insert item again, but this time node is a branch
-			n.insert(cell, data, bits, nil)
+			n.insert(tr, cell, data, bits, nil, create)
+			split = true
 			// we need to deduct one item from the count, otherwise it'll be
 			// the target cell will be counted twice
 			n.count--
@@ -107,6 +653,12 @@ func (n *node) insert(
 					cond = nil
 					goto insertAgain
 				}
+				if tr.pool != nil && len(n.items) == cap(n.items) {
+					n.items = tr.growItems(n.items)
+				}
+				if create != nil {
+					data = create()
+				}
 				n.items = append(n.items, item{cell: cell, data: data})
 			} else {
 				// locate the index of the cell in the leaf
@@ -124,9 +676,14 @@ func (n *node) insert(
 							// must replace the cell data instead of inserting
 							// a new one.
 							n.items[i].data = newData
-							return false
+							return false, false
 						}
 					}
+					if create != nil && index > 0 &&
+						n.items[index-1].cell == cell {
+						// the cell exists, so nothing is created
+						return false, false
+					}
 					// condition func was not safisfied. this means that the
 					// new item will be inserted/
 					if atcap {
@@ -135,25 +692,33 @@ func (n *node) insert(
 					}
 				}
 				// create space for the new cell
+				if tr.pool != nil && len(n.items) == cap(n.items) {
+					n.items = tr.growItems(n.items)
+				}
 				n.items = append(n.items, item{})
 				// move other cells over to make room for new cell
 				copy(n.items[index+1:], n.items[index:len(n.items)-1])
 				// assign the new cell
+				if create != nil {
+					data = create()
+				}
 				n.items[index] = item{cell: cell, data: data}
 			}
 		}
 	} else {
 		// branch node
 		// locate the index of the child node in the leaf
-		index := cellIndex(cell, bits)
+		index := tr.cellIndex(cell, bits)
 		// insert the cell into the child node
-		if !n.nodes[index].insert(cell, data, bits-numBits, cond) {
-			return false
+		inserted, split = n.child(tr, index).insert(tr, cell, data,
+			bits-tr.numBits, cond, create)
+		if !inserted {
+			return false, false
 		}
 	}
 	// increment the node
 	n.count++
-	return true
+	return true, split
 }
 
 // findLeafItemSeqIns position where the return value is the index for
@@ -184,20 +749,69 @@ func (n *node) findLeafItemBin(cell uint64) int {
 	return i
 }
 
+// findLeafItemFirst returns the index of the first item in the items array
+// that has a cell that is greater than or equal to the provided cell.
+func (n *node) findLeafItemFirst(cell uint64) int {
+	i, j := 0, len(n.items)
+	for i < j {
+		h := i + (j-i)/2
+		if cell > n.items[h].cell {
+			i = h + 1
+		} else {
+			j = h
+		}
+	}
+	return i
+}
+
+// shrinkItems should be called after items have been removed from a leaf.
+// It releases the items array when empty, otherwise it reallocates the array
+// when the number of items has fallen to 40% or less of it's capacity.
+func (n *node) shrinkItems(tr *Tree) {
+	if len(n.items) == 0 {
+		tr.releaseItems(n.items)
+		n.items = nil
+		return
+	}
+	// check if the base array needs to be shrunk/reallocated.
+	ncap := cap(n.items)
+	min := ncap * 40 / 100
+	if len(n.items) <= min {
+		for len(n.items) <= min {
+			ncap /= 2
+			min = ncap * 40 / 100
+		}
+		// shrink and realloc the array
+		var items []item
+		if tr.pool != nil {
+			items = tr.allocItems(len(n.items))
+		} else {
+			items = make([]item, len(n.items), ncap)
+		}
+		copy(items, n.items)
+		tr.releaseItems(n.items)
+		n.items = items
+	}
+}
+
 // Delete removes an item from the tree based on it's cell and data values.
-func (tr *Tree) Delete(cell uint64, data interface{}) {
+// Returns true if an item was removed.
+func (tr *Tree) Delete(cell uint64, data interface{}) bool {
 	if tr.root == nil {
-		return
+		return false
 	}
-	if tr.root.nodeDelete(cell, data, 64-numBits, nil) {
+	_, deleted := tr.root.nodeDelete(tr, cell, data, 64-tr.numBits, nil)
+	if deleted {
 		tr.count--
+		tr.updateAggs(cell, cell)
 	}
+	return deleted
 }
 
 func (n *node) nodeDelete(
-	cell uint64, data interface{}, bits uint,
+	tr *Tree, cell uint64, data interface{}, bits uint,
 	cond func(data interface{}) bool,
-) (deleted bool) {
+) (old interface{}, deleted bool) {
 	if !n.branch {
 		// leaf node
 		i := n.findLeafItemBin(cell) - 1
@@ -206,21 +820,31 @@ func (n *node) nodeDelete(
 				// did not find
 				break
 			}
-			if (cond == nil && n.items[i].data == data) ||
+			if (cond == nil && (n.items[i].data == data ||
+				(tr.unique && data == nil))) ||
 				(cond != nil && cond(n.items[i].data)) {
 				// found the cell, remove it now
+				old = n.items[i].data
 				// if the len of items has fallen below 40% of it's cap then
 				// shrink the items
 				if len(n.items) == 1 {
 					// do not have non-nil leaves hanging around
+					tr.releaseItems(n.items)
 					n.items = nil
 				} else {
 					min := cap(n.items) * 40 / 100
 					if len(n.items)-1 <= min {
 						// shrink and realloc the array
-						items := make([]item, len(n.items)-1, cap(n.items)/2)
+						var items []item
+						if tr.pool != nil {
+							items = tr.allocItems(len(n.items) - 1)
+						} else {
+							items = make([]item, len(n.items)-1,
+								cap(n.items)/2)
+						}
 						copy(items[:i], n.items[:i])
 						copy(items[i:], n.items[i+1:len(n.items)])
+						tr.releaseItems(n.items)
 						n.items = items
 					} else {
 						// keep the same array
@@ -235,139 +859,2068 @@ func (n *node) nodeDelete(
 		}
 	} else {
 		// branch node
-		index := cellIndex(cell, bits)
-		deleted = n.nodes[index].nodeDelete(cell, data, bits-numBits, cond)
+		i, found := n.findChild(tr.cellIndex(cell, bits))
+		if !found {
+			return nil, false
+		}
+		old, deleted = n.nodes[i].nodeDelete(tr, cell, data,
+			bits-tr.numBits, cond)
+		if deleted && n.nodes[i].count == 0 {
+			n.removeChild(tr, i)
+		}
 	}
 	if deleted {
 		// an item was deleted from this node or a child node
 		// decrement the counter
 		n.count--
-		if n.branch && n.count <= minItems {
+		if n.branch && n.count <= tr.minItems {
 			// compact the branch into a leaf
-			n.compactBranch()
+			n.compactBranch(tr)
 		}
 	}
-	return deleted
+	return old, deleted
 }
 
-// DeleteWhen removes an item from the tree based on it's cell and when the
-// cond func returns true. It will delete at most a maximum of one item.
-func (tr *Tree) DeleteWhen(cell uint64, cond func(data interface{}) bool) {
-	if tr.root == nil {
-		return
+// DeleteMany removes multiple items from the tree based on their cell and
+// data values. The data param may be nil, otherwise it must be the same
+// length as cells. Each cell/data pair removes at most one item, just like
+// Delete. Returns the number of items deleted.
+func (tr *Tree) DeleteMany(cells []uint64, data []interface{}) int {
+	if data != nil && len(data) != len(cells) {
+		panic("celltree: mismatched cells and data")
 	}
-	if tr.root.nodeDelete(cell, nil, 64-numBits, cond) {
-		tr.count--
+	if tr.root == nil || len(cells) == 0 {
+		return 0
 	}
-}
-
-func (n *node) flatten(items []item) []item {
-	if !n.branch {
-		items = append(items, n.items...)
-	} else {
-		for _, child := range n.nodes {
-			if child.count > 0 {
-				items = child.flatten(items)
-			}
+	items := make([]item, len(cells))
+	for i := range cells {
+		items[i].cell = cells[i]
+		if data != nil {
+			items[i].data = data[i]
 		}
 	}
-	return items
-}
-
-func (n *node) compactBranch() {
-	n.items = n.flatten(nil)
-	n.branch = false
-	n.nodes = nil
-	n.count = len(n.items)
-}
-
-// Scan iterates over the entire tree. Return false from iter function to stop.
-func (tr *Tree) Scan(iter func(cell uint64, data interface{}) bool) {
-	if tr.root == nil {
-		return
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].cell < items[j].cell
+	})
+	var marks []bool
+	deleted := tr.root.nodeDeleteMany(tr, items, 64-tr.numBits, &marks)
+	tr.count -= deleted
+	if deleted > 0 {
+		tr.updateAggs(items[0].cell, items[len(items)-1].cell)
 	}
-	tr.root.scan(iter)
+	return deleted
 }
 
-func (n *node) scan(iter func(cell uint64, data interface{}) bool) bool {
+// nodeDeleteMany deletes items that are sorted by cell from the node. The
+// marks param is a reusable buffer for flagging the leaf items to delete.
+func (n *node) nodeDeleteMany(
+	tr *Tree, items []item, bits uint, marks *[]bool,
+) (deleted int) {
 	if !n.branch {
+		// leaf node
+		if len(*marks) < len(n.items) {
+			*marks = make([]bool, len(n.items))
+		}
+		mark := (*marks)[:len(n.items)]
+		for _, target := range items {
+			i := n.findLeafItemBin(target.cell) - 1
+			for ; i >= 0 && n.items[i].cell == target.cell; i-- {
+				if !mark[i] && (n.items[i].data == target.data ||
+					(tr.unique && target.data == nil)) {
+					mark[i] = true
+					deleted++
+					break
+				}
+			}
+		}
+		if deleted == 0 {
+			return 0
+		}
+		// remove the marked items in one pass
+		var j int
 		for i := 0; i < len(n.items); i++ {
-			if !iter(n.items[i].cell, n.items[i].data) {
-				return false
+			if mark[i] {
+				mark[i] = false
+			} else {
+				n.items[j] = n.items[i]
+				j++
 			}
 		}
+		for i := j; i < len(n.items); i++ {
+			n.items[i] = item{}
+		}
+		n.items = n.items[:j]
+		n.shrinkItems(tr)
 	} else {
-		for i := 0; i < len(n.nodes); i++ {
-			if n.nodes[i].count > 0 {
-				if !n.nodes[i].scan(iter) {
-					return false
+		// branch node
+		for len(items) > 0 {
+			// group all of the items that belong to the same child node
+			index := tr.cellIndex(items[0].cell, bits)
+			i := 1
+			for ; i < len(items); i++ {
+				if tr.cellIndex(items[i].cell, bits) != index {
+					break
 				}
 			}
+			if j, found := n.findChild(index); found {
+				deleted += n.nodes[j].nodeDeleteMany(tr, items[:i],
+					bits-tr.numBits, marks)
+			}
+			items = items[i:]
+		}
+		if deleted == 0 {
+			return 0
 		}
+		n.removeEmptyChildren(tr)
 	}
-	return true
-}
-
-// Range iterates over the tree starting with the start param.
-func (tr *Tree) Range(
-	start uint64,
-	iter func(cell uint64, data interface{}) bool,
-) {
-	if tr.root != nil {
-		tr.root.nodeRange(start, 64-numBits, false, iter)
+	n.count -= deleted
+	if n.branch && n.count <= tr.minItems {
+		// compact the branch into a leaf
+		n.compactBranch(tr)
 	}
+	return deleted
 }
 
-func (n *node) nodeRange(
-	start uint64, bits uint, hit bool,
-	iter func(cell uint64, data interface{}) bool,
+// DeleteWhen removes an item from the tree based on it's cell and when the
+// cond func returns true. It will delete at most a maximum of one item.
+// Returns the data of the deleted item.
+func (tr *Tree) DeleteWhen(
+	cell uint64, cond func(data interface{}) bool,
+) (data interface{}, deleted bool) {
+	if tr.root == nil {
+		return nil, false
+	}
+	data, deleted = tr.root.nodeDelete(tr, cell, nil, 64-tr.numBits, cond)
+	if deleted {
+		tr.count--
+		tr.updateAggs(cell, cell)
+	}
+	return data, deleted
+}
+
+// DeleteAll removes all items from the tree that match the provided cell.
+// Returns the number of items deleted.
+func (tr *Tree) DeleteAll(cell uint64) int {
+	if tr.root == nil {
+		return 0
+	}
+	deleted := tr.root.nodeDeleteAll(tr, cell, 64-tr.numBits, nil)
+	tr.count -= deleted
+	if deleted > 0 {
+		tr.updateAggs(cell, cell)
+	}
+	return deleted
+}
+
+// DeleteWhenAll removes all items from the tree that match the provided cell
+// and when the cond func returns true. Unlike DeleteWhen, the cond func is
+// called for every item with the cell. Returns the number of items deleted.
+func (tr *Tree) DeleteWhenAll(
+	cell uint64, cond func(data interface{}) bool,
+) int {
+	if tr.root == nil {
+		return 0
+	}
+	deleted := tr.root.nodeDeleteAll(tr, cell, 64-tr.numBits, cond)
+	tr.count -= deleted
+	if deleted > 0 {
+		tr.updateAggs(cell, cell)
+	}
+	return deleted
+}
+
+// nodeDeleteAll removes the items that match the cell. When cond is not nil
+// only the items that it returns true for are removed.
+func (n *node) nodeDeleteAll(
+	tr *Tree, cell uint64, bits uint, cond func(data interface{}) bool,
+) (deleted int) {
+	if !n.branch {
+		// leaf node
+		// all duplicate cells are contiguous in the leaf
+		i := n.findLeafItemFirst(cell)
+		j := n.findLeafItemBin(cell)
+		if cond != nil {
+			// move the items to keep to the front of the run
+			k := i
+			for ; i < j; i++ {
+				if !cond(n.items[i].data) {
+					n.items[k] = n.items[i]
+					k++
+				}
+			}
+			i = k
+		}
+		deleted = j - i
+		if deleted == 0 {
+			return 0
+		}
+		copy(n.items[i:], n.items[j:])
+		for k := len(n.items) - deleted; k < len(n.items); k++ {
+			n.items[k] = item{}
+		}
+		n.items = n.items[:len(n.items)-deleted]
+		n.shrinkItems(tr)
+	} else {
+		// branch node
+		i, found := n.findChild(tr.cellIndex(cell, bits))
+		if !found {
+			return 0
+		}
+		deleted = n.nodes[i].nodeDeleteAll(tr, cell, bits-tr.numBits, cond)
+		if deleted == 0 {
+			return 0
+		}
+		if n.nodes[i].count == 0 {
+			n.removeChild(tr, i)
+		}
+	}
+	n.count -= deleted
+	if n.branch && n.count <= tr.minItems {
+		// compact the branch into a leaf
+		n.compactBranch(tr)
+	}
+	return deleted
+}
+
+// ReplaceAll sets the data for all items in the tree that match the provided
+// cell. Returns the number of items updated.
+func (tr *Tree) ReplaceAll(cell uint64, data interface{}) int {
+	n := tr.findLeaf(cell)
+	if n == nil {
+		return 0
+	}
+	// all duplicate cells are contiguous in the leaf
+	i := n.findLeafItemFirst(cell)
+	j := n.findLeafItemBin(cell)
+	for k := i; k < j; k++ {
+		n.items[k].data = data
+	}
+	tr.updateAggs(cell, cell)
+	return j - i
+}
+
+// Update changes the data for an item with the provided cell. The fn function
+// is called for each item with the cell until it returns true, and then the
+// item data is replaced with newData. It will update at most one item.
+// Returns true if an item was updated.
+func (tr *Tree) Update(
+	cell uint64, fn func(data interface{}) (newData interface{}, ok bool),
+) bool {
+	n := tr.findLeaf(cell)
+	if n == nil {
+		return false
+	}
+	for i := n.findLeafItemFirst(cell); i < len(n.items); i++ {
+		if n.items[i].cell != cell {
+			break
+		}
+		if newData, ok := fn(n.items[i].data); ok {
+			n.items[i].data = newData
+			tr.updateAggs(cell, cell)
+			return true
+		}
+	}
+	return false
+}
+
+// UpdateAll replaces the data for all items in the tree that match the
+// provided cell with the result of the fn function. Returns the number of
+// items updated.
+func (tr *Tree) UpdateAll(
+	cell uint64, fn func(data interface{}) interface{},
+) int {
+	n := tr.findLeaf(cell)
+	if n == nil {
+		return 0
+	}
+	i := n.findLeafItemFirst(cell)
+	j := n.findLeafItemBin(cell)
+	for k := i; k < j; k++ {
+		n.items[k].data = fn(n.items[k].data)
+	}
+	tr.updateAggs(cell, cell)
+	return j - i
+}
+
+// findLeaf returns the leaf node that the cell belongs to. Returns nil when
+// the tree has no leaf for the cell.
+func (tr *Tree) findLeaf(cell uint64) *node {
+	n := tr.root
+	if n == nil {
+		return nil
+	}
+	bits := 64 - tr.numBits
+	for n.branch {
+		i, found := n.findChild(tr.cellIndex(cell, bits))
+		if !found {
+			return nil
+		}
+		n = &n.nodes[i]
+		bits -= tr.numBits
+	}
+	return n
+}
+
+// Map replaces the data for every item in the tree with the result of the
+// transform function. The cells and structure of the tree are unchanged.
+func (tr *Tree) Map(transform func(cell uint64, data interface{}) interface{}) {
+	if tr.root != nil {
+		tr.root.mapData(transform)
+		tr.root.computeAggs(tr)
+	}
+}
+
+func (n *node) mapData(
+	transform func(cell uint64, data interface{}) interface{},
+) {
+	if !n.branch {
+		for i := 0; i < len(n.items); i++ {
+			n.items[i].data = transform(n.items[i].cell, n.items[i].data)
+		}
+		return
+	}
+	for i := 0; i < len(n.nodes); i++ {
+		n.nodes[i].mapData(transform)
+	}
+}
+
+// RangeReplace replaces the data for every item in the inclusive [start,end]
+// range with the result of the fn function. The cells, counts, and structure
+// of the tree are unchanged, so no nodes are split, shrunk, or compacted.
+func (tr *Tree) RangeReplace(
+	start, end uint64,
+	fn func(cell uint64, old interface{}) (newData interface{}),
+) {
+	if tr.root == nil || start > end {
+		return
+	}
+	tr.root.nodeRangeReplace(tr, start, end, 64-tr.numBits, 0, fn)
+	tr.updateAggs(start, end)
+}
+
+// nodeRangeReplace replaces the data for the items in the [start,end] range.
+// Returns false once a cell is past the end.
+func (n *node) nodeRangeReplace(
+	tr *Tree, start, end uint64, bits uint, base uint64,
+	fn func(cell uint64, old interface{}) (newData interface{}),
+) bool {
+	if !n.branch {
+		for i := n.findLeafItemFirst(start); i < len(n.items); i++ {
+			if n.items[i].cell > end {
+				return false
+			}
+			n.items[i].data = fn(n.items[i].cell, n.items[i].data)
+		}
+		return true
+	}
+	var i int
+	if start > base {
+		i, _ = n.findChild(tr.cellIndex(start, bits))
+	}
+	for ; i < len(n.nodes); i++ {
+		cellStart := base | uint64(n.nodes[i].index)<<bits
+		if cellStart > end {
+			// this node and all following nodes are past the end
+			return false
+		}
+		if !n.nodes[i].nodeRangeReplace(tr, start, end, bits-tr.numBits,
+			cellStart, fn) {
+			return false
+		}
+	}
+	return true
+}
+
+func (n *node) flatten(items []item) []item {
+	if !n.branch {
+		items = append(items, n.items...)
+	} else {
+		for i := 0; i < len(n.nodes); i++ {
+			items = n.nodes[i].flatten(items)
+		}
+	}
+	return items
+}
+
+func (n *node) compactBranch(tr *Tree) {
+	var items []item
+	if tr.pool != nil {
+		items = tr.allocItems(n.count)[:0]
+	}
+	items = n.flatten(items)
+	tr.releaseNode(n)
+	n.items = items
+	n.branch = false
+	n.nodes = nil
+	n.count = len(n.items)
+}
+
+// Compact reclaims memory by collapsing any branch that has too few items
+// into a leaf, and by shrinking the leaf items arrays to fit.
+func (tr *Tree) Compact() {
+	if tr.root != nil {
+		tr.root.compact(tr)
+	}
+}
+
+func (n *node) compact(tr *Tree) {
+	if n.branch {
+		if n.count <= tr.minItems {
+			n.compactBranch(tr)
+		} else {
+			for i := 0; i < len(n.nodes); i++ {
+				n.nodes[i].compact(tr)
+			}
+			if len(n.nodes) < cap(n.nodes) {
+				nodes := make([]node, len(n.nodes))
+				copy(nodes, n.nodes)
+				tr.releaseNodes(n.nodes)
+				n.nodes = nodes
+			}
+			return
+		}
+	}
+	if len(n.items) < cap(n.items) {
+		items := make([]item, len(n.items))
+		copy(items, n.items)
+		tr.releaseItems(n.items)
+		n.items = items
+	}
+}
+
+// emptyCopy returns a new empty tree with the same options as the tree.
+func (tr *Tree) emptyCopy() *Tree {
+	ntr := &Tree{numBits: tr.numBits, maxItems: tr.maxItems,
+		unique: tr.unique, agg: tr.agg}
+	if tr.pool != nil {
+		ntr.pool = new(nodePool)
+	}
+	ntr.init()
+	return ntr
+}
+
+// Filter returns a new tree that contains only the items that the keep
+// function returns true for. The new tree uses the same options.
+func (tr *Tree) Filter(keep func(cell uint64, data interface{}) bool) *Tree {
+	var items []item
+	tr.Scan(func(cell uint64, data interface{}) bool {
+		if keep(cell, data) {
+			items = append(items, item{cell: cell, data: data})
+		}
+		return true
+	})
+	ntr := tr.emptyCopy()
+	ntr.load(items)
+	return ntr
+}
+
+// CopyRange returns a new tree with the same options that has a copy of the
+// items in the inclusive [start,end] range. The tree is not modified.
+func (tr *Tree) CopyRange(start, end uint64) *Tree {
+	ntr := tr.emptyCopy()
+	if tr.root == nil || start > end {
+		return ntr
+	}
+	n := tr.root.nodeCountRange(tr, start, end, 64-tr.numBits, 0)
+	if n == 0 {
+		return ntr
+	}
+	items := make([]item, 0, n)
+	tr.root.nodeRangeBetween(tr, start, end, 64-tr.numBits, 0,
+		func(cell uint64, data interface{}) bool {
+			items = append(items, item{cell: cell, data: data})
+			return true
+		},
+	)
+	ntr.load(items)
+	return ntr
+}
+
+// MoveRange removes the items in the inclusive [start,end] range from the
+// tree and inserts them into the dst tree. Returns the number of items moved.
+// When both trees have the same fanout bits and max items, the nodes that are
+// fully inside of the range are moved to dst as a whole, and only the leaves
+// at the edges of the range have their items copied. Otherwise, or when dst
+// has unique cells, the items are inserted into dst in sorted order.
+func (tr *Tree) MoveRange(dst *Tree, start, end uint64) int {
+	if tr.root == nil || start > end || dst == tr {
+		return 0
+	}
+	dst.init()
+	if dst.numBits != tr.numBits || dst.maxItems != tr.maxItems ||
+		dst.unique {
+		n := tr.root.nodeCountRange(tr, start, end, 64-tr.numBits, 0)
+		if n == 0 {
+			return 0
+		}
+		items := make([]item, 0, n)
+		tr.root.nodeRangeBetween(tr, start, end, 64-tr.numBits, 0,
+			func(cell uint64, data interface{}) bool {
+				items = append(items, item{cell: cell, data: data})
+				return true
+			},
+		)
+		tr.RangeDelete(start, end, nil)
+		dst.insertSorted(items)
+		return n
+	}
+	if dst.root == nil {
+		dst.root = new(node)
+	}
+	moved := tr.root.nodeMoveSpan(tr, dst, dst.root, start, end,
+		64-tr.numBits, 0)
+	if moved > 0 {
+		tr.count -= moved
+		dst.count += moved
+		tr.updateAggs(start, end)
+		dst.updateAggs(start, end)
+	}
+	return moved
+}
+
+// nodeMoveSpan moves the items in the [start,end] range from the node to the
+// d node, which is the node in the dst tree for the same cells. A child node
+// that is entirely within the range is moved as a whole when the matching
+// dst child node is empty.
+func (n *node) nodeMoveSpan(
+	tr, dst *Tree, d *node, start, end uint64, bits uint, base uint64,
+) (moved int) {
+	if !n.branch {
+		i := n.findLeafItemFirst(start)
+		j := n.findLeafItemBin(end)
+		if i == j {
+			return 0
+		}
+		d.insertMany(dst, n.items[i:j], bits)
+		return n.nodeDeleteSpan(tr, start, end, bits, base, nil)
+	}
+	if !d.branch {
+		// the dst node must be a branch to take the child nodes
+		d.splitLeaf(dst, bits)
+	}
+	var i int
+	if start > base {
+		i, _ = n.findChild(tr.cellIndex(start, bits))
+	}
+	for ; i < len(n.nodes); i++ {
+		index := int(n.nodes[i].index)
+		cellStart := base | uint64(index)<<bits
+		if cellStart > end {
+			break
+		}
+		cellEnd := cellStart | (uint64(1)<<bits - 1)
+		if _, found := d.findChild(index); !found &&
+			cellStart >= start && cellEnd <= end {
+			// move the node altogether
+			moved += n.nodes[i].count
+			*d.child(dst, index) = n.nodes[i]
+			n.nodes[i] = node{index: uint8(index)}
+		} else {
+			moved += n.nodes[i].nodeMoveSpan(tr, dst, d.child(dst, index),
+				start, end, bits-tr.numBits, cellStart)
+		}
+	}
+	n.removeEmptyChildren(tr)
+	d.removeEmptyChildren(dst)
+	n.count -= moved
+	d.count += moved
+	if n.count <= tr.minItems {
+		// compact the branch into a leaf
+		n.compactBranch(tr)
+	}
+	if d.count <= dst.minItems {
+		d.compactBranch(dst)
+	}
+	return moved
+}
+
+// SplitAt splits the tree into two trees at the pivot cell. All items with
+// cells that are less than the pivot stay in the tree, and the items that are
+// greater than or equal to the pivot are moved to the returned tree. Only the
+// nodes along the path to the pivot are visited, all other nodes are moved
+// as-is.
+func (tr *Tree) SplitAt(pivot uint64) *Tree {
+	ntr := tr.emptyCopy()
+	if tr.root == nil {
+		return ntr
+	}
+	right := tr.root.splitAt(tr, pivot, 64-tr.numBits)
+	if right.count > 0 {
+		ntr.root = &right
+		ntr.count = right.count
+		tr.count -= right.count
+		tr.updateAggs(pivot, math.MaxUint64)
+		ntr.updateAggs(0, pivot)
+	}
+	return ntr
+}
+
+// Split divides the tree at the pivot cell into two new trees. The left tree
+// has all items with cells that are less than the pivot, and the right tree
+// has the items that are greater than or equal to the pivot. The nodes are
+// moved to the new trees, leaving the tree empty. See SplitAt.
+func (tr *Tree) Split(pivot uint64) (left, right *Tree) {
+	right = tr.SplitAt(pivot)
+	left = tr.emptyCopy()
+	left.root, left.count = tr.root, tr.count
+	tr.root, tr.count = nil, 0
+	return left, right
+}
+
+// splitAt removes the items that are greater than or equal to the pivot from
+// the node and returns them in a new node.
+func (n *node) splitAt(tr *Tree, pivot uint64, bits uint) (right node) {
+	if !n.branch {
+		i := n.findLeafItemFirst(pivot)
+		if i == len(n.items) {
+			return right
+		}
+		right.index = n.index
+		right.items = make([]item, len(n.items)-i)
+		copy(right.items, n.items[i:])
+		right.count = len(right.items)
+		for j := i; j < len(n.items); j++ {
+			n.items[j] = item{}
+		}
+		n.items = n.items[:i]
+		n.count = i
+		n.shrinkItems(tr)
+		return right
+	}
+	right.branch = true
+	right.index = n.index
+	i, found := n.findChild(tr.cellIndex(pivot, bits))
+	// the child node for the pivot is split, and all of the nodes after it
+	// are moved.
+	right.nodes = tr.allocNodes(len(n.nodes) - i)[:0]
+	if found {
+		child := n.nodes[i].splitAt(tr, pivot, bits-tr.numBits)
+		if child.count > 0 {
+			right.nodes = append(right.nodes, child)
+		}
+		i++
+	}
+	for j := i; j < len(n.nodes); j++ {
+		right.nodes = append(right.nodes, n.nodes[j])
+		n.nodes[j] = node{}
+	}
+	n.nodes = n.nodes[:i]
+	n.removeEmptyChildren(tr)
+	for j := range right.nodes {
+		right.count += right.nodes[j].count
+	}
+	n.count -= right.count
+	if n.count <= tr.minItems {
+		n.compactBranch(tr)
+	}
+	if right.count <= tr.minItems {
+		right.compactBranch(tr)
+	}
+	return right
+}
+
+// Scan iterates over the entire tree. Return false from iter function to stop.
+func (tr *Tree) Scan(iter func(cell uint64, data interface{}) bool) {
+	if tr.root == nil {
+		return
+	}
+	tr.root.scan(iter)
+}
+
+// Stop can be returned from the iter function of ScanErr and RangeErr to stop
+// the iteration without an error.
+var Stop = errors.New("celltree: stop")
+
+// ScanErr iterates over the entire tree. Return a non-nil error from the iter
+// function to stop, which is then returned by ScanErr. Returning Stop also
+// stops, but ScanErr returns nil.
+func (tr *Tree) ScanErr(iter func(cell uint64, data interface{}) error) error {
+	var err error
+	tr.Scan(func(cell uint64, data interface{}) bool {
+		err = iter(cell, data)
+		return err == nil
+	})
+	if err == Stop {
+		return nil
+	}
+	return err
+}
+
+// ScanFilter iterates over the entire tree, in order, calling the iter
+// function only for the items where the pred function returns true. Return
+// false from iter function to stop.
+func (tr *Tree) ScanFilter(
+	pred func(cell uint64, data interface{}) bool,
+	iter func(cell uint64, data interface{}) bool,
+) {
+	tr.Scan(func(cell uint64, data interface{}) bool {
+		return !pred(cell, data) || iter(cell, data)
+	})
+}
+
+// contextCheckItems is the number of items visited between each check of the
+// context by ScanContext and RangeContext.
+const contextCheckItems = 1024
+
+// contextIter wraps the iter function with one that stops when the context
+// is done, which sets err to the context's error.
+func contextIter(
+	ctx context.Context, err *error,
+	iter func(cell uint64, data interface{}) bool,
+) func(cell uint64, data interface{}) bool {
+	var count int
+	return func(cell uint64, data interface{}) bool {
+		count++
+		if count%contextCheckItems == 0 {
+			if *err = ctx.Err(); *err != nil {
+				return false
+			}
+		}
+		return iter(cell, data)
+	}
+}
+
+// ScanContext iterates over the entire tree until the context is done. The
+// context is checked before the first item and then after every 1024 items.
+// Returns the context's error when it's done, otherwise nil. Return false
+// from iter function to stop.
+func (tr *Tree) ScanContext(
+	ctx context.Context,
+	iter func(cell uint64, data interface{}) bool,
+) error {
+	err := ctx.Err()
+	if err == nil {
+		tr.Scan(contextIter(ctx, &err, iter))
+	}
+	return err
+}
+
+// Items returns a channel that streams all of the items in the tree in
+// ascending order, using a new goroutine. The channel has a buffer of buf
+// items, and it's closed after the last item or when the context is done.
+// A caller that stops receiving early must cancel the context, otherwise the
+// goroutine is blocked forever. The tree must not be changed until the
+// channel is closed.
+func (tr *Tree) Items(ctx context.Context, buf int) <-chan Item {
+	ch := make(chan Item, buf)
+	go func() {
+		defer close(ch)
+		done := ctx.Done()
+		it := newLeafIter(tr.root)
+		for items := it.next(); items != nil; items = it.next() {
+			if ctx.Err() != nil {
+				return
+			}
+			for i := range items {
+				select {
+				case ch <- Item{Cell: items[i].cell, Data: items[i].data}:
+				case <-done:
+					return
+				}
+			}
+		}
+	}()
+	return ch
+}
+
+// maxStackDepth is the greatest number of branches from the root to a leaf,
+// which happens when a tree uses one bit per branch.
+const maxStackDepth = 65
+
+// scanFrame is a branch being scanned and the index of it's next child.
+type scanFrame struct {
+	n     *node
+	index int
+}
+
+// scan iterates over the items in the node. It walks the branches using an
+// explicit stack rather than by recursion, which avoids a function call for
+// every node in deep trees. Returns false when the iterator should stop.
+func (n *node) scan(iter func(cell uint64, data interface{}) bool) bool {
+	var stack [maxStackDepth]scanFrame
+	var depth int
+	for {
+		if !n.branch {
+			for i := 0; i < len(n.items); i++ {
+				if !iter(n.items[i].cell, n.items[i].data) {
+					return false
+				}
+			}
+		} else {
+			stack[depth] = scanFrame{n, 0}
+			depth++
+		}
+		// find the next non-empty child node
+		n = nil
+		for depth > 0 {
+			f := &stack[depth-1]
+			if f.index >= len(f.n.nodes) {
+				depth--
+				continue
+			}
+			child := &f.n.nodes[f.index]
+			f.index++
+			if child.count > 0 {
+				n = child
+				break
+			}
+		}
+		if n == nil {
+			return true
+		}
+	}
+}
+
+// ScanSeek iterates over the entire tree, allowing for the iterator to skip
+// ahead. Returning a seekTo that is greater than the current cell will jump
+// to the first item that has a cell that is greater than or equal to seekTo.
+// Nodes that are skipped over are not visited. Otherwise the iteration
+// continues with the next item. Return false from iter function to stop.
+func (tr *Tree) ScanSeek(
+	iter func(cell uint64, data interface{}) (seekTo uint64, ok bool),
+) {
+	if tr.root == nil {
+		return
+	}
+	var seek uint64
+	tr.root.nodeScanSeek(tr, 64-tr.numBits, 0, &seek, iter)
+}
+
+// nodeScanSeek iterates over the items in the node, skipping those that are
+// less than seek. The seek param is shared by all nodes and is updated by the
+// iterator. Returns false when the iterator should stop.
+func (n *node) nodeScanSeek(
+	tr *Tree, bits uint, base uint64, seek *uint64,
+	iter func(cell uint64, data interface{}) (seekTo uint64, ok bool),
+) bool {
+	if !n.branch {
+		i := n.findLeafItemFirst(*seek)
+		for i < len(n.items) {
+			seekTo, ok := iter(n.items[i].cell, n.items[i].data)
+			if !ok {
+				return false
+			}
+			if seekTo > n.items[i].cell {
+				*seek = seekTo
+				i = n.findLeafItemFirst(seekTo)
+			} else {
+				i++
+			}
+		}
+		return true
+	}
+	// the last possible cell for this node
+	nodeEnd := base | (uint64(1)<<(bits+tr.numBits) - 1)
+	var i int
+	if *seek > base {
+		i, _ = n.findChild(tr.cellIndex(*seek, bits))
+	}
+	for i < len(n.nodes) {
+		cellStart := base | uint64(n.nodes[i].index)<<bits
+		cellEnd := cellStart | (uint64(1)<<bits - 1)
+		if *seek > cellEnd {
+			if *seek > nodeEnd {
+				// the seek is past this node
+				return true
+			}
+			// jump to the node for the seek
+			i, _ = n.findChild(tr.cellIndex(*seek, bits))
+			continue
+		}
+		if n.nodes[i].count > 0 {
+			if !n.nodes[i].nodeScanSeek(tr, bits-tr.numBits, cellStart,
+				seek, iter) {
+				return false
+			}
+		}
+		i++
+	}
+	return true
+}
+
+// ScanBatch iterates over the entire tree one leaf at a time. The iter
+// function is passed the cells and data for all of the items in a leaf, in
+// order. The slices are reused and are only valid until the iter function
+// returns. Return false from iter function to stop.
+func (tr *Tree) ScanBatch(iter func(cells []uint64, data []interface{}) bool) {
+	var cells []uint64
+	var data []interface{}
+	it := newLeafIter(tr.root)
+	for items := it.next(); items != nil; items = it.next() {
+		if cap(cells) < len(items) {
+			cells = make([]uint64, len(items))
+			data = make([]interface{}, len(items))
+		}
+		cells = cells[:len(items)]
+		data = data[:len(items)]
+		for i := range items {
+			cells[i] = items[i].cell
+			data[i] = items[i].data
+		}
+		if !iter(cells, data) {
+			return
+		}
+	}
+}
+
+// leafIter iterates over the non-empty leaves of a tree, in order.
+type leafIter struct {
+	stack []leafIterFrame
+}
+
+type leafIterFrame struct {
+	n     *node
+	index int
+}
+
+func newLeafIter(root *node) leafIter {
+	var it leafIter
+	if root != nil {
+		it.stack = append(it.stack,
+			leafIterFrame{n: root})
+	}
+	return it
+}
+
+// next returns the items for the next leaf, or nil when there are no more
+// leaves.
+func (it *leafIter) next() []item {
+	for len(it.stack) > 0 {
+		f := &it.stack[len(it.stack)-1]
+		if !f.n.branch || f.index >= len(f.n.nodes) {
+			items := f.n.items
+			it.stack = it.stack[:len(it.stack)-1]
+			if len(items) > 0 {
+				return items
+			}
+			continue
+		}
+		child := &f.n.nodes[f.index]
+		f.index++
+		if child.count > 0 {
+			it.stack = append(it.stack,
+				leafIterFrame{n: child})
+		}
+	}
+	return nil
+}
+
+// Equal returns true if both trees contain the same items in the same order.
+// The eq function is used to compare the data of two items with the same
+// cell, and when nil the data is compared using ==.
+func (tr *Tree) Equal(other *Tree, eq func(a, b interface{}) bool) bool {
+	if tr.count != other.count {
+		return false
+	}
+	it1, it2 := newLeafIter(tr.root), newLeafIter(other.root)
+	var items1, items2 []item
+	for {
+		if len(items1) == 0 {
+			items1 = it1.next()
+		}
+		if len(items2) == 0 {
+			items2 = it2.next()
+		}
+		if len(items1) == 0 || len(items2) == 0 {
+			return len(items1) == len(items2)
+		}
+		n := len(items1)
+		if len(items2) < n {
+			n = len(items2)
+		}
+		for i := 0; i < n; i++ {
+			if items1[i].cell != items2[i].cell {
+				return false
+			}
+			if eq == nil {
+				if items1[i].data != items2[i].data {
+					return false
+				}
+			} else if !eq(items1[i].data, items2[i].data) {
+				return false
+			}
+		}
+		items1, items2 = items1[n:], items2[n:]
+	}
+}
+
+// ScanDescending iterates over the entire tree in descending order. Return
+// false from iter function to stop.
+func (tr *Tree) ScanDescending(iter func(cell uint64, data interface{}) bool) {
+	if tr.root == nil {
+		return
+	}
+	tr.root.scanDescending(iter)
+}
+
+func (n *node) scanDescending(
+	iter func(cell uint64, data interface{}) bool,
+) bool {
+	if !n.branch {
+		for i := len(n.items) - 1; i >= 0; i-- {
+			if !iter(n.items[i].cell, n.items[i].data) {
+				return false
+			}
+		}
+	} else {
+		for i := len(n.nodes) - 1; i >= 0; i-- {
+			if n.nodes[i].count > 0 {
+				if !n.nodes[i].scanDescending(iter) {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// Min returns the smallest cell in the tree. Returns false if the tree is
+// empty.
+func (tr *Tree) Min() (cell uint64, ok bool) {
+	if tr.count == 0 {
+		return 0, false
+	}
+	return tr.root.first().cell, true
+}
+
+// SeekFirstGreater returns the first item that has a cell that is greater
+// than the provided cell. When there are duplicates of the returned cell, the
+// data is from the first of those items. Returns false if no item exists.
+func (tr *Tree) SeekFirstGreater(cell uint64) (
+	next uint64, data interface{}, ok bool,
+) {
+	if tr.root == nil || cell == math.MaxUint64 {
+		return 0, nil, false
+	}
+	tr.root.nodeRangeBetween(tr, cell+1, math.MaxUint64, 64-tr.numBits, 0,
+		func(cell uint64, value interface{}) bool {
+			next, data, ok = cell, value, true
+			return false
+		},
+	)
+	return next, data, ok
+}
+
+// Max returns the largest cell in the tree. Returns false if the tree is
+// empty.
+func (tr *Tree) Max() (cell uint64, ok bool) {
+	if tr.count == 0 {
+		return 0, false
+	}
+	return tr.root.last().cell, true
+}
+
+// first returns the first item in a non-empty node.
+func (n *node) first() *item {
+	for n.branch {
+		n = &n.nodes[0]
+	}
+	return &n.items[0]
+}
+
+// last returns the last item in a non-empty node.
+func (n *node) last() *item {
+	for n.branch {
+		n = &n.nodes[len(n.nodes)-1]
+	}
+	return &n.items[len(n.items)-1]
+}
+
+// Range iterates over the tree starting with the start param.
+func (tr *Tree) Range(
+	start uint64,
+	iter func(cell uint64, data interface{}) bool,
+) {
+	if tr.root != nil {
+		tr.root.nodeRange(tr, start, 64-tr.numBits, false, iter)
+	}
+}
+
+// RangeErr iterates over the tree starting with the pivot param. Return a
+// non-nil error from the iter function to stop, which is then returned by
+// RangeErr. Returning Stop also stops, but RangeErr returns nil.
+func (tr *Tree) RangeErr(
+	pivot uint64,
+	iter func(cell uint64, data interface{}) error,
+) error {
+	var err error
+	tr.Range(pivot, func(cell uint64, data interface{}) bool {
+		err = iter(cell, data)
+		return err == nil
+	})
+	if err == Stop {
+		return nil
+	}
+	return err
+}
+
+// RangeContext iterates over the tree starting with the pivot param until
+// the context is done. The context is checked before the first item and then
+// after every 1024 items. Returns the context's error when it's done,
+// otherwise nil. Return false from iter function to stop.
+func (tr *Tree) RangeContext(
+	ctx context.Context, pivot uint64,
+	iter func(cell uint64, data interface{}) bool,
+) error {
+	err := ctx.Err()
+	if err == nil {
+		tr.Range(pivot, contextIter(ctx, &err, iter))
+	}
+	return err
+}
+
+// RangeWithIndex iterates over the tree starting with the start param. The
+// index param is the position of the item in the iteration, starting with
+// zero for the first item.
+func (tr *Tree) RangeWithIndex(
+	start uint64,
+	iter func(index int, cell uint64, data interface{}) bool,
+) {
+	var index int
+	tr.Range(start, func(cell uint64, data interface{}) bool {
+		index++
+		return iter(index-1, cell, data)
+	})
+}
+
+// RangeLimit iterates over the tree starting with the pivot param, and stops
+// after limit items. A limit of zero or less means no limit.
+func (tr *Tree) RangeLimit(
+	pivot uint64, limit int,
+	iter func(cell uint64, data interface{}) bool,
+) {
+	if limit <= 0 {
+		tr.Range(pivot, iter)
+		return
+	}
+	tr.Range(pivot, func(cell uint64, data interface{}) bool {
+		limit--
+		return iter(cell, data) && limit > 0
+	})
+}
+
+// Cursor is a position in the tree for paging with ScanFrom. The Cell is the
+// last cell seen, and Seen is the number of items with that cell that have
+// been seen, which allows for a page to end in the middle of a run of
+// duplicate cells. The zero value Cursor is the position before the first
+// item.
+type Cursor struct {
+	Cell uint64
+	Seen int
+}
+
+// ScanFrom iterates over a page of at most limit items, resuming strictly
+// after the cursor. Pass the zero value Cursor for the first page, and then
+// pass the returned nextCursor for the following pages. The done param is
+// true when there are no more items. A limit of zero or less means no limit.
+// When the iter function returns false the page ends after that item.
+func (tr *Tree) ScanFrom(
+	cursor Cursor, limit int,
+	iter func(cell uint64, data interface{}) bool,
+) (nextCursor Cursor, done bool) {
+	nextCursor = cursor
+	skip := cursor.Seen
+	var count int
+	var stop bool
+	done = true
+	tr.RangeBetween(cursor.Cell, math.MaxUint64,
+		func(cell uint64, data interface{}) bool {
+			if skip > 0 && cell == cursor.Cell {
+				// seen on a previous page
+				skip--
+				return true
+			}
+			if stop || (limit > 0 && count >= limit) {
+				// the page is full, and there are more items
+				done = false
+				return false
+			}
+			count++
+			if cell == nextCursor.Cell {
+				nextCursor.Seen++
+			} else {
+				nextCursor = Cursor{Cell: cell, Seen: 1}
+			}
+			// keep going after a stop to find out if there are more items
+			stop = !iter(cell, data)
+			return true
+		},
+	)
+	return nextCursor, done
+}
+
+// RangeBetween iterates over the items in the inclusive [start,end] range, in
+// order. Nodes that are past the end are never visited, which makes this
+// faster than using Range and stopping once a cell is past the end.
+func (tr *Tree) RangeBetween(
+	start, end uint64,
+	iter func(cell uint64, data interface{}) bool,
+) {
+	if tr.root != nil && start <= end {
+		tr.root.nodeRangeBetween(tr, start, end, 64-tr.numBits, 0, iter)
+	}
+}
+
+func (n *node) nodeRange(
+	tr *Tree, start uint64, bits uint, hit bool,
+	iter func(cell uint64, data interface{}) bool,
 ) (hitout bool, ok bool) {
 	if !n.branch {
-		for _, item := range n.items {
-			if item.cell < start {
+		for _, item := range n.items {
+			if item.cell < start {
+				continue
+			}
+			if !iter(item.cell, item.data) {
+				return false, false
+			}
+		}
+		return true, true
+	}
+	var i int
+	if !hit {
+		var found bool
+		i, found = n.findChild(tr.cellIndex(start, bits))
+		if !found {
+			// the following child nodes are past the start
+			hit = true
+		}
+	}
+	for ; i < len(n.nodes); i++ {
+		hit, ok = n.nodes[i].nodeRange(tr, start, bits-tr.numBits, hit, iter)
+		if !ok {
+			return false, false
+		}
+	}
+	// all following nodes are past the start
+	return true, true
+}
+
+// prefixSpan returns the first and last cells for a prefix.
+func prefixSpan(prefix uint64, prefixBits uint) (start, end uint64) {
+	if prefixBits > 64 {
+		panic("celltree: invalid prefixBits")
+	}
+	mask := uint64(1)<<(64-prefixBits) - 1
+	return prefix &^ mask, prefix | mask
+}
+
+// PrefixScan iterates over all items that have cells sharing the same high
+// prefixBits as the prefix param. The prefixBits must be in the range [0,64].
+// A prefixBits of zero will iterate over the entire tree.
+func (tr *Tree) PrefixScan(
+	prefix uint64, prefixBits uint,
+	iter func(cell uint64, data interface{}) bool,
+) {
+	start, end := prefixSpan(prefix, prefixBits)
+	if tr.root == nil {
+		return
+	}
+	n := tr.root
+	bits := 64 - tr.numBits
+	for n.branch {
+		if 64-bits > prefixBits {
+			// the prefix covers multiple child nodes, all of which are
+			// entirely within the prefix.
+			last := tr.cellIndex(end, bits)
+			i, _ := n.findChild(tr.cellIndex(start, bits))
+			for ; i < len(n.nodes) && int(n.nodes[i].index) <= last; i++ {
+				if n.nodes[i].count > 0 {
+					if !n.nodes[i].scan(iter) {
+						return
+					}
+				}
+			}
+			return
+		}
+		// the prefix is entirely within a single child node
+		i, found := n.findChild(tr.cellIndex(start, bits))
+		if !found {
+			return
+		}
+		n = &n.nodes[i]
+		bits -= tr.numBits
+	}
+	for i := n.findLeafItemFirst(start); i < len(n.items); i++ {
+		if n.items[i].cell > end {
+			return
+		}
+		if !iter(n.items[i].cell, n.items[i].data) {
+			return
+		}
+	}
+}
+
+// ScanPrefix is the same as PrefixScan.
+func (tr *Tree) ScanPrefix(
+	prefix uint64, prefixBits uint,
+	iter func(cell uint64, data interface{}) bool,
+) {
+	tr.PrefixScan(prefix, prefixBits, iter)
+}
+
+// ToSlice returns all of the items in the tree, in order.
+func (tr *Tree) ToSlice() []Item {
+	if tr.count == 0 {
+		return nil
+	}
+	items := make([]Item, 0, tr.count)
+	tr.Scan(func(cell uint64, data interface{}) bool {
+		items = append(items, Item{Cell: cell, Data: data})
+		return true
+	})
+	return items
+}
+
+// RangeBetweenReverse iterates over the items in the inclusive [start,end]
+// range, in descending order.
+func (tr *Tree) RangeBetweenReverse(
+	start, end uint64,
+	iter func(cell uint64, data interface{}) bool,
+) {
+	if tr.root != nil && start <= end {
+		tr.root.nodeRangeBetweenReverse(tr, start, end, 64-tr.numBits, 0,
+			iter)
+	}
+}
+
+// nodeRangeBetweenReverse iterates over all items in the [start,end] range
+// in descending order. Returns false when the iterator should stop, which
+// also happens once a cell is before the start.
+func (n *node) nodeRangeBetweenReverse(
+	tr *Tree, start, end uint64, bits uint, base uint64,
+	iter func(cell uint64, data interface{}) bool,
+) bool {
+	if !n.branch {
+		for i := n.findLeafItemBin(end) - 1; i >= 0; i-- {
+			if n.items[i].cell < start {
+				return false
+			}
+			if !iter(n.items[i].cell, n.items[i].data) {
+				return false
+			}
+		}
+		return true
+	}
+	i := len(n.nodes) - 1
+	if end < base|(uint64(1)<<(bits+tr.numBits)-1) {
+		var found bool
+		i, found = n.findChild(tr.cellIndex(end, bits))
+		if !found {
+			// start with the node before the end
+			i--
+		}
+	}
+	for ; i >= 0; i-- {
+		cellStart := base | uint64(n.nodes[i].index)<<bits
+		cellEnd := cellStart | (uint64(1)<<bits - 1)
+		if cellEnd < start {
+			// this node and all previous nodes are before the start
+			return false
+		}
+		if n.nodes[i].count > 0 {
+			if !n.nodes[i].nodeRangeBetweenReverse(tr, start, end,
+				bits-tr.numBits, cellStart, iter) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// MultiRange iterates over the items in multiple inclusive [start,end]
+// ranges, in order, using a single traversal of the tree. Ranges may be in any
+// order and may overlap, but each item is visited at most once. Ranges where
+// start is greater than end are ignored.
+func (tr *Tree) MultiRange(
+	ranges [][2]uint64,
+	iter func(cell uint64, data interface{}) bool,
+) {
+	if tr.root == nil || len(ranges) == 0 {
+		return
+	}
+	// ranges that are already sorted and do not overlap are used as-is,
+	// otherwise they are sorted and merged.
+	merged := ranges
+	for i := 0; i < len(ranges); i++ {
+		if ranges[i][0] > ranges[i][1] ||
+			(i > 0 && ranges[i][0] <= ranges[i-1][1]) {
+			merged = mergeRanges(ranges)
+			break
+		}
+	}
+	if len(merged) == 0 {
+		return
+	}
+	tr.root.nodeMultiRange(tr, merged, 64-tr.numBits, 0, iter)
+}
+
+// mergeRanges returns a sorted copy of the ranges, with the overlapping and
+// adjacent ranges merged together.
+func mergeRanges(ranges [][2]uint64) [][2]uint64 {
+	sorted := make([][2]uint64, 0, len(ranges))
+	for _, r := range ranges {
+		if r[0] <= r[1] {
+			sorted = append(sorted, r)
+		}
+	}
+	sort.Sort(rangesByStart(sorted))
+	merged := sorted[:0]
+	for _, r := range sorted {
+		if len(merged) > 0 {
+			last := &merged[len(merged)-1]
+			if r[0] <= last[1] || r[0]-1 == last[1] {
+				if r[1] > last[1] {
+					last[1] = r[1]
+				}
 				continue
 			}
-			if !iter(item.cell, item.data) {
-				return false, false
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+type rangesByStart [][2]uint64
+
+func (r rangesByStart) Len() int           { return len(r) }
+func (r rangesByStart) Less(i, j int) bool { return r[i][0] < r[j][0] }
+func (r rangesByStart) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+// nodeMultiRange iterates over the items in the ranges, which are sorted and
+// do not overlap. Child nodes that do not intersect any range are skipped.
+func (n *node) nodeMultiRange(
+	tr *Tree, ranges [][2]uint64, bits uint, base uint64,
+	iter func(cell uint64, data interface{}) bool,
+) bool {
+	if !n.branch {
+		for _, r := range ranges {
+			for i := n.findLeafItemFirst(r[0]); i < len(n.items); i++ {
+				if n.items[i].cell > r[1] {
+					break
+				}
+				if !iter(n.items[i].cell, n.items[i].data) {
+					return false
+				}
 			}
 		}
-		return true, true
+		return true
 	}
-	var index int
-	if hit {
-		index = 0
+	var i int
+	if ranges[0][0] > base {
+		i, _ = n.findChild(tr.cellIndex(ranges[0][0], bits))
+	}
+	for i < len(n.nodes) {
+		cellStart := base | uint64(n.nodes[i].index)<<bits
+		cellEnd := cellStart | (uint64(1)<<bits - 1)
+		// skip the ranges that end before this node
+		for len(ranges) > 0 && ranges[0][1] < cellStart {
+			ranges = ranges[1:]
+		}
+		if len(ranges) == 0 {
+			break
+		}
+		if ranges[0][0] > cellEnd {
+			// jump to the node for the next range
+			i, _ = n.findChild(tr.cellIndex(ranges[0][0], bits))
+			continue
+		}
+		if n.nodes[i].count > 0 {
+			// find the ranges that intersect this node
+			j := 1
+			for j < len(ranges) && ranges[j][0] <= cellEnd {
+				j++
+			}
+			if !n.nodes[i].nodeMultiRange(tr, ranges[:j],
+				bits-tr.numBits, cellStart, iter) {
+				return false
+			}
+		}
+		i++
+	}
+	return true
+}
+
+// CountWhere returns the number of items in the tree where the pred function
+// returns true.
+func (tr *Tree) CountWhere(pred func(cell uint64, data interface{}) bool) int {
+	if tr.root == nil {
+		return 0
+	}
+	return tr.root.countWhere(pred)
+}
+
+func (n *node) countWhere(pred func(cell uint64, data interface{}) bool) int {
+	var count int
+	if !n.branch {
+		for i := 0; i < len(n.items); i++ {
+			if pred(n.items[i].cell, n.items[i].data) {
+				count++
+			}
+		}
 	} else {
-		index = cellIndex(start, bits)
+		for i := 0; i < len(n.nodes); i++ {
+			if n.nodes[i].count > 0 {
+				count += n.nodes[i].countWhere(pred)
+			}
+		}
 	}
-	for ; index < len(n.nodes); index++ {
-		if n.nodes[index].count == 0 {
-			hit = true
+	return count
+}
+
+// Reduce folds all of the items in the tree into a single value. The fn
+// function is called for each item in ascending order, with the acc param
+// being the result of the previous call, or initial for the first call.
+// Returns the result of the last call, or initial when the tree is empty.
+func (tr *Tree) Reduce(
+	initial interface{},
+	fn func(acc interface{}, cell uint64, data interface{}) interface{},
+) interface{} {
+	acc := initial
+	tr.Scan(func(cell uint64, data interface{}) bool {
+		acc = fn(acc, cell, data)
+		return true
+	})
+	return acc
+}
+
+// ReduceRange is like Reduce, but only folds the items in the inclusive
+// [start,end] range. Returns initial when the range has no items.
+func (tr *Tree) ReduceRange(
+	start, end uint64, initial interface{},
+	fn func(acc interface{}, cell uint64, data interface{}) interface{},
+) interface{} {
+	acc := initial
+	tr.RangeBetween(start, end, func(cell uint64, data interface{}) bool {
+		acc = fn(acc, cell, data)
+		return true
+	})
+	return acc
+}
+
+// RangeSlice returns the items in the inclusive [start,end] range, in order.
+// At most limit items are returned, and a limit of zero or less returns all
+// items in the range.
+func (tr *Tree) RangeSlice(start, end uint64, limit int) []Item {
+	if tr.root == nil || start > end {
+		return nil
+	}
+	n := tr.root.nodeCountRange(tr, start, end, 64-tr.numBits, 0)
+	if limit > 0 && n > limit {
+		n = limit
+	}
+	if n == 0 {
+		return nil
+	}
+	items := make([]Item, 0, n)
+	tr.root.nodeRangeBetween(tr, start, end, 64-tr.numBits, 0,
+		func(cell uint64, data interface{}) bool {
+			items = append(items, Item{Cell: cell, Data: data})
+			return len(items) < n
+		},
+	)
+	return items
+}
+
+// RangeCount iterates over the items in the inclusive [start,end] range, in
+// order. The remaining param is the number of items in the range that follow
+// the current item, which is zero for the last item.
+func (tr *Tree) RangeCount(
+	start, end uint64,
+	iter func(cell uint64, data interface{}, remaining int) bool,
+) {
+	if tr.root == nil || start > end {
+		return
+	}
+	remaining := tr.root.nodeCountRange(tr, start, end, 64-tr.numBits, 0)
+	tr.root.nodeRangeBetween(tr, start, end, 64-tr.numBits, 0,
+		func(cell uint64, data interface{}) bool {
+			remaining--
+			return iter(cell, data, remaining)
+		},
+	)
+}
+
+// nodeRangeBetween iterates over all items in the [start,end] range. The
+// base param is the first possible cell for the node. Returns false when the
+// iterator should stop, which also happens once a cell is past the end.
+func (n *node) nodeRangeBetween(
+	tr *Tree, start, end uint64, bits uint, base uint64,
+	iter func(cell uint64, data interface{}) bool,
+) bool {
+	if !n.branch {
+		for i := n.findLeafItemFirst(start); i < len(n.items); i++ {
+			if n.items[i].cell > end {
+				return false
+			}
+			if !iter(n.items[i].cell, n.items[i].data) {
+				return false
+			}
+		}
+		return true
+	}
+	var i int
+	if start > base {
+		i, _ = n.findChild(tr.cellIndex(start, bits))
+	}
+	for ; i < len(n.nodes); i++ {
+		cellStart := base | uint64(n.nodes[i].index)<<bits
+		if cellStart > end {
+			// this node and all following nodes are past the end
+			return false
+		}
+		if n.nodes[i].count > 0 {
+			if !n.nodes[i].nodeRangeBetween(tr, start, end,
+				bits-tr.numBits, cellStart, iter) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// CountPrefix returns the number of items that have cells sharing the same
+// high prefixBits as the prefix param. The prefixBits must be in the range
+// [0,64].
+func (tr *Tree) CountPrefix(prefix uint64, prefixBits uint) int {
+	start, end := prefixSpan(prefix, prefixBits)
+	if tr.root == nil {
+		return 0
+	}
+	return tr.root.nodeCountRange(tr, start, end, 64-tr.numBits, 0)
+}
+
+// nodeCountRange returns the number of items in the [start,end] range. Child
+// nodes that are entirely within the range are counted using the node count,
+// thus only the nodes on the start and end boundaries are descended into.
+func (n *node) nodeCountRange(
+	tr *Tree, start, end uint64, bits uint, base uint64,
+) int {
+	if !n.branch {
+		if start > end {
+			return 0
+		}
+		return n.findLeafItemBin(end) - n.findLeafItemFirst(start)
+	}
+	var count int
+	var i int
+	if start > base {
+		i, _ = n.findChild(tr.cellIndex(start, bits))
+	}
+	for ; i < len(n.nodes); i++ {
+		cellStart := base | uint64(n.nodes[i].index)<<bits
+		if cellStart > end {
+			break
+		}
+		if n.nodes[i].count == 0 {
+			continue
+		}
+		cellEnd := cellStart | (uint64(1)<<bits - 1)
+		if cellStart >= start && cellEnd <= end {
+			// the entire node is in range
+			count += n.nodes[i].count
 		} else {
-			hit, ok = n.nodes[index].nodeRange(start, bits-numBits, hit, iter)
-			if !ok {
-				return false, false
+			count += n.nodes[i].nodeCountRange(tr, start, end,
+				bits-tr.numBits, cellStart)
+		}
+	}
+	return count
+}
+
+// DeletePrefix removes all items that have cells sharing the same high
+// prefixBits as the prefix param. The prefixBits must be in the range [0,64].
+// Returns the number of items deleted.
+func (tr *Tree) DeletePrefix(prefix uint64, prefixBits uint) int {
+	start, end := prefixSpan(prefix, prefixBits)
+	if tr.root == nil {
+		return 0
+	}
+	deleted := tr.root.nodeDeleteSpan(tr, start, end, 64-tr.numBits, 0, nil)
+	tr.count -= deleted
+	if deleted > 0 {
+		tr.updateAggs(start, end)
+	}
+	return deleted
+}
+
+// ExtractRange removes all items in the inclusive [start,end] range and
+// returns their cells and data in ascending order. Child nodes that are
+// entirely within the range are dropped as a whole, after their items are
+// copied out. The returned slices are allocated once, using the node counts.
+func (tr *Tree) ExtractRange(start, end uint64) (
+	cells []uint64, data []interface{},
+) {
+	if tr.root == nil || start > end {
+		return nil, nil
+	}
+	n := tr.root.nodeCountRange(tr, start, end, 64-tr.numBits, 0)
+	if n == 0 {
+		return nil, nil
+	}
+	cells = make([]uint64, 0, n)
+	data = make([]interface{}, 0, n)
+	deleted := tr.root.nodeDeleteSpan(tr, start, end, 64-tr.numBits, 0,
+		func(items []item) {
+			for i := range items {
+				cells = append(cells, items[i].cell)
+				data = append(data, items[i].data)
+			}
+		},
+	)
+	tr.count -= deleted
+	tr.updateAggs(start, end)
+	return cells, data
+}
+
+// nodeDeleteSpan deletes all items in the [start,end] range. Child nodes that
+// are entirely within the range are dropped without visiting their items.
+// When removed is not nil it's passed the deleted items, in order, before
+// they are released.
+func (n *node) nodeDeleteSpan(
+	tr *Tree, start, end uint64, bits uint, base uint64,
+	removed func(items []item),
+) (deleted int) {
+	if !n.branch {
+		i := n.findLeafItemFirst(start)
+		j := n.findLeafItemBin(end)
+		deleted = j - i
+		if deleted == 0 {
+			return 0
+		}
+		if removed != nil {
+			removed(n.items[i:j])
+		}
+		copy(n.items[i:], n.items[j:])
+		for k := len(n.items) - deleted; k < len(n.items); k++ {
+			n.items[k] = item{}
+		}
+		n.items = n.items[:len(n.items)-deleted]
+		n.shrinkItems(tr)
+	} else {
+		var i int
+		if start > base {
+			i, _ = n.findChild(tr.cellIndex(start, bits))
+		}
+		for ; i < len(n.nodes); i++ {
+			cellStart := base | uint64(n.nodes[i].index)<<bits
+			if cellStart > end {
+				break
+			}
+			if n.nodes[i].count == 0 {
+				continue
+			}
+			cellEnd := cellStart | (uint64(1)<<bits - 1)
+			if cellStart >= start && cellEnd <= end {
+				// drop the node altogether
+				deleted += n.nodes[i].count
+				if removed != nil {
+					it := newLeafIter(&n.nodes[i])
+					for items := it.next(); items != nil; items = it.next() {
+						removed(items)
+					}
+				}
+				tr.releaseNode(&n.nodes[i])
+				n.nodes[i] = node{}
+			} else {
+				deleted += n.nodes[i].nodeDeleteSpan(tr, start, end,
+					bits-tr.numBits, cellStart, removed)
 			}
 		}
+		if deleted == 0 {
+			return 0
+		}
+		n.removeEmptyChildren(tr)
+	}
+	n.count -= deleted
+	if n.branch && n.count <= tr.minItems {
+		// compact the branch into a leaf
+		n.compactBranch(tr)
 	}
-	return hit, true
+	return deleted
 }
 
 // RangeDelete iterates over the tree starting with the start param and "asks"
-// the iterator if the item should be deleted.
+// the iterator if the item should be deleted. Only items in the inclusive
+// [start,end] range are visited, and when start is greater than end nothing
+// is visited or deleted. A nil iter deletes all items in the range.
 func (tr *Tree) RangeDelete(
 	start, end uint64,
 	iter func(cell uint64, data interface{}) (shouldDelete bool, ok bool),
 ) {
-	if tr.root == nil {
+	if tr.root == nil || start > end {
 		return
 	}
 	_, deleted, _ := tr.root.nodeRangeDelete(
-		start, end, 64-numBits, 0, false, iter)
+		tr, start, end, 64-tr.numBits, 0, false, iter)
+	tr.count -= deleted
+	if deleted > 0 {
+		tr.updateAggs(start, end)
+	}
+}
+
+// DeleteRange deletes items in the inclusive [start,end] range. When pred is
+// nil all items in the range are deleted, otherwise only the items that pred
+// returns true for are deleted. The entire range is always visited.
+func (tr *Tree) DeleteRange(
+	start, end uint64,
+	pred func(cell uint64, data interface{}) bool,
+) {
+	var iter func(cell uint64, data interface{}) (bool, bool)
+	if pred != nil {
+		iter = func(cell uint64, data interface{}) (bool, bool) {
+			return pred(cell, data), true
+		}
+	}
+	tr.RangeDelete(start, end, iter)
+}
+
+// DeleteByData removes all items from the tree that the match func returns
+// true for, regardless of their cells. Every item in the tree is visited.
+// Returns the number of items deleted.
+func (tr *Tree) DeleteByData(match func(data interface{}) bool) int {
+	count := tr.count
+	tr.RangeDelete(0, math.MaxUint64,
+		func(cell uint64, data interface{}) (bool, bool) {
+			return match(data), true
+		},
+	)
+	return count - tr.count
+}
+
+// Clear removes all items from the tree.
+func (tr *Tree) Clear() {
+	if tr.root != nil {
+		tr.releaseNode(tr.root)
+	}
+	tr.root = nil
+	tr.count = 0
+}
+
+// TruncateBefore removes all items with cells that are less than the cell
+// param. Child nodes that are entirely before the cell are dropped without
+// visiting their items, and only the leaf that holds the cell is rewritten.
+// Returns the number of items removed.
+func (tr *Tree) TruncateBefore(cell uint64) int {
+	if tr.root == nil || cell == 0 {
+		return 0
+	}
+	deleted := tr.root.truncateBefore(tr, cell, 64-tr.numBits)
+	if deleted == 0 {
+		return 0
+	}
+	tr.count -= deleted
+	if tr.count == 0 {
+		tr.Clear()
+	} else {
+		tr.updateAggs(0, cell)
+	}
+	return deleted
+}
+
+func (n *node) truncateBefore(tr *Tree, cell uint64, bits uint) (deleted int) {
+	if !n.branch {
+		i := n.findLeafItemFirst(cell)
+		if i == 0 {
+			return 0
+		}
+		n.keepItems(tr, i, len(n.items))
+		return i
+	}
+	i, found := n.findChild(tr.cellIndex(cell, bits))
+	for j := 0; j < i; j++ {
+		// drop the node altogether
+		deleted += n.nodes[j].count
+		tr.releaseNode(&n.nodes[j])
+		n.nodes[j] = node{}
+	}
+	if found {
+		deleted += n.nodes[i].truncateBefore(tr, cell, bits-tr.numBits)
+	}
+	if deleted == 0 {
+		return 0
+	}
+	n.removeEmptyChildren(tr)
+	n.count -= deleted
+	if n.count <= tr.minItems {
+		// compact the branch into a leaf
+		n.compactBranch(tr)
+	}
+	return deleted
+}
+
+// TruncateAfter removes all items with cells that are greater than the cell
+// param. Child nodes that are entirely after the cell are dropped without
+// visiting their items, and only the leaf that holds the cell is rewritten.
+// Returns the number of items removed.
+func (tr *Tree) TruncateAfter(cell uint64) int {
+	if tr.root == nil || cell == math.MaxUint64 {
+		return 0
+	}
+	deleted := tr.root.truncateAfter(tr, cell, 64-tr.numBits)
+	if deleted == 0 {
+		return 0
+	}
 	tr.count -= deleted
+	if tr.count == 0 {
+		tr.Clear()
+	} else {
+		tr.updateAggs(cell, math.MaxUint64)
+	}
+	return deleted
+}
+
+func (n *node) truncateAfter(tr *Tree, cell uint64, bits uint) (deleted int) {
+	if !n.branch {
+		i := n.findLeafItemBin(cell)
+		if i == len(n.items) {
+			return 0
+		}
+		deleted = len(n.items) - i
+		n.keepItems(tr, 0, i)
+		return deleted
+	}
+	i, found := n.findChild(tr.cellIndex(cell, bits))
+	if found {
+		deleted += n.nodes[i].truncateAfter(tr, cell, bits-tr.numBits)
+		i++
+	}
+	for j := i; j < len(n.nodes); j++ {
+		// drop the node altogether
+		deleted += n.nodes[j].count
+		tr.releaseNode(&n.nodes[j])
+		n.nodes[j] = node{}
+	}
+	if deleted == 0 {
+		return 0
+	}
+	n.removeEmptyChildren(tr)
+	n.count -= deleted
+	if n.count <= tr.minItems {
+		// compact the branch into a leaf
+		n.compactBranch(tr)
+	}
+	return deleted
+}
+
+// keepItems removes all items from the leaf except for those in the [i,j)
+// range. The items are moved to the front of the array, or copied into a new
+// array with the exact length when the leaf would be underfilled.
+func (n *node) keepItems(tr *Tree, i, j int) {
+	m := j - i
+	if m == 0 {
+		tr.releaseItems(n.items)
+		n.items = nil
+	} else if m <= cap(n.items)*40/100 {
+		var items []item
+		if tr.pool != nil {
+			items = tr.allocItems(m)
+		} else {
+			items = make([]item, m)
+		}
+		copy(items, n.items[i:j])
+		tr.releaseItems(n.items)
+		n.items = items
+	} else {
+		copy(n.items, n.items[i:j])
+		for k := m; k < len(n.items); k++ {
+			n.items[k] = item{}
+		}
+		n.items = n.items[:m]
+	}
+	n.count = m
+}
+
+// Truncate removes the items with the largest cells until there are n items
+// left in the tree. A n of zero or less clears the tree. See TrimToCount.
+func (tr *Tree) Truncate(n int) {
+	tr.TrimToCount(n, true)
+}
+
+// TrimToCount removes items until there are n items left in the tree. When
+// keepSmallest is true the items with the largest cells are removed,
+// otherwise the items with the smallest cells are removed. When there are
+// duplicates of the cell at the cut, the items that are kept are the ones
+// that would come first in a scan for keepSmallest, or last otherwise. A n
+// of zero or less clears the tree. Returns the number of items removed.
+func (tr *Tree) TrimToCount(n int, keepSmallest bool) (removed int) {
+	count := tr.count
+	if n <= 0 {
+		tr.Clear()
+		return count
+	}
+	if count <= n {
+		return 0
+	}
+	var cell uint64
+	if keepSmallest {
+		// the first item to remove
+		cell = tr.root.itemAt(n).cell
+		if cell < math.MaxUint64 {
+			tr.RangeDelete(cell+1, math.MaxUint64, nil)
+		}
+	} else {
+		// the first item to keep
+		cell = tr.root.itemAt(count - n).cell
+		if cell > 0 {
+			tr.RangeDelete(0, cell-1, nil)
+		}
+	}
+	// remove the duplicates of the cell at the cut, which are ordered
+	dups := tr.root.nodeCountRange(tr, cell, cell, 64-tr.numBits, 0)
+	keep := n - (tr.count - dups)
+	var i int
+	tr.DeleteWhenAll(cell, func(data interface{}) bool {
+		i++
+		if keepSmallest {
+			return i > keep
+		}
+		return i <= dups-keep
+	})
+	return count - tr.count
+}
+
+// itemAt returns the item at the index, in order. The index must be less
+// than the count of the node.
+func (n *node) itemAt(index int) *item {
+	for n.branch {
+		for i := 0; i < len(n.nodes); i++ {
+			if index < n.nodes[i].count {
+				n = &n.nodes[i]
+				break
+			}
+			index -= n.nodes[i].count
+		}
+	}
+	return &n.items[index]
+}
+
+// RangeDeleteCount returns the number of items that DeleteRange would delete
+// using the same params. The tree is not modified.
+func (tr *Tree) RangeDeleteCount(
+	start, end uint64,
+	pred func(cell uint64, data interface{}) bool,
+) int {
+	if tr.root == nil || start > end {
+		return 0
+	}
+	if pred == nil {
+		return tr.root.nodeCountRange(tr, start, end, 64-tr.numBits, 0)
+	}
+	var count int
+	tr.root.nodeRangeBetween(tr, start, end, 64-tr.numBits, 0,
+		func(cell uint64, data interface{}) bool {
+			if pred(cell, data) {
+				count++
+			}
+			return true
+		},
+	)
+	return count
 }
 
+// nodeRangeDelete deletes items in the [start,end] range. The base param is
+// the first possible cell for the node.
 func (n *node) nodeRangeDelete(
-	start, end uint64, bits uint, base uint64, hit bool,
+	tr *Tree, start, end uint64, bits uint, base uint64, hit bool,
 	iter func(cell uint64, data interface{}) (shouldDelete bool, ok bool),
 ) (hitout bool, deleted int, ok bool) {
 	if !n.branch {
@@ -426,65 +2979,54 @@ func (n *node) nodeRangeDelete(
 			// there was some deleted items so we need to adjust the length
 			// of the items array to reflect the change
 			n.items = n.items[:len(n.items)-deleted]
-			if len(n.items) == 0 {
-				n.items = nil
-			} else {
-				// check if the base array needs to be shrunk/reallocated.
-				ncap := cap(n.items)
-				min := ncap * 40 / 100
-				if len(n.items) <= min {
-					for len(n.items) <= min {
-						ncap /= 2
-						min = ncap * 40 / 100
-					}
-					// shrink and realloc the array
-					items := make([]item, len(n.items), ncap)
-					copy(items, n.items)
-					n.items = items
-				}
-			}
+			n.shrinkItems(tr)
 		}
 		// set the hit flag once a leaf is reached
 		hit = true
 	} else {
-		var index int
-		if hit {
-			// target leaf node has been reached. this means we can just start at
-			// index zero and expect that all of the following noes are candidates.
-			index = 0
-		} else {
+		// the children that follow an empty child node must still be
+		// visited, so do not stop unless a child node says so.
+		ok = true
+		var i int
+		if !hit {
 			// target leaf node has not been reached yet so we need to determine
-			// the best path to get to it.
-			index = cellIndex(start, bits)
+			// the best path to get to it. otherwise we can just start at the
+			// first child and expect that all of the following nodes are
+			// candidates.
+			var found bool
+			i, found = n.findChild(tr.cellIndex(start, bits))
+			if !found {
+				hit = true
+			}
 		}
-		for ; index < len(n.nodes); index++ {
-			if n.nodes[index].count == 0 {
+		for ; i < len(n.nodes); i++ {
+			if n.nodes[i].count == 0 {
 				hit = true
 			} else {
 				var dropped bool
+				cellStart := base | uint64(n.nodes[i].index)<<bits
 				if hit && iter == nil {
-					cellStart := (base + uint64(index)) << bits
-					cellEnd := ((base + uint64(index+1)) << bits) - 1
+					cellEnd := cellStart | (uint64(1)<<bits - 1)
 					// we've already hit a leaf and the iter is nil. It's
 					// possible that this entire node can be deleted if it's
 					// cell range fits within start/end.
 					if cellStart >= start && cellEnd <= end {
 						// drop the node altogether
-						deleted += n.nodes[index].count
-						n.nodes[index] = node{}
+						deleted += n.nodes[i].count
+						tr.releaseNode(&n.nodes[i])
+						n.nodes[i] = node{}
 						dropped = true
 					}
 				}
 				if !dropped {
 					var ndeleted int
-					hit, ndeleted, ok = n.nodes[index].nodeRangeDelete(
-						start, end, bits-numBits,
-						(base<<numBits)+uint64(index),
+					hit, ndeleted, ok = n.nodes[i].nodeRangeDelete(
+						tr, start, end, bits-tr.numBits, cellStart,
 						hit, iter)
 					deleted += ndeleted
-					if !ok {
-						break
-					}
+				}
+				if !ok {
+					break
 				}
 			}
 		}
@@ -493,9 +3035,12 @@ func (n *node) nodeRangeDelete(
 		// an item was deleted from this node or a child node
 		// decrement the counter
 		n.count -= deleted
-		if n.branch && n.count <= minItems {
-			// compact the branch into a leaf
-			n.compactBranch()
+		if n.branch {
+			n.removeEmptyChildren(tr)
+			if n.count <= tr.minItems {
+				// compact the branch into a leaf
+				n.compactBranch(tr)
+			}
 		}
 	}
 	return hit, deleted, ok
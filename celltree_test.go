@@ -5,12 +5,15 @@
 package celltree
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math"
 	"math/rand"
 	"os"
 	"runtime"
 	"sort"
+	"strconv"
 	"testing"
 	"time"
 
@@ -26,15 +29,26 @@ func init() {
 }
 
 func random(N int, perm bool) []uint64 {
+	return randomFrom(rand.Uint64, rand.Perm, N, perm)
+}
+
+// randomRand is like random, but uses the rng instead of the global source.
+func randomRand(rng *rand.Rand, N int, perm bool) []uint64 {
+	return randomFrom(rng.Uint64, rng.Perm, N, perm)
+}
+
+func randomFrom(uint64fn func() uint64, permfn func(n int) []int,
+	N int, perm bool,
+) []uint64 {
 	ints := make([]uint64, N)
 	if perm {
-		for i, x := range rand.Perm(N) {
+		for i, x := range permfn(N) {
 			ints[i] = uint64(x)
 		}
 	} else {
 		m := make(map[uint64]bool)
 		for len(m) < N {
-			m[rand.Uint64()] = true
+			m[uint64fn()] = true
 		}
 		var i int
 		for k := range m {
@@ -73,71 +87,9 @@ func testEquals(t *testing.T, random, sorted []uint64) {
 
 // sane tests the sanity of the tree. Any problems will panic.
 func (tr *Tree) sane() {
-	if tr.root == nil {
-		if tr.count != 0 {
-			panic(fmt.Sprintf("sane: expected %d, got %d", 0, tr.count))
-		}
-		return
-	}
-	count, _ := tr.root.saneCount(0, 64-numBits)
-	if tr.count != count {
-		panic(fmt.Sprintf("sane: expected %d, got %d", count, tr.count))
-	}
-}
-
-func (n *node) saneCount(cell uint64, bits uint) (count int, cellout uint64) {
-	if !n.branch {
-		// all leaves count should match the number of items.
-		if n.count != len(n.items) {
-			panic(fmt.Sprintf("leaf has a count of %d, but %d items in array",
-				n.count, len(n.items)))
-		}
-		// leaves should never go above max items unless they are at max depth.
-		if n.count > maxItems && !maxDepth(bits) {
-			panic(fmt.Sprintf("leaf has a count of %d, but maxItems is %d",
-				n.count, maxItems))
-		}
-		// all leaves should not have non-nil leaves
-		if len(n.items) == 0 && n.items != nil {
-			panic(fmt.Sprintf("leaf has zero items, but a non-nil items array"))
-		}
-		// test if the items cells are in order
-		for i := 0; i < len(n.items); i++ {
-			if n.items[i].cell < cell {
-				panic(fmt.Sprintf("leaf out of order at index: %d", i))
-			}
-			cell = n.items[i].cell
-		}
-		// all leaves should *not* fall below 40% capacity
-		min := cap(n.items) * 40 / 100
-		if len(n.items) <= min && len(n.items) > 0 {
-			println(len(n.items), cap(n.items), min)
-			panic(fmt.Sprintf("leaf is underfilled"))
-		}
-		return len(n.items), cell
+	if err := tr.Validate(); err != nil {
+		panic(err)
 	}
-	// all branches should have a count of at least 1
-	if n.count <= 0 {
-		panic(fmt.Sprintf("branch has a count of %d", n.count))
-	}
-	// all branches should have a nil items array
-	if n.items != nil {
-		panic(fmt.Sprintf("branch has non-nil items"))
-	}
-	// check each node
-	for i := 0; i < len(n.nodes); i++ {
-		ncount, ncell := n.nodes[i].saneCount(cell, bits-numBits)
-		count += ncount
-		if ncell < cell {
-			panic(fmt.Sprintf("branch out of order at index: %d", i))
-		}
-		cell = ncell
-	}
-	if n.count != count {
-		panic(fmt.Sprintf("branch has wrong count, expected %d, got %d",
-			count, n.count))
-	}
-	return count, cell
 }
 
 func TestRandomSingleStep(t *testing.T) {
@@ -145,12 +97,14 @@ func TestRandomSingleStep(t *testing.T) {
 }
 
 func testRandomStep(t *testing.T) {
-	N := (rand.Int() % 10000)
+	testRandomStepTree(t, new(Tree), rand.Int()%10000)
+}
+
+func testRandomStepTree(t *testing.T, tr *Tree, N int) {
 	if N%2 == 1 {
 		N++
 	}
 	ints := random(N, rand.Int()%2 == 0)
-	var tr Tree
 	for i := 0; i < N; i++ {
 		tr.Insert(ints[i], nil)
 		tr.sane()
@@ -204,6 +158,110 @@ func TestRandom(t *testing.T) {
 	}
 }
 
+func TestOptions(t *testing.T) {
+	for _, opts := range []Options{
+		{MaxItems: 1, FanoutBits: 1},
+		{MaxItems: 4, FanoutBits: 2},
+		{MaxItems: 16, FanoutBits: 3},
+		{MaxItems: 64, FanoutBits: 4},
+		{MaxItems: 1000, FanoutBits: 8},
+		{FanoutBits: 5},
+		{MaxItems: 10},
+	} {
+		t.Run(fmt.Sprintf("%d/%d", opts.MaxItems, opts.FanoutBits),
+			func(t *testing.T) {
+				for i := 0; i < 10; i++ {
+					testRandomStepTree(t, NewTree(opts), rand.Int()%1000)
+				}
+				tr := NewTree(opts)
+				for i := 0; i < 1000; i++ {
+					tr.Insert(388098102398102938, i)
+				}
+				tr.sane()
+				tr.RangeDelete(0, math.MaxUint64, nil)
+				tr.sane()
+			},
+		)
+	}
+	tr := NewTree(Options{})
+	if tr.numBits != numBits || tr.maxItems != maxItems ||
+		tr.minItems != minItems {
+		t.Fatal("invalid defaults")
+	}
+}
+
+func TestUniqueCells(t *testing.T) {
+	for _, tr := range []*Tree{
+		New(WithUniqueCells()),
+		New(WithUniqueCells(), WithFanoutBits(2), WithMaxItems(8)),
+	} {
+		ref := make(map[uint64]interface{})
+		// a small cell space, with many repeated cells
+		randCell := func() uint64 {
+			return uint64(rand.Int()%5000) << (rand.Uint64() % 52)
+		}
+		for i := 0; i < 50000; i++ {
+			cell := randCell()
+			switch rand.Int() % 6 {
+			case 0, 1:
+				tr.Insert(cell, i)
+				ref[cell] = i
+			case 2:
+				_, ok := ref[cell]
+				if tr.Delete(cell, nil) != ok {
+					t.Fatalf("expected %v, got %v", ok, !ok)
+				}
+				delete(ref, cell)
+			case 3:
+				// only replace odd data
+				tr.InsertOrReplace(cell, i,
+					func(data interface{}) (interface{}, bool) {
+						return i, data.(int)%2 == 1
+					},
+				)
+				if data, ok := ref[cell]; !ok || data.(int)%2 == 1 {
+					ref[cell] = i
+				}
+			case 4:
+				cells := []uint64{cell, randCell(), cell}
+				tr.InsertMany(cells, []interface{}{-1, i, i})
+				ref[cells[1]] = i
+				ref[cell] = i
+			case 5:
+				tr.Delete(cell, -2)
+			}
+			if tr.Count() != len(ref) {
+				t.Fatalf("expected %v, got %v", len(ref), tr.Count())
+			}
+			if i%1000 == 0 {
+				tr.sane()
+			}
+		}
+		tr.sane()
+		tr.Scan(func(cell uint64, data interface{}) bool {
+			if data != ref[cell] {
+				t.Fatalf("expected %v, got %v", ref[cell], data)
+			}
+			return true
+		})
+		// bulk loading keeps the last of each duplicate cell
+		ntr := tr.emptyCopy()
+		ntr.InsertItems([]Item{{1, 1}, {1, 2}, {2, 3}, {3, 4}, {3, 5}})
+		ntr.sane()
+		if items := ntr.ToSlice(); len(items) != 3 || items[0].Data != 2 ||
+			items[1].Data != 3 || items[2].Data != 5 {
+			t.Fatalf("unexpected items %v", items)
+		}
+		// non-unique trees still allow duplicates
+		ntr = New()
+		ntr.Insert(1, 1)
+		ntr.Insert(1, 2)
+		if ntr.Delete(1, nil) || ntr.Count() != 2 {
+			t.Fatal("expected duplicates")
+		}
+	}
+}
+
 func TestVarious(t *testing.T) {
 	var tr Tree
 	tr.Delete(0, nil)
@@ -259,25 +317,39 @@ func TestDeleteWhen(t *testing.T) {
 	tr.Insert(16, 6)
 	tr.sane()
 	var count int
-	tr.DeleteWhen(16, func(data interface{}) bool {
+	data, deleted := tr.DeleteWhen(16, func(data interface{}) bool {
 		count++
 		return false
 	})
 	if count != 2 {
 		t.Fatalf("expected %v, got %v", 2, count)
 	}
+	if data != nil || deleted {
+		t.Fatalf("expected %v/%v, got %v/%v", nil, false, data, deleted)
+	}
 	if tr.Count() != 7 {
 		t.Fatalf("expected %v, got %v", 7, tr.Count())
 	}
-	tr.DeleteWhen(16, func(data interface{}) bool {
+	data, deleted = tr.DeleteWhen(16, func(data interface{}) bool {
 		if data.(int) == 3 {
 			return true
 		}
 		return false
 	})
+	if data != 3 || !deleted {
+		t.Fatalf("expected %v/%v, got %v/%v", 3, true, data, deleted)
+	}
 	if tr.Count() != 6 {
 		t.Fatalf("expected %v, got %v", 6, tr.Count())
 	}
+	// the last duplicate is deleted first
+	data, deleted = tr.DeleteWhen(5, func(data interface{}) bool {
+		return true
+	})
+	if data != 5 || !deleted {
+		t.Fatalf("expected %v/%v, got %v/%v", 5, true, data, deleted)
+	}
+	tr.sane()
 }
 
 type perfCtx struct {
@@ -308,6 +380,18 @@ func printPerfLabel(label string, randomized, shuffled bool) {
 	}
 	println(") --")
 }
+
+// perfTree returns a new tree for the perf tests. The leaf size can be
+// changed using the PERFMAXITEMS environment variable, and node pooling can
+// be enabled using PERFNODEPOOL=1.
+func perfTree() *Tree {
+	n, _ := strconv.Atoi(os.Getenv("PERFMAXITEMS"))
+	if os.Getenv("PERFNODEPOOL") == "1" {
+		return New(WithMaxItems(n), WithNodePool())
+	}
+	return New(WithMaxItems(n))
+}
+
 func TestPerf(t *testing.T) {
 	if os.Getenv("BASICPERF") != "1" {
 		fmt.Printf("TestPerf disabled (BASICPERF=1)\n")
@@ -320,7 +404,7 @@ func TestPerf(t *testing.T) {
 		shuffled := i%2 == 0
 		t.Run("CellTree", func(t *testing.T) {
 			printPerfLabel("celltree", randomized, shuffled)
-			var tr Tree
+			tr := perfTree()
 			ctx := perfCtx{
 				_insert: func(cell uint64) { tr.Insert(cell, nil) },
 				_count:  func() int { return tr.Count() },
@@ -340,6 +424,58 @@ func TestPerf(t *testing.T) {
 		})
 	}
 
+	// CellTree with uint64 data, which is boxed into an interface{}
+	for i := 0; i < 4; i++ {
+		randomized := i/2 == 0
+		shuffled := i%2 == 0
+		t.Run("CellTreeData", func(t *testing.T) {
+			printPerfLabel("celltree+data", randomized, shuffled)
+			tr := perfTree()
+			ctx := perfCtx{
+				_insert: func(cell uint64) { tr.Insert(cell, cell) },
+				_count:  func() int { return tr.Count() },
+				_scan: func() {
+					tr.Scan(func(cell uint64, data interface{}) bool {
+						return true
+					})
+				},
+				_range: func(cell uint64, iter func(cell uint64) bool) {
+					tr.Range(cell, func(cell uint64, data interface{}) bool {
+						return iter(cell)
+					})
+				},
+				_remove: func(cell uint64) { tr.Delete(cell, cell) },
+			}
+			testPerf(t, ctx, randomized, shuffled)
+		})
+	}
+
+	// Uint64Tree
+	for i := 0; i < 4; i++ {
+		randomized := i/2 == 0
+		shuffled := i%2 == 0
+		t.Run("Uint64Tree", func(t *testing.T) {
+			printPerfLabel("uint64tree", randomized, shuffled)
+			var tr Uint64Tree
+			ctx := perfCtx{
+				_insert: func(cell uint64) { tr.Insert(cell, cell) },
+				_count:  func() int { return tr.Count() },
+				_scan: func() {
+					tr.Scan(func(cell uint64, data uint64) bool {
+						return true
+					})
+				},
+				_range: func(cell uint64, iter func(cell uint64) bool) {
+					tr.Range(cell, func(cell uint64, data uint64) bool {
+						return iter(cell)
+					})
+				},
+				_remove: func(cell uint64) { tr.Delete(cell, cell) },
+			}
+			testPerf(t, ctx, randomized, shuffled)
+		})
+	}
+
 	// BTree
 	for i := 0; i < 4; i++ {
 		randomized := i/2 == 0
@@ -472,7 +608,7 @@ func TestPerfLongTime(t *testing.T) {
 	x := 0
 	N := 1024 * 1024
 	ints := random(N, true)
-	var tr Tree
+	tr := perfTree()
 	var insops, remops int
 	var ms1, ms2 runtime.MemStats
 	runtime.GC()
@@ -662,6 +798,46 @@ func TestDuplicates(t *testing.T) {
 	}
 }
 
+func TestInsertOrReplaceAtCap(t *testing.T) {
+	for _, cell := range []uint64{100, 1000} {
+		// a root leaf that is at capacity, with duplicates of cell 100
+		var tr Tree
+		for i := 0; i < maxItems-2; i++ {
+			tr.Insert(uint64(i)*2, i)
+		}
+		tr.Insert(100, -1)
+		tr.Insert(100, -2)
+		if tr.root.branch || len(tr.root.items) != maxItems {
+			t.Fatal("expected a full leaf")
+		}
+		var calls int
+		tr.InsertOrReplace(cell, "new",
+			func(data interface{}) (interface{}, bool) {
+				calls++
+				return nil, false
+			},
+		)
+		tr.sane()
+		if !tr.root.branch {
+			t.Fatal("expected a split")
+		}
+		if tr.Count() != maxItems+1 {
+			t.Fatalf("expected %v, got %v", maxItems+1, tr.Count())
+		}
+		expectCalls := 3
+		if cell == 1000 {
+			// the cell is past the end of the leaf
+			expectCalls = 0
+		}
+		if calls != expectCalls {
+			t.Fatalf("expected %v, got %v", expectCalls, calls)
+		}
+		if !tr.Delete(cell, "new") {
+			t.Fatal("expected the item to be inserted")
+		}
+	}
+}
+
 func TestRangeDelete(t *testing.T) {
 	N := 1000
 	start := 5000
@@ -796,16 +972,16 @@ func TestSingleRandomRangeDelete(t *testing.T) {
 	switch rand.Uint64() % 4 {
 	case 0:
 		// end at max uint64
-		min = math.MaxUint64
+		max = math.MaxUint64
 	case 1:
 		// end after last
-		min = (math.MaxUint64-all[len(all)-1])/2 + all[len(all)-1]
+		max = (math.MaxUint64-all[len(all)-1])/2 + all[len(all)-1]
 	case 2:
 		// end on the last
-		min = all[len(all)-1]
+		max = all[len(all)-1]
 	case 3:
 		// end in random position
-		min = rand.Uint64()
+		max = rand.Uint64()
 	}
 	if min > max {
 		min, max = max, min
@@ -845,6 +1021,47 @@ func TestSingleRandomRangeDelete(t *testing.T) {
 	}
 }
 
+func TestDeleteRange(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		N := rand.Int() % 10000
+		var tr1, tr2 Tree
+		for j := 0; j < N; j++ {
+			cell := rand.Uint64()
+			tr1.Insert(cell, cell)
+			tr2.Insert(cell, cell)
+		}
+		start, end := rand.Uint64(), rand.Uint64()
+		if start > end {
+			start, end = end, start
+		}
+		if i%10 == 0 {
+			start, end = 0, math.MaxUint64
+		}
+		var pred func(cell uint64, data interface{}) bool
+		if i%2 == 1 {
+			pred = func(cell uint64, data interface{}) bool {
+				if cell < start || cell > end {
+					t.Fatalf("cell %v is outside of range", cell)
+				}
+				return cell%3 == 0
+			}
+		}
+		tr1.DeleteRange(start, end, pred)
+		tr2.RangeDelete(start, end,
+			func(cell uint64, data interface{}) (bool, bool) {
+				if pred == nil {
+					return true, true
+				}
+				return pred(cell, data), true
+			},
+		)
+		tr1.sane()
+		if !tr1.Equal(&tr2, nil) {
+			t.Fatal("trees not equal")
+		}
+	}
+}
+
 func testRangeDeleteNoIterator(t *testing.T, N int) {
 	var tr Tree
 	var all []uint64
@@ -874,6 +1091,326 @@ func testRangeDeleteNoIterator(t *testing.T, N int) {
 	}
 }
 
+func TestDeleteByData(t *testing.T) {
+	var tr Tree
+	if tr.DeleteByData(nil) != 0 {
+		t.Fatal("expected zero")
+	}
+	N := 100000
+	for i := 0; i < N; i++ {
+		// clustered cells with some duplicates
+		cell := rand.Uint64() >> (rand.Uint64() % 64)
+		tr.Insert(cell, i)
+		if i%10 == 0 {
+			tr.Insert(cell, -i)
+		}
+	}
+	count := tr.Count()
+	for _, div := range []int{7, 3, 2, 1} {
+		var expect int
+		tr.Scan(func(cell uint64, data interface{}) bool {
+			if data.(int)%div == 0 {
+				expect++
+			}
+			return true
+		})
+		n := tr.DeleteByData(func(data interface{}) bool {
+			return data.(int)%div == 0
+		})
+		if n != expect {
+			t.Fatalf("expected %v, got %v", expect, n)
+		}
+		count -= n
+		if tr.Count() != count {
+			t.Fatalf("expected %v, got %v", count, tr.Count())
+		}
+		tr.sane()
+		tr.Scan(func(cell uint64, data interface{}) bool {
+			if data.(int)%div == 0 {
+				t.Fatalf("expected %v to be deleted", data)
+			}
+			return true
+		})
+	}
+	if tr.Count() != 0 || tr.root.branch {
+		t.Fatal("expected an empty tree")
+	}
+}
+
+func TestClear(t *testing.T) {
+	var tr Tree
+	tr.Clear()
+	tr.sane()
+	for _, tr := range []*Tree{New(), New(WithNodePool())} {
+		for i := 0; i < 10000; i++ {
+			tr.Insert(rand.Uint64(), i)
+		}
+		tr.Clear()
+		tr.sane()
+		if tr.Count() != 0 {
+			t.Fatalf("expected %v, got %v", 0, tr.Count())
+		}
+		tr.Insert(1, nil)
+		tr.sane()
+		if tr.Count() != 1 {
+			t.Fatalf("expected %v, got %v", 1, tr.Count())
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	var tr Tree
+	tr.Truncate(10)
+	tr.sane()
+	for i := 0; i < 50; i++ {
+		tr := New(WithMaxItems(rand.Int()%64 + 8))
+		N := rand.Int() % 20000
+		for j := 0; j < N; j++ {
+			// clustered cells with some duplicates
+			cell := rand.Uint64() >> (rand.Uint64() % 64)
+			tr.Insert(cell, j)
+			if j%10 == 0 {
+				for k := 0; k < rand.Int()%100; k++ {
+					tr.Insert(cell, -k)
+				}
+			}
+		}
+		all := tr.ToSlice()
+		n := rand.Int() % (len(all) + 10)
+		if i%10 == 0 {
+			n = 0
+		}
+		tr.Truncate(n)
+		tr.sane()
+		if n > len(all) {
+			n = len(all)
+		}
+		if tr.Count() != n {
+			t.Fatalf("expected %v, got %v", n, tr.Count())
+		}
+		var j int
+		tr.Scan(func(cell uint64, data interface{}) bool {
+			if all[j] != (Item{cell, data}) {
+				t.Fatalf("expected %v, got %v", all[j], Item{cell, data})
+			}
+			j++
+			return true
+		})
+	}
+}
+
+func TestTrimToCount(t *testing.T) {
+	var tr Tree
+	if tr.TrimToCount(10, false) != 0 {
+		t.Fatal("expected zero")
+	}
+	for i := 0; i < 50; i++ {
+		tr := New(WithMaxItems(rand.Int()%64 + 8))
+		N := rand.Int() % 20000
+		for j := 0; j < N; j++ {
+			// clustered cells with some duplicates
+			cell := rand.Uint64() >> (rand.Uint64() % 64)
+			if j%3 == 0 {
+				cell = 0
+			} else if j%3 == 1 {
+				cell = math.MaxUint64
+			}
+			tr.Insert(cell, j)
+			if j%10 == 0 {
+				for k := 0; k < rand.Int()%100; k++ {
+					tr.Insert(cell, -k)
+				}
+			}
+		}
+		all := tr.ToSlice()
+		n := rand.Int() % (len(all) + 10)
+		if i%10 == 0 {
+			n = 0
+		}
+		keepSmallest := i%2 == 0
+		removed := tr.TrimToCount(n, keepSmallest)
+		tr.sane()
+		if n > len(all) {
+			n = len(all)
+		}
+		if tr.Count() != n || removed != len(all)-n {
+			t.Fatalf("expected %v/%v, got %v/%v", n, len(all)-n,
+				tr.Count(), removed)
+		}
+		if !keepSmallest {
+			all = all[len(all)-n:]
+		}
+		var j int
+		tr.Scan(func(cell uint64, data interface{}) bool {
+			if all[j] != (Item{cell, data}) {
+				t.Fatalf("expected %v, got %v", all[j], Item{cell, data})
+			}
+			j++
+			return true
+		})
+	}
+}
+
+func TestTruncateBefore(t *testing.T) {
+	var tr Tree
+	if tr.TruncateBefore(10) != 0 {
+		t.Fatal("expected zero")
+	}
+	for i := 0; i < 50; i++ {
+		opts := []Option{WithMaxItems(rand.Int()%64 + 8)}
+		if i%2 == 0 {
+			opts = append(opts, WithNodePool())
+		}
+		tr := New(opts...)
+		N := rand.Int() % 20000
+		for j := 0; j < N; j++ {
+			// clustered cells with some duplicates
+			cell := rand.Uint64() >> (rand.Uint64() % 64)
+			tr.Insert(cell, j)
+			if j%10 == 0 {
+				for k := 0; k < rand.Int()%100; k++ {
+					tr.Insert(cell, -k)
+				}
+			}
+		}
+		all := tr.ToSlice()
+		var cell uint64
+		switch {
+		case i%10 == 0:
+			cell = math.MaxUint64
+		case i%10 == 1:
+			cell = 0
+		case len(all) > 0:
+			// a cell that is in the tree, which keeps all of it's duplicates
+			cell = all[rand.Int()%len(all)].Cell
+		}
+		var n int
+		for n < len(all) && all[n].Cell < cell {
+			n++
+		}
+		if removed := tr.TruncateBefore(cell); removed != n {
+			t.Fatalf("expected %v, got %v", n, removed)
+		}
+		tr.sane()
+		all = all[n:]
+		if tr.Count() != len(all) {
+			t.Fatalf("expected %v, got %v", len(all), tr.Count())
+		}
+		if len(all) == 0 && tr.root != nil {
+			t.Fatal("expected nil root")
+		}
+		var j int
+		tr.Scan(func(cell uint64, data interface{}) bool {
+			if all[j] != (Item{cell, data}) {
+				t.Fatalf("expected %v, got %v", all[j], Item{cell, data})
+			}
+			j++
+			return true
+		})
+	}
+}
+
+func TestTruncateAfter(t *testing.T) {
+	var tr Tree
+	if tr.TruncateAfter(10) != 0 {
+		t.Fatal("expected zero")
+	}
+	for i := 0; i < 50; i++ {
+		opts := []Option{WithMaxItems(rand.Int()%64 + 8)}
+		if i%2 == 0 {
+			opts = append(opts, WithNodePool())
+		}
+		tr := New(opts...)
+		N := rand.Int() % 20000
+		for j := 0; j < N; j++ {
+			// clustered cells with some duplicates
+			cell := rand.Uint64() >> (rand.Uint64() % 64)
+			tr.Insert(cell, j)
+			if j%10 == 0 {
+				for k := 0; k < rand.Int()%100; k++ {
+					tr.Insert(cell, -k)
+				}
+			}
+		}
+		all := tr.ToSlice()
+		var cell uint64
+		switch {
+		case i%10 == 0:
+			cell = 0
+		case i%10 == 1:
+			cell = math.MaxUint64
+		case len(all) > 0:
+			// a cell that is in the tree, which keeps all of it's duplicates
+			cell = all[rand.Int()%len(all)].Cell
+		}
+		var n int
+		for n < len(all) && all[len(all)-1-n].Cell > cell {
+			n++
+		}
+		if removed := tr.TruncateAfter(cell); removed != n {
+			t.Fatalf("expected %v, got %v", n, removed)
+		}
+		tr.sane()
+		all = all[:len(all)-n]
+		if tr.Count() != len(all) {
+			t.Fatalf("expected %v, got %v", len(all), tr.Count())
+		}
+		if len(all) == 0 && tr.root != nil {
+			t.Fatal("expected nil root")
+		}
+		var j int
+		tr.Scan(func(cell uint64, data interface{}) bool {
+			if all[j] != (Item{cell, data}) {
+				t.Fatalf("expected %v, got %v", all[j], Item{cell, data})
+			}
+			j++
+			return true
+		})
+	}
+}
+
+func TestRangeDeleteCount(t *testing.T) {
+	var tr Tree
+	if tr.RangeDeleteCount(0, math.MaxUint64, nil) != 0 {
+		t.Fatal("expected zero")
+	}
+	for i := 0; i < 50; i++ {
+		N := rand.Int() % 10000
+		tr = Tree{}
+		for j := 0; j < N; j++ {
+			// clustered cells with some duplicates
+			cell := rand.Uint64() >> (rand.Uint64() % 64)
+			tr.Insert(cell, j)
+			if j%10 == 0 {
+				tr.Insert(cell, -j)
+			}
+		}
+		start, end := rand.Uint64()>>(rand.Uint64()%64), rand.Uint64()
+		if start > end {
+			start, end = end, start
+		}
+		if i%10 == 0 {
+			start, end = 0, math.MaxUint64
+		}
+		var pred func(cell uint64, data interface{}) bool
+		if i%2 == 1 {
+			pred = func(cell uint64, data interface{}) bool {
+				return data.(int)%3 == 0
+			}
+		}
+		before, _ := FromSortedSlice(tr.ToSlice())
+		count := tr.RangeDeleteCount(start, end, pred)
+		if !tr.Equal(before, nil) {
+			t.Fatal("tree was modified")
+		}
+		tr.DeleteRange(start, end, pred)
+		tr.sane()
+		if before.Count()-tr.Count() != count {
+			t.Fatalf("expected %v, got %v", before.Count()-tr.Count(), count)
+		}
+	}
+}
+
 func TestRangeDeleteNoIterator(t *testing.T) {
 	testRangeDeleteNoIterator(t, 0)
 	testRangeDeleteNoIterator(t, maxItems/2)
@@ -882,3 +1419,3367 @@ func TestRangeDeleteNoIterator(t *testing.T) {
 	testRangeDeleteNoIterator(t, maxItems+1)
 	testRangeDeleteNoIterator(t, 100000)
 }
+
+func TestReplaceAll(t *testing.T) {
+	var tr Tree
+	if tr.ReplaceAll(10, nil) != 0 {
+		t.Fatal("expected zero")
+	}
+	for _, N := range []int{1, 5, maxItems * 3} {
+		tr = Tree{}
+		cell := uint64(388098102398102938)
+		for i := 0; i < 1000; i++ {
+			tr.Insert(rand.Uint64(), -1)
+		}
+		tr.Insert(cell-1, -1)
+		tr.Insert(cell+1, -1)
+		for i := 0; i < N; i++ {
+			tr.Insert(cell, i)
+		}
+		count := tr.Count()
+		if n := tr.ReplaceAll(cell, "hello"); n != N {
+			t.Fatalf("expected %v, got %v", N, n)
+		}
+		if tr.Count() != count {
+			t.Fatalf("expected %v, got %v", count, tr.Count())
+		}
+		tr.sane()
+		var replaced int
+		tr.Scan(func(c uint64, data interface{}) bool {
+			if c == cell {
+				if data != "hello" {
+					t.Fatalf("expected %v, got %v", "hello", data)
+				}
+				replaced++
+			} else if data != -1 {
+				t.Fatalf("expected %v, got %v", -1, data)
+			}
+			return true
+		})
+		if replaced != N {
+			t.Fatalf("expected %v, got %v", N, replaced)
+		}
+	}
+}
+
+func TestMap(t *testing.T) {
+	var tr Tree
+	tr.Map(nil)
+	N := 50000
+	cells := random(N, false)
+	for i := 0; i < N; i++ {
+		tr.Insert(cells[i], i)
+		if i%10 == 0 {
+			// duplicate cell
+			tr.Insert(cells[i], i)
+		}
+	}
+	var visited int
+	tr.Map(func(cell uint64, data interface{}) interface{} {
+		visited++
+		return data.(int) * data.(int)
+	})
+	if visited != tr.Count() || tr.Count() != N+N/10 {
+		t.Fatalf("expected %v, got %v", tr.Count(), visited)
+	}
+	tr.sane()
+	tr.Scan(func(cell uint64, data interface{}) bool {
+		i := int(math.Sqrt(float64(data.(int))))
+		if cells[i] != cell || i*i != data.(int) {
+			t.Fatalf("unexpected data %v for cell %v", data, cell)
+		}
+		return true
+	})
+}
+
+func TestRangeReplace(t *testing.T) {
+	var tr Tree
+	tr.RangeReplace(0, math.MaxUint64, nil)
+	N := 50000
+	cells := random(N, false)
+	for i := 0; i < N; i++ {
+		tr.Insert(cells[i], i)
+		if i%10 == 0 {
+			// duplicate cell
+			tr.Insert(cells[i], i)
+		}
+	}
+	all := tr.ToSlice()
+	for i := 0; i < 100; i++ {
+		start, end := rand.Uint64(), rand.Uint64()
+		switch i % 10 {
+		case 0:
+			start, end = 0, math.MaxUint64
+		case 1:
+			// a single cell with a duplicate
+			start = cells[rand.Int()%(N/10)*10]
+			end = start
+		case 2:
+			start, end = end, start
+		}
+		var visited int
+		tr.RangeReplace(start, end,
+			func(cell uint64, old interface{}) interface{} {
+				if cell < start || cell > end {
+					t.Fatalf("%v is outside of [%v,%v]", cell, start, end)
+				}
+				visited++
+				return old.(int) + 1
+			},
+		)
+		tr.sane()
+		var expect int
+		for j := range all {
+			if all[j].Cell >= start && all[j].Cell <= end {
+				all[j].Data = all[j].Data.(int) + 1
+				expect++
+			}
+		}
+		if visited != expect {
+			t.Fatalf("expected %v, got %v", expect, visited)
+		}
+	}
+	if tr.Count() != len(all) {
+		t.Fatalf("expected %v, got %v", len(all), tr.Count())
+	}
+	var j int
+	tr.Scan(func(cell uint64, data interface{}) bool {
+		if all[j] != (Item{cell, data}) {
+			t.Fatalf("expected %v, got %v", all[j], Item{cell, data})
+		}
+		j++
+		return true
+	})
+}
+
+func TestInsertIfAbsent(t *testing.T) {
+	var tr Tree
+	N := 10000
+	ints := random(N, false)
+	for i := 0; i < N; i++ {
+		if !tr.InsertIfAbsent(ints[i], i) {
+			t.Fatalf("expected %v to be inserted", ints[i])
+		}
+	}
+	for i := 0; i < N; i++ {
+		if tr.InsertIfAbsent(ints[i], -i) {
+			t.Fatalf("expected %v to be present", ints[i])
+		}
+	}
+	tr.sane()
+	if tr.Count() != N {
+		t.Fatalf("expected %v, got %v", N, tr.Count())
+	}
+	for i := 0; i < N; i++ {
+		if !tr.Delete(ints[i], i) {
+			t.Fatalf("expected %v to be unchanged", ints[i])
+		}
+	}
+	// any duplicate counts as present
+	tr.Insert(100, 1)
+	tr.Insert(100, 2)
+	if tr.InsertIfAbsent(100, 3) {
+		t.Fatal("expected false")
+	}
+	if tr.Count() != 2 {
+		t.Fatalf("expected %v, got %v", 2, tr.Count())
+	}
+	// a full leaf is not split for an existing cell
+	tr = Tree{}
+	for i := 0; i < maxItems; i++ {
+		tr.Insert(uint64(i), i)
+	}
+	if tr.InsertIfAbsent(maxItems/2, nil) || tr.root.branch {
+		t.Fatal("expected an unchanged leaf")
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		tr.InsertIfAbsent(maxItems/2, nil)
+	})
+	if allocs != 0 {
+		t.Fatalf("expected %v, got %v", 0, allocs)
+	}
+}
+
+func TestInsertTracked(t *testing.T) {
+	tr := New(WithMaxItems(16))
+	var splits int
+	for i := 0; i < 10000; i++ {
+		// cells sharing the same high bits
+		inserted, split := tr.InsertTracked(0xABCD000000000000|uint64(i), i)
+		if !inserted {
+			t.Fatal("expected true")
+		}
+		if i < 16 && split {
+			t.Fatalf("expected no split at %d", i)
+		}
+		if i == 16 && !split {
+			t.Fatal("expected a split")
+		}
+		if split {
+			splits++
+		}
+	}
+	tr.sane()
+	// each split makes at least one new branch
+	if splits == 0 || splits > tr.Stats().BranchCount {
+		t.Fatalf("expected [1,%d], got %d", tr.Stats().BranchCount, splits)
+	}
+	// replacing a cell in a unique tree does not insert
+	tr = New(WithUniqueCells(), WithMaxItems(16))
+	for i := 0; i < 16; i++ {
+		tr.InsertTracked(uint64(i), i)
+	}
+	inserted, split := tr.InsertTracked(5, 50)
+	if inserted || split {
+		t.Fatalf("expected false/false, got %v/%v", inserted, split)
+	}
+	inserted, split = tr.InsertTracked(16, 16)
+	if !inserted || !split {
+		t.Fatalf("expected true/true, got %v/%v", inserted, split)
+	}
+	tr.sane()
+}
+
+func TestReplace(t *testing.T) {
+	var tr Tree
+	if tr.Replace(10, nil) || tr.Count() != 0 {
+		t.Fatal("expected false")
+	}
+	N := 10000
+	ints := random(N, false)
+	for i := 0; i < N; i += 2 {
+		tr.Insert(ints[i], i)
+	}
+	for i := 0; i < N; i++ {
+		if tr.Replace(ints[i], -i) != (i%2 == 0) {
+			t.Fatalf("expected %v, got %v", i%2 == 0, i%2 != 0)
+		}
+	}
+	tr.sane()
+	if tr.Count() != N/2 {
+		t.Fatalf("expected %v, got %v", N/2, tr.Count())
+	}
+	for i := 0; i < N; i += 2 {
+		if !tr.Delete(ints[i], -i) {
+			t.Fatalf("expected %v to be replaced", ints[i])
+		}
+	}
+	// only the first of the duplicates is replaced
+	tr.Insert(100, 1)
+	tr.Insert(100, 2)
+	if !tr.Replace(100, 3) || !tr.Delete(100, 3) || !tr.Delete(100, 2) {
+		t.Fatal("expected the first item to be replaced")
+	}
+}
+
+func TestGetOrInsert(t *testing.T) {
+	var tr Tree
+	N := 10000
+	ints := random(N, false)
+	for i := 0; i < N; i++ {
+		data, loaded := tr.GetOrInsert(ints[i], func() interface{} {
+			return i
+		})
+		if loaded || data != i {
+			t.Fatalf("expected %v/false, got %v/%v", i, data, loaded)
+		}
+		if tr.Count() != i+1 {
+			t.Fatalf("expected %v, got %v", i+1, tr.Count())
+		}
+	}
+	for i := 0; i < N; i++ {
+		data, loaded := tr.GetOrInsert(ints[i], func() interface{} {
+			t.Fatal("expected no calls")
+			return nil
+		})
+		if !loaded || data != i {
+			t.Fatalf("expected %v/true, got %v/%v", i, data, loaded)
+		}
+		if tr.Count() != N {
+			t.Fatalf("expected %v, got %v", N, tr.Count())
+		}
+	}
+	tr.sane()
+	if tr.Count() != N {
+		t.Fatalf("expected %v, got %v", N, tr.Count())
+	}
+	// the first of the duplicates is returned
+	tr = Tree{}
+	for i := 0; i < maxItems*3; i++ {
+		tr.Insert(100, i)
+	}
+	if data, loaded := tr.GetOrInsert(100, nil); !loaded || data != 0 {
+		t.Fatalf("expected 0/true, got %v/%v", data, loaded)
+	}
+	tr.sane()
+	// a unique tree only calls create for missing cells
+	utr := New(WithUniqueCells(), WithMaxItems(8))
+	for i := 0; i < 1000; i++ {
+		var created bool
+		data, loaded := utr.GetOrInsert(uint64(i%500), func() interface{} {
+			created = true
+			return i
+		})
+		if created == loaded || data != i%500 {
+			t.Fatalf("expected %v/%v, got %v/%v", i%500, i >= 500, data,
+				loaded)
+		}
+	}
+	utr.sane()
+	if utr.Count() != 500 {
+		t.Fatalf("expected %v, got %v", 500, utr.Count())
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	var tr Tree
+	if tr.Update(10, nil) {
+		t.Fatal("expected false")
+	}
+	N := 10000
+	ints := random(N, false)
+	for i := 0; i < N; i++ {
+		tr.Insert(ints[i], i)
+	}
+	for i := 0; i < N; i++ {
+		if tr.Update(ints[i], func(data interface{}) (interface{}, bool) {
+			return nil, false
+		}) {
+			t.Fatal("expected false")
+		}
+		if !tr.Update(ints[i], func(data interface{}) (interface{}, bool) {
+			if data != i {
+				t.Fatalf("expected %v, got %v", i, data)
+			}
+			return -i, true
+		}) {
+			t.Fatal("expected true")
+		}
+	}
+	tr.sane()
+	for i := 0; i < N; i++ {
+		if !tr.Delete(ints[i], -i) {
+			t.Fatalf("expected %v to be updated", ints[i])
+		}
+	}
+	// duplicates
+	tr = Tree{}
+	for i := 0; i < maxItems*3; i++ {
+		tr.Insert(100, i)
+	}
+	var calls int
+	if !tr.Update(100, func(data interface{}) (interface{}, bool) {
+		calls++
+		return "hello", data == maxItems*2
+	}) {
+		t.Fatal("expected true")
+	}
+	if calls != maxItems*2+1 {
+		t.Fatalf("expected %v, got %v", maxItems*2+1, calls)
+	}
+	if !tr.Delete(100, "hello") || tr.Delete(100, "hello") {
+		t.Fatal("expected a single update")
+	}
+	if tr.Update(101, func(data interface{}) (interface{}, bool) {
+		t.Fatal("expected no calls")
+		return nil, true
+	}) {
+		t.Fatal("expected false")
+	}
+}
+
+func TestUpdateAll(t *testing.T) {
+	var tr Tree
+	if tr.UpdateAll(10, nil) != 0 {
+		t.Fatal("expected zero")
+	}
+	// duplicates that span more than a single leaf worth of items
+	for i := 0; i < maxItems*3; i++ {
+		tr.Insert(100, i)
+		tr.Insert(99, i)
+		tr.Insert(101, i)
+	}
+	n := tr.UpdateAll(100, func(data interface{}) interface{} {
+		return data.(int) * 10
+	})
+	if n != maxItems*3 {
+		t.Fatalf("expected %v, got %v", maxItems*3, n)
+	}
+	tr.sane()
+	for i := 0; i < maxItems*3; i++ {
+		if !tr.Delete(100, i*10) {
+			t.Fatalf("expected %v to be updated", i)
+		}
+		if !tr.Delete(99, i) || !tr.Delete(101, i) {
+			t.Fatalf("expected %v to be unchanged", i)
+		}
+	}
+	if tr.Count() != 0 {
+		t.Fatalf("expected zero, got %v", tr.Count())
+	}
+	if tr.UpdateAll(100, func(data interface{}) interface{} {
+		t.Fatal("expected no calls")
+		return nil
+	}) != 0 {
+		t.Fatal("expected zero")
+	}
+}
+
+func TestDeleteResult(t *testing.T) {
+	var tr Tree
+	if tr.Delete(10, nil) {
+		t.Fatal("expected false")
+	}
+	N := 10000
+	ints := random(N, false)
+	for i := 0; i < N; i++ {
+		tr.Insert(ints[i], i)
+	}
+	for i := 0; i < N; i++ {
+		if tr.Delete(ints[i], -1) {
+			t.Fatal("expected false")
+		}
+		if !tr.Delete(ints[i], i) {
+			t.Fatal("expected true")
+		}
+		if tr.Delete(ints[i], i) {
+			t.Fatal("expected false")
+		}
+	}
+	tr.sane()
+	if tr.Count() != 0 {
+		t.Fatalf("expected %v, got %v", 0, tr.Count())
+	}
+}
+
+func TestDeleteAll(t *testing.T) {
+	N := 1000000
+	cell := uint64(388098102398102938)
+	var tr Tree
+	if tr.DeleteAll(cell) != 0 {
+		t.Fatal("expected zero")
+	}
+	tr.Insert(cell-1, nil)
+	for i := 0; i < N; i++ {
+		tr.Insert(cell, i)
+	}
+	tr.Insert(cell+1, nil)
+	tr.sane()
+	if n := tr.DeleteAll(cell); n != N {
+		t.Fatalf("expected %v, got %v", N, n)
+	}
+	tr.sane()
+	if tr.Count() != 2 {
+		t.Fatalf("expected %v, got %v", 2, tr.Count())
+	}
+	tr.DeleteAll(cell - 1)
+	tr.DeleteAll(cell + 1)
+	tr.sane()
+	if tr.Count() != 0 {
+		t.Fatalf("expected %v, got %v", 0, tr.Count())
+	}
+
+	// random cells with some duplicates
+	tr = Tree{}
+	counts := make(map[uint64]int)
+	var cells []uint64
+	for i := 0; i < 50000; i++ {
+		cell := rand.Uint64()
+		if len(cells) > 0 && rand.Int()%4 == 0 {
+			cell = cells[rand.Int()%len(cells)]
+		} else {
+			cells = append(cells, cell)
+		}
+		counts[cell]++
+		tr.Insert(cell, i)
+	}
+	shuffle(cells)
+	for i, cell := range cells {
+		if n := tr.DeleteAll(cell); n != counts[cell] {
+			t.Fatalf("expected %v, got %v", counts[cell], n)
+		}
+		if i%1000 == 0 {
+			tr.sane()
+		}
+	}
+	tr.sane()
+	if tr.Count() != 0 {
+		t.Fatalf("expected %v, got %v", 0, tr.Count())
+	}
+}
+
+func TestDeleteWhenAll(t *testing.T) {
+	var tr Tree
+	if tr.DeleteWhenAll(10, nil) != 0 {
+		t.Fatal("expected zero")
+	}
+	// compare to deleting the items one at a time with DeleteWhen
+	var other Tree
+	var cells []uint64
+	for i := 0; i < 50000; i++ {
+		cell := rand.Uint64()
+		if len(cells) > 0 && rand.Int()%2 == 0 {
+			cell = cells[rand.Int()%len(cells)]
+		} else {
+			cells = append(cells, cell)
+		}
+		tr.Insert(cell, i)
+		other.Insert(cell, i)
+	}
+	// a long run of duplicates
+	for i := 0; i < maxItems*3; i++ {
+		tr.Insert(cells[0], -i)
+		other.Insert(cells[0], -i)
+	}
+	even := func(data interface{}) bool { return data.(int)%2 == 0 }
+	shuffle(cells)
+	for i, cell := range cells {
+		var expect int
+		for {
+			if _, deleted := other.DeleteWhen(cell, even); !deleted {
+				break
+			}
+			expect++
+		}
+		if n := tr.DeleteWhenAll(cell, even); n != expect {
+			t.Fatalf("expected %v, got %v", expect, n)
+		}
+		if tr.Count() != other.Count() {
+			t.Fatalf("expected %v, got %v", other.Count(), tr.Count())
+		}
+		if i%1000 == 0 {
+			tr.sane()
+		}
+	}
+	tr.sane()
+	if !tr.Equal(&other, nil) {
+		t.Fatal("expected equal trees")
+	}
+	tr.Scan(func(cell uint64, data interface{}) bool {
+		if even(data) {
+			t.Fatalf("expected %v to be deleted", data)
+		}
+		return true
+	})
+	// delete the rest
+	for _, cell := range cells {
+		tr.DeleteWhenAll(cell, func(data interface{}) bool { return true })
+	}
+	tr.sane()
+	if tr.Count() != 0 {
+		t.Fatalf("expected %v, got %v", 0, tr.Count())
+	}
+}
+
+func TestPrefixScan(t *testing.T) {
+	for _, opts := range []Options{{}, {MaxItems: 8, FanoutBits: 3}} {
+		tr := NewTree(opts)
+		var all []uint64
+		for i := 0; i < 20000; i++ {
+			var cell uint64
+			switch i % 3 {
+			case 0:
+				cell = rand.Uint64()
+			case 1:
+				// clustered
+				cell = 0xABCD000000000000 | rand.Uint64()>>20
+			case 2:
+				// sequential
+				cell = 0x1234000000000000 + uint64(i)
+			}
+			all = append(all, cell)
+			tr.Insert(cell, cell)
+		}
+		sortInts(all)
+		for i := 0; i < 1000; i++ {
+			prefix := all[rand.Int()%len(all)]
+			prefixBits := uint(rand.Int() % 65)
+			if i == 0 {
+				prefixBits = 0
+			} else if i == 1 {
+				prefixBits = 64
+			}
+			var hits1 []uint64
+			tr.PrefixScan(prefix, prefixBits,
+				func(cell uint64, data interface{}) bool {
+					hits1 = append(hits1, cell)
+					return true
+				},
+			)
+			var hits2 []uint64
+			for _, cell := range all {
+				if prefixBits == 0 || cell>>(64-prefixBits) ==
+					prefix>>(64-prefixBits) {
+					hits2 = append(hits2, cell)
+				}
+			}
+			if !cellsEqual(hits1, hits2) {
+				t.Fatalf("prefix %x/%d: not equal", prefix, prefixBits)
+			}
+		}
+	}
+	var tr Tree
+	tr.PrefixScan(0, 0, nil)
+	for i := 0; i < 1000; i++ {
+		tr.Insert(uint64(i), nil)
+	}
+	var count int
+	tr.PrefixScan(0, 0, func(cell uint64, data interface{}) bool {
+		count++
+		return count < 10
+	})
+	if count != 10 {
+		t.Fatalf("expected %v, got %v", 10, count)
+	}
+}
+
+// interleave returns the morton code for a 32-bit x/y point.
+func interleave(x, y uint32) uint64 {
+	var cell uint64
+	for i := 31; i >= 0; i-- {
+		cell = cell<<2 | uint64(x>>uint(i)&1)<<1 | uint64(y>>uint(i)&1)
+	}
+	return cell
+}
+
+func TestScanPrefixMorton(t *testing.T) {
+	type point struct{ x, y uint32 }
+	var tr Tree
+	var points []point
+	for i := 0; i < 20000; i++ {
+		pt := point{rand.Uint32(), rand.Uint32()}
+		points = append(points, pt)
+		tr.Insert(interleave(pt.x, pt.y), pt)
+	}
+	for i := 0; i < 100; i++ {
+		// pick a quadtree tile that contains a random point
+		level := uint(rand.Int()%8 + 1)
+		pt := points[rand.Int()%len(points)]
+		tile := interleave(pt.x, pt.y)
+		var count int
+		tr.ScanPrefix(tile, level*2, func(cell uint64, data interface{}) bool {
+			qt := data.(point)
+			if qt.x>>(32-level) != pt.x>>(32-level) ||
+				qt.y>>(32-level) != pt.y>>(32-level) {
+				t.Fatalf("point %v is outside of the tile", qt)
+			}
+			count++
+			return true
+		})
+		var expect int
+		for _, qt := range points {
+			if qt.x>>(32-level) == pt.x>>(32-level) &&
+				qt.y>>(32-level) == pt.y>>(32-level) {
+				expect++
+			}
+		}
+		if count != expect {
+			t.Fatalf("expected %v, got %v", expect, count)
+		}
+	}
+}
+
+func TestScanDescending(t *testing.T) {
+	var tr Tree
+	tr.ScanDescending(nil)
+	N := 10000
+	ints := random(N, rand.Int()%2 == 0)
+	for i := 0; i < N; i++ {
+		tr.Insert(ints[i], nil)
+	}
+	sortInts(ints)
+	var cells []uint64
+	tr.ScanDescending(func(cell uint64, data interface{}) bool {
+		cells = append(cells, cell)
+		return true
+	})
+	if len(cells) != N {
+		t.Fatalf("expected %v, got %v", N, len(cells))
+	}
+	for i := 0; i < N; i++ {
+		if cells[i] != ints[N-i-1] {
+			t.Fatal("not equal")
+		}
+	}
+	var count int
+	tr.ScanDescending(func(cell uint64, data interface{}) bool {
+		count++
+		return count < 10
+	})
+	if count != 10 {
+		t.Fatalf("expected %v, got %v", 10, count)
+	}
+}
+
+func TestCountPrefix(t *testing.T) {
+	for _, opts := range []Options{{}, {MaxItems: 8, FanoutBits: 3}} {
+		tr := NewTree(opts)
+		if tr.CountPrefix(0, 0) != 0 {
+			t.Fatal("expected zero")
+		}
+		var all []uint64
+		for i := 0; i < 20000; i++ {
+			var cell uint64
+			switch i % 3 {
+			case 0:
+				cell = rand.Uint64()
+			case 1:
+				cell = 0xABCD000000000000 | rand.Uint64()>>20
+			case 2:
+				cell = 0x1234000000000000 + uint64(i/2)
+			}
+			all = append(all, cell)
+			tr.Insert(cell, nil)
+		}
+		if tr.CountPrefix(0, 0) != tr.Count() {
+			t.Fatalf("expected %v, got %v", tr.Count(), tr.CountPrefix(0, 0))
+		}
+		for i := 0; i < 1000; i++ {
+			prefix := all[rand.Int()%len(all)]
+			if i%10 == 0 {
+				prefix = rand.Uint64()
+			}
+			prefixBits := uint(rand.Int() % 65)
+			var count int
+			tr.PrefixScan(prefix, prefixBits,
+				func(cell uint64, data interface{}) bool {
+					count++
+					return true
+				},
+			)
+			if n := tr.CountPrefix(prefix, prefixBits); n != count {
+				t.Fatalf("prefix %x/%d: expected %v, got %v",
+					prefix, prefixBits, count, n)
+			}
+			// filter all of the inserted cells
+			count = 0
+			shift := 64 - prefixBits
+			for _, cell := range all {
+				if cell>>shift == prefix>>shift {
+					count++
+				}
+			}
+			if n := tr.CountPrefix(prefix, prefixBits); n != count {
+				t.Fatalf("prefix %x/%d: expected %v, got %v",
+					prefix, prefixBits, count, n)
+			}
+		}
+	}
+}
+
+func TestCountPrefixAligned(t *testing.T) {
+	// prefixes that align with a node must match the node count
+	for _, b := range []uint{3, 7} {
+		tr := New(WithFanoutBits(b), WithMaxItems(16))
+		for i := 0; i < 20000; i++ {
+			tr.Insert(rand.Uint64()>>(rand.Uint64()%16), nil)
+		}
+		var nodes int
+		tr.Walk(func(depth int, isLeaf bool, count int, cellPrefix uint64) bool {
+			prefixBits := uint(depth) * b
+			if prefixBits > 64 {
+				prefixBits = 64
+			}
+			if n := tr.CountPrefix(cellPrefix, prefixBits); n != count {
+				t.Fatalf("prefix %x/%d: expected %v, got %v",
+					cellPrefix, prefixBits, count, n)
+			}
+			nodes++
+			return true
+		})
+		if nodes < 100 {
+			t.Fatalf("expected at least %v nodes, got %v", 100, nodes)
+		}
+	}
+}
+
+func TestDeletePrefix(t *testing.T) {
+	var tr Tree
+	if tr.DeletePrefix(0, 0) != 0 {
+		t.Fatal("expected zero")
+	}
+	for _, opts := range []Options{{}, {MaxItems: 8, FanoutBits: 3}} {
+		for i := 0; i < 200; i++ {
+			tr := NewTree(opts)
+			var all []uint64
+			for j := 0; j < 5000; j++ {
+				var cell uint64
+				switch j % 3 {
+				case 0:
+					cell = rand.Uint64()
+				case 1:
+					cell = 0xABCD000000000000 | rand.Uint64()>>20
+				case 2:
+					cell = 0x1234000000000000 + uint64(j/2)
+				}
+				all = append(all, cell)
+				tr.Insert(cell, nil)
+			}
+			prefix := all[rand.Int()%len(all)]
+			var prefixBits uint
+			if i%2 == 0 {
+				// aligned with a branch boundary
+				prefixBits = uint(rand.Int()%4) * tr.numBits
+			} else {
+				prefixBits = uint(rand.Int() % 65)
+			}
+			start, end := prefixSpan(prefix, prefixBits)
+			var expect int
+			for _, cell := range all {
+				if cell >= start && cell <= end {
+					expect++
+				}
+			}
+			if n := tr.DeletePrefix(prefix, prefixBits); n != expect {
+				t.Fatalf("prefix %x/%d: expected %v, got %v",
+					prefix, prefixBits, expect, n)
+			}
+			tr.sane()
+			if tr.Count() != len(all)-expect {
+				t.Fatalf("expected %v, got %v", len(all)-expect, tr.Count())
+			}
+			if tr.CountPrefix(prefix, prefixBits) != 0 {
+				t.Fatal("expected zero")
+			}
+			// the cells outside of the prefix, including the neighboring
+			// cells, must all survive
+			var keep []uint64
+			for _, cell := range all {
+				if cell < start || cell > end {
+					keep = append(keep, cell)
+				}
+			}
+			sort.Slice(keep, func(i, j int) bool { return keep[i] < keep[j] })
+			items := tr.ToSlice()
+			for j := range keep {
+				if items[j].Cell != keep[j] {
+					t.Fatalf("expected %x, got %x", keep[j], items[j].Cell)
+				}
+			}
+		}
+	}
+}
+
+func TestExtractRange(t *testing.T) {
+	var tr Tree
+	if cells, data := tr.ExtractRange(0, math.MaxUint64); cells != nil ||
+		data != nil {
+		t.Fatal("expected nil")
+	}
+	for i := 0; i < 50; i++ {
+		opts := []Option{WithMaxItems(rand.Int()%64 + 8)}
+		if i%2 == 0 {
+			opts = append(opts, WithNodePool())
+		}
+		tr := New(opts...)
+		N := rand.Int() % 20000
+		for j := 0; j < N; j++ {
+			// clustered cells with some duplicates
+			cell := rand.Uint64() >> (rand.Uint64() % 64)
+			tr.Insert(cell, j)
+			if j%10 == 0 {
+				for k := 0; k < rand.Int()%100; k++ {
+					tr.Insert(cell, -k)
+				}
+			}
+		}
+		all := tr.ToSlice()
+		start := rand.Uint64() >> (rand.Uint64() % 64)
+		end := start + rand.Uint64()>>(rand.Uint64()%64)
+		switch {
+		case i%10 == 0:
+			start, end = 0, math.MaxUint64
+		case end < start:
+			end = math.MaxUint64
+		}
+		cells, data := tr.ExtractRange(start, end)
+		tr.sane()
+		if len(cells) != len(data) || cap(cells) != len(cells) {
+			t.Fatalf("expected %v/%v, got %v/%v", len(cells), len(cells),
+				len(data), cap(cells))
+		}
+		if tr.Count()+len(cells) != len(all) {
+			t.Fatalf("expected %v, got %v", len(all), tr.Count()+len(cells))
+		}
+		// the extracted and the remaining items make up the original items
+		var j, k int
+		tr.Scan(func(cell uint64, value interface{}) bool {
+			for ; all[j] != (Item{cell, value}); j++ {
+				if all[j] != (Item{cells[k], data[k]}) {
+					t.Fatalf("expected %v, got %v", all[j],
+						Item{cells[k], data[k]})
+				}
+				k++
+			}
+			j++
+			return true
+		})
+		for ; j < len(all); j++ {
+			if all[j] != (Item{cells[k], data[k]}) {
+				t.Fatalf("expected %v, got %v", all[j], Item{cells[k], data[k]})
+			}
+			k++
+		}
+		for _, cell := range cells {
+			if cell < start || cell > end {
+				t.Fatalf("%v is outside of [%v,%v]", cell, start, end)
+			}
+		}
+		if tr.RangeDeleteCount(start, end, nil) != 0 {
+			t.Fatal("expected zero")
+		}
+	}
+}
+
+func TestSeekFirstGreater(t *testing.T) {
+	var tr Tree
+	if _, _, ok := tr.SeekFirstGreater(0); ok {
+		t.Fatal("expected false")
+	}
+	// cells with gaps and duplicates
+	N := 10000
+	for i := 0; i < N; i++ {
+		cell := uint64(i) * 1000
+		if i%2 == 0 {
+			cell = uint64(i) << 48
+		}
+		tr.Insert(cell, i)
+		if i%10 == 0 {
+			// duplicate cell
+			tr.Insert(cell, -i)
+		}
+	}
+	all := tr.ToSlice()
+	for i := 0; i < 1000; i++ {
+		var cell uint64
+		switch i % 3 {
+		case 0:
+			cell = all[rand.Int()%len(all)].Cell
+		case 1:
+			cell = all[rand.Int()%len(all)].Cell - 1
+		case 2:
+			cell = rand.Uint64()
+		}
+		j := sort.Search(len(all), func(j int) bool {
+			return all[j].Cell > cell
+		})
+		next, data, ok := tr.SeekFirstGreater(cell)
+		if j == len(all) {
+			if ok {
+				t.Fatalf("expected false for %v", cell)
+			}
+			continue
+		}
+		if !ok || next != all[j].Cell || data != all[j].Data {
+			t.Fatalf("expected %v/%v, got %v/%v", all[j].Cell, all[j].Data,
+				next, data)
+		}
+	}
+	last := all[len(all)-1].Cell
+	if _, _, ok := tr.SeekFirstGreater(last); ok {
+		t.Fatal("expected false")
+	}
+	tr.Insert(math.MaxUint64, nil)
+	if next, _, ok := tr.SeekFirstGreater(last); !ok ||
+		next != math.MaxUint64 {
+		t.Fatalf("expected %v, got %v", uint64(math.MaxUint64), next)
+	}
+	if _, _, ok := tr.SeekFirstGreater(math.MaxUint64); ok {
+		t.Fatal("expected false")
+	}
+	// paging through all of the distinct cells
+	var count int
+	cell, _, ok := tr.SeekFirstGreater(0)
+	for ; ok; cell, _, ok = tr.SeekFirstGreater(cell) {
+		count++
+	}
+	if count != N {
+		t.Fatalf("expected %v, got %v", N, count)
+	}
+}
+
+func TestScanSeek(t *testing.T) {
+	var tr Tree
+	tr.ScanSeek(func(cell uint64, data interface{}) (uint64, bool) {
+		t.Fatal("expected no items")
+		return 0, false
+	})
+	for _, tr := range []*Tree{
+		New(),
+		New(WithFanoutBits(4), WithMaxItems(16)),
+	} {
+		N := 50000
+		for i := 0; i < N; i++ {
+			// clustered cells with some duplicates
+			cell := rand.Uint64()>>(rand.Uint64()%64) | uint64(rand.Int()%8)<<61
+			tr.Insert(cell, i)
+			if i%10 == 0 {
+				tr.Insert(cell, -i)
+			}
+		}
+		all := tr.ToSlice()
+		for _, seekFn := range []func(cell uint64) uint64{
+			// no seeking
+			func(cell uint64) uint64 { return 0 },
+			// one sample per group of the high 8 bits
+			func(cell uint64) uint64 {
+				if cell>>56 == 0xFF {
+					return 0
+				}
+				return (cell>>56 + 1) << 56
+			},
+			// random seeks ahead
+			func(cell uint64) uint64 {
+				switch rand.Int() % 4 {
+				case 0:
+					return cell + rand.Uint64()>>(rand.Uint64()%64)
+				case 1:
+					return cell + 1
+				}
+				return 0
+			},
+		} {
+			var visited []Item
+			var seeks []uint64
+			tr.ScanSeek(func(cell uint64, data interface{}) (uint64, bool) {
+				visited = append(visited, Item{Cell: cell, Data: data})
+				seeks = append(seeks, seekFn(cell))
+				return seeks[len(seeks)-1], true
+			})
+			// replay the seeks on the sorted items
+			var i int
+			for j := range visited {
+				if i == len(all) || all[i] != visited[j] {
+					t.Fatalf("item %d: unexpected %v", j, visited[j])
+				}
+				if seeks[j] > visited[j].Cell {
+					i = sort.Search(len(all), func(i int) bool {
+						return all[i].Cell >= seeks[j]
+					})
+				} else {
+					i++
+				}
+			}
+			if i != len(all) {
+				t.Fatalf("expected %v to be visited", all[i])
+			}
+		}
+		// stop early
+		var count int
+		tr.ScanSeek(func(cell uint64, data interface{}) (uint64, bool) {
+			count++
+			return cell + 1000, count < 100
+		})
+		if count != 100 {
+			t.Fatalf("expected %v, got %v", 100, count)
+		}
+	}
+}
+
+func TestScanDeep(t *testing.T) {
+	// one bit per branch makes the deepest possible trees
+	tr := New(WithFanoutBits(1), WithMaxItems(4))
+	N := 10000
+	for i := 0; i < N; i++ {
+		switch i % 3 {
+		case 0:
+			tr.Insert(rand.Uint64(), i)
+		case 1:
+			tr.Insert(uint64(i), i)
+		case 2:
+			tr.Insert(math.MaxUint64-uint64(i), i)
+		}
+	}
+	tr.sane()
+	var expect []Item
+	tr.Leaves(func(prefix uint64, items []Item) bool {
+		expect = append(expect, items...)
+		return true
+	})
+	var all []Item
+	tr.Scan(func(cell uint64, data interface{}) bool {
+		all = append(all, Item{cell, data})
+		return true
+	})
+	if len(all) != len(expect) {
+		t.Fatalf("expected %v, got %v", len(expect), len(all))
+	}
+	for i := range all {
+		if all[i] != expect[i] {
+			t.Fatalf("expected %v, got %v", expect[i], all[i])
+		}
+	}
+	// stop early
+	for i := 0; i < 100; i++ {
+		stop := rand.Int() % N
+		var count int
+		tr.Scan(func(cell uint64, data interface{}) bool {
+			if all[count] != (Item{cell, data}) {
+				t.Fatalf("expected %v, got %v", all[count], Item{cell, data})
+			}
+			count++
+			return count <= stop
+		})
+		if count != stop+1 {
+			t.Fatalf("expected %v, got %v", stop+1, count)
+		}
+	}
+}
+
+func TestScanErr(t *testing.T) {
+	var tr Tree
+	errFail := errors.New("fail")
+	if err := tr.ScanErr(func(cell uint64, data interface{}) error {
+		return errFail
+	}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if err := tr.RangeErr(0, func(cell uint64, data interface{}) error {
+		return errFail
+	}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	// a deep tree so that the errors come from deep leaves
+	tr = *New(WithFanoutBits(1), WithMaxItems(4))
+	N := 10000
+	for i := 0; i < N; i++ {
+		tr.Insert(rand.Uint64(), i)
+	}
+	all := tr.ToSlice()
+	for _, stopErr := range []error{Stop, errFail} {
+		expectErr := stopErr
+		if stopErr == Stop {
+			expectErr = nil
+		}
+		for i := 0; i < 100; i++ {
+			stop := rand.Int() % N
+			var count int
+			err := tr.ScanErr(func(cell uint64, data interface{}) error {
+				if all[count] != (Item{cell, data}) {
+					t.Fatalf("expected %v, got %v", all[count],
+						Item{cell, data})
+				}
+				count++
+				if count > stop {
+					return stopErr
+				}
+				return nil
+			})
+			if err != expectErr {
+				t.Fatalf("expected %v, got %v", expectErr, err)
+			}
+			if count != stop+1 {
+				t.Fatalf("expected %v, got %v", stop+1, count)
+			}
+			// range from a random item to the stop
+			pivot := rand.Int() % N
+			count = 0
+			err = tr.RangeErr(all[pivot].Cell,
+				func(cell uint64, data interface{}) error {
+					if all[pivot+count] != (Item{cell, data}) {
+						t.Fatalf("expected %v, got %v", all[pivot+count],
+							Item{cell, data})
+					}
+					count++
+					if pivot+count > stop {
+						return stopErr
+					}
+					return nil
+				},
+			)
+			if err != expectErr {
+				t.Fatalf("expected %v, got %v", expectErr, err)
+			}
+			if stop >= pivot && count != stop-pivot+1 {
+				t.Fatalf("expected %v, got %v", stop-pivot+1, count)
+			}
+		}
+	}
+	// no error visits every item
+	var count int
+	if err := tr.ScanErr(func(cell uint64, data interface{}) error {
+		count++
+		return nil
+	}); err != nil || count != N {
+		t.Fatalf("expected nil/%v, got %v/%v", N, err, count)
+	}
+}
+
+func TestScanFilter(t *testing.T) {
+	var tr Tree
+	tr.ScanFilter(
+		func(cell uint64, data interface{}) bool {
+			t.Fatal("expected no items")
+			return true
+		},
+		func(cell uint64, data interface{}) bool {
+			t.Fatal("expected no items")
+			return true
+		},
+	)
+	N := 100000
+	for i := 0; i < N; i++ {
+		tr.Insert(rand.Uint64(), i)
+	}
+	even := func(cell uint64, data interface{}) bool {
+		return data.(int)%2 == 0
+	}
+	var expect []Item
+	tr.Scan(func(cell uint64, data interface{}) bool {
+		if even(cell, data) {
+			expect = append(expect, Item{cell, data})
+		}
+		return true
+	})
+	var all []Item
+	tr.ScanFilter(even, func(cell uint64, data interface{}) bool {
+		all = append(all, Item{cell, data})
+		return true
+	})
+	if len(all) != len(expect) {
+		t.Fatalf("expected %v, got %v", len(expect), len(all))
+	}
+	for i := range all {
+		if all[i] != expect[i] {
+			t.Fatalf("expected %v, got %v", expect[i], all[i])
+		}
+	}
+	// stop early
+	var count int
+	tr.ScanFilter(even, func(cell uint64, data interface{}) bool {
+		if all[count] != (Item{cell, data}) {
+			t.Fatalf("expected %v, got %v", all[count], Item{cell, data})
+		}
+		count++
+		return count < 100
+	})
+	if count != 100 {
+		t.Fatalf("expected %v, got %v", 100, count)
+	}
+}
+
+func TestScanContext(t *testing.T) {
+	var tr Tree
+	N := 100000
+	for i := 0; i < N; i++ {
+		tr.Insert(rand.Uint64(), i)
+	}
+	all := tr.ToSlice()
+	pivot := N / 2
+	scans := []struct {
+		start int
+		scan  func(ctx context.Context,
+			iter func(cell uint64, data interface{}) bool) error
+	}{
+		{0, tr.ScanContext},
+		{pivot, func(ctx context.Context,
+			iter func(cell uint64, data interface{}) bool) error {
+			return tr.RangeContext(ctx, all[pivot].Cell, iter)
+		}},
+	}
+	for _, sc := range scans {
+		start, scan := sc.start, sc.scan
+		// visit every item
+		var count int
+		err := scan(context.Background(),
+			func(cell uint64, data interface{}) bool {
+				if all[start+count] != (Item{cell, data}) {
+					t.Fatalf("expected %v, got %v", all[start+count],
+						Item{cell, data})
+				}
+				count++
+				return true
+			},
+		)
+		if err != nil || start+count != N {
+			t.Fatalf("expected nil/%v, got %v/%v", N, err, start+count)
+		}
+		// stop early
+		count = 0
+		err = scan(context.Background(),
+			func(cell uint64, data interface{}) bool {
+				count++
+				return count < 10
+			},
+		)
+		if err != nil || count != 10 {
+			t.Fatalf("expected nil/%v, got %v/%v", 10, err, count)
+		}
+		// already cancelled
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err = scan(ctx, func(cell uint64, data interface{}) bool {
+			t.Fatal("expected no items")
+			return true
+		})
+		if err != context.Canceled {
+			t.Fatalf("expected %v, got %v", context.Canceled, err)
+		}
+		// cancelled while scanning
+		ctx, cancel = context.WithCancel(context.Background())
+		count = 0
+		err = scan(ctx, func(cell uint64, data interface{}) bool {
+			count++
+			if count == 5000 {
+				cancel()
+			}
+			return true
+		})
+		if err != context.Canceled {
+			t.Fatalf("expected %v, got %v", context.Canceled, err)
+		}
+		if count < 5000 || count >= 5000+contextCheckItems {
+			t.Fatalf("expected [%v,%v), got %v", 5000,
+				5000+contextCheckItems, count)
+		}
+	}
+}
+
+func TestItems(t *testing.T) {
+	var tr Tree
+	for range tr.Items(context.Background(), 0) {
+		t.Fatal("expected no items")
+	}
+	N := 100000
+	for i := 0; i < N; i++ {
+		tr.Insert(rand.Uint64(), i)
+	}
+	all := tr.ToSlice()
+	// full drain
+	for _, buf := range []int{0, 1, 100} {
+		var count int
+		for item := range tr.Items(context.Background(), buf) {
+			if all[count] != item {
+				t.Fatalf("expected %v, got %v", all[count], item)
+			}
+			count++
+		}
+		if count != N {
+			t.Fatalf("expected %v, got %v", N, count)
+		}
+	}
+	// already cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for range tr.Items(ctx, 0) {
+		t.Fatal("expected no items")
+	}
+	// cancelled while streaming
+	ctx, cancel = context.WithCancel(context.Background())
+	var count int
+	for item := range tr.Items(ctx, 10) {
+		if all[count] != item {
+			t.Fatalf("expected %v, got %v", all[count], item)
+		}
+		count++
+		if count == 1000 {
+			cancel()
+		}
+	}
+	if count < 1000 || count == N {
+		t.Fatalf("expected [%v,%v), got %v", 1000, N, count)
+	}
+	// the consumer stops receiving, and the goroutine must exit once the
+	// context is cancelled
+	ngo := runtime.NumGoroutine()
+	ctx, cancel = context.WithCancel(context.Background())
+	ch := tr.Items(ctx, 10)
+	<-ch
+	cancel()
+	start := time.Now()
+	for runtime.NumGoroutine() > ngo {
+		if time.Since(start) > time.Second*10 {
+			t.Fatal("expected the goroutine to exit")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestScanBatch(t *testing.T) {
+	var tr Tree
+	tr.ScanBatch(func(cells []uint64, data []interface{}) bool {
+		t.Fatal("expected no items")
+		return false
+	})
+	for _, tr := range []*Tree{New(), New(WithMaxItems(8))} {
+		N := 100000
+		for i := 0; i < N; i++ {
+			tr.Insert(rand.Uint64(), i)
+		}
+		all := tr.ToSlice()
+		var j, batches int
+		tr.ScanBatch(func(cells []uint64, data []interface{}) bool {
+			if len(cells) == 0 || len(cells) != len(data) {
+				t.Fatalf("invalid batch %v/%v", len(cells), len(data))
+			}
+			for i := range cells {
+				if all[j] != (Item{cells[i], data[i]}) {
+					t.Fatalf("expected %v, got %v", all[j],
+						Item{cells[i], data[i]})
+				}
+				j++
+			}
+			batches++
+			return true
+		})
+		if j != len(all) {
+			t.Fatalf("expected %v, got %v", len(all), j)
+		}
+		if batches != tr.Stats().LeafCount {
+			t.Fatalf("expected %v, got %v", tr.Stats().LeafCount, batches)
+		}
+		// stop early
+		batches = 0
+		tr.ScanBatch(func(cells []uint64, data []interface{}) bool {
+			batches++
+			return batches < 3
+		})
+		if batches != 3 {
+			t.Fatalf("expected %v, got %v", 3, batches)
+		}
+	}
+}
+
+func TestMinMax(t *testing.T) {
+	var tr Tree
+	if _, ok := tr.Min(); ok {
+		t.Fatal("expected false")
+	}
+	if _, ok := tr.Max(); ok {
+		t.Fatal("expected false")
+	}
+	N := 10000
+	ints := random(N, rand.Int()%2 == 0)
+	for i := 0; i < N; i++ {
+		tr.Insert(ints[i], nil)
+	}
+	sortInts(ints)
+	for len(ints) > 0 {
+		min, ok := tr.Min()
+		if !ok || min != ints[0] {
+			t.Fatalf("expected %v, got %v", ints[0], min)
+		}
+		max, ok := tr.Max()
+		if !ok || max != ints[len(ints)-1] {
+			t.Fatalf("expected %v, got %v", ints[len(ints)-1], max)
+		}
+		tr.Delete(ints[0], nil)
+		ints = ints[1:]
+		if len(ints) > 0 {
+			tr.Delete(ints[len(ints)-1], nil)
+			ints = ints[:len(ints)-1]
+		}
+	}
+	if _, ok := tr.Min(); ok {
+		t.Fatal("expected false")
+	}
+	if _, ok := tr.Max(); ok {
+		t.Fatal("expected false")
+	}
+}
+
+func TestSparseChildren(t *testing.T) {
+	// clusters of cells leave most of the child indexes unused, and every
+	// change to the tree must keep the branches holding only the non-empty
+	// child nodes, sorted by index.
+	clustered := func(n int) []uint64 {
+		cells := make([]uint64, n)
+		for i := range cells {
+			cells[i] = uint64(i%4)<<60 | uint64(rand.Intn(1<<20))<<20
+		}
+		return cells
+	}
+	check := func(tr *Tree) {
+		t.Helper()
+		if err := tr.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		var asc, desc []uint64
+		tr.Scan(func(cell uint64, data interface{}) bool {
+			asc = append(asc, cell)
+			return true
+		})
+		tr.ScanDescending(func(cell uint64, data interface{}) bool {
+			desc = append(desc, cell)
+			return true
+		})
+		if len(asc) != tr.Count() || len(desc) != tr.Count() {
+			t.Fatalf("expected %v, got %v and %v", tr.Count(), len(asc),
+				len(desc))
+		}
+		for i := range asc {
+			if asc[i] != desc[len(desc)-1-i] {
+				t.Fatalf("expected %v, got %v", asc[i], desc[len(desc)-1-i])
+			}
+		}
+		if len(asc) > 0 {
+			min, _ := tr.Min()
+			max, _ := tr.Max()
+			if min != asc[0] || max != asc[len(asc)-1] {
+				t.Fatalf("expected %v/%v, got %v/%v", asc[0],
+					asc[len(asc)-1], min, max)
+			}
+		}
+	}
+	var tr Tree
+	cells := clustered(10000)
+	for _, cell := range cells {
+		tr.Insert(cell, nil)
+	}
+	check(&tr)
+	tr.InsertMany(clustered(5000), nil)
+	check(&tr)
+	tr.DeleteMany(cells[:2000], nil)
+	check(&tr)
+	tr.DeletePrefix(1, 4)
+	check(&tr)
+	tr.RangeDelete(2<<60, 3<<60, func(cell uint64, data interface{}) (
+		bool, bool) {
+		return cell&(1<<20) == 0, true
+	})
+	check(&tr)
+	right := tr.SplitAt(3<<60 | 1<<39)
+	check(&tr)
+	check(right)
+	var moved Tree
+	tr.MoveRange(&moved, 2<<60|1<<39, 3<<60-1)
+	check(&tr)
+	check(&moved)
+	right.TruncateBefore(3<<60 | 1<<50)
+	right.TruncateAfter(3<<60 | 1<<58)
+	check(right)
+	for _, cell := range cells[2000:] {
+		tr.DeleteAll(cell)
+		right.DeleteAll(cell)
+		moved.DeleteAll(cell)
+	}
+	check(&tr)
+	check(right)
+	check(&moved)
+}
+
+func TestSplitLeafChildren(t *testing.T) {
+	// splitting a leaf must only create the child nodes that it's items
+	// are routed to, which are allocated once. Pooled arrays have a power of
+	// two capacity.
+	for _, tc := range []struct {
+		tr  *Tree
+		cap int
+	}{
+		{New(WithMaxItems(16)), 5},
+		{New(WithMaxItems(16), WithNodePool()), 8},
+	} {
+		for i := 0; i < 17; i++ {
+			tc.tr.Insert(uint64(i%5)<<60|uint64(i), nil)
+		}
+		tc.tr.sane()
+		if !tc.tr.root.branch {
+			t.Fatal("expected a branch")
+		}
+		if len(tc.tr.root.nodes) != 5 || cap(tc.tr.root.nodes) != tc.cap {
+			t.Fatalf("expected %v/%v, got %v/%v", 5, tc.cap,
+				len(tc.tr.root.nodes), cap(tc.tr.root.nodes))
+		}
+	}
+}
+
+func TestRangeDeleteBounds(t *testing.T) {
+	newTree := func() *Tree {
+		var tr Tree
+		for i := 0; i < 1000; i++ {
+			tr.Insert(uint64(i*10), i)
+		}
+		tr.Insert(5000, -1)
+		return &tr
+	}
+	var count int
+	iter := func(cell uint64, data interface{}) (bool, bool) {
+		count++
+		return true, true
+	}
+
+	// start > end is a noop
+	tr := newTree()
+	tr.RangeDelete(6000, 4000, iter)
+	tr.RangeDelete(6000, 4000, nil)
+	tr.RangeDelete(math.MaxUint64, 0, nil)
+	tr.sane()
+	if count != 0 || tr.Count() != 1001 {
+		t.Fatalf("expected %v/%v, got %v/%v", 0, 1001, count, tr.Count())
+	}
+
+	// start == end that does not match a cell
+	tr.RangeDelete(5001, 5001, iter)
+	tr.RangeDelete(5001, 5001, nil)
+	tr.sane()
+	if count != 0 || tr.Count() != 1001 {
+		t.Fatalf("expected %v/%v, got %v/%v", 0, 1001, count, tr.Count())
+	}
+
+	// start == end that matches a duplicated cell
+	tr.RangeDelete(5000, 5000, iter)
+	tr.sane()
+	if count != 2 || tr.Count() != 999 {
+		t.Fatalf("expected %v/%v, got %v/%v", 2, 999, count, tr.Count())
+	}
+	tr = newTree()
+	tr.RangeDelete(5000, 5000, nil)
+	tr.sane()
+	if tr.Count() != 999 {
+		t.Fatalf("expected %v, got %v", 999, tr.Count())
+	}
+	tr.Range(4990, func(cell uint64, data interface{}) bool {
+		if cell != 4990 && cell != 5010 {
+			t.Fatalf("expected %v or %v, got %v", 4990, 5010, cell)
+		}
+		return cell < 5010
+	})
+}
+
+func TestRangeDeleteDeepNodes(t *testing.T) {
+	// the subtrees of a root child must be dropped using their actual cell
+	// ranges.
+	var tr Tree
+	for i := uint64(0); i < 2000; i++ {
+		tr.Insert(1<<57+i<<46, nil)
+	}
+	end := uint64(1<<57 + 1<<56)
+	var expect int
+	tr.Scan(func(cell uint64, _ interface{}) bool {
+		if cell > end {
+			expect++
+		}
+		return true
+	})
+	tr.RangeDelete(0, end, nil)
+	tr.sane()
+	if tr.Count() != expect {
+		t.Fatalf("expected %v, got %v", expect, tr.Count())
+	}
+}
+
+func TestToSlice(t *testing.T) {
+	var tr Tree
+	if items := tr.ToSlice(); items != nil {
+		t.Fatal("expected nil")
+	}
+	N := 10000
+	ints := random(N, false)
+	for i := 0; i < N; i++ {
+		tr.Insert(ints[i], i)
+		if i%10 == 0 {
+			// duplicate cell
+			tr.Insert(ints[i], -i)
+		}
+	}
+	items := tr.ToSlice()
+	if len(items) != tr.Count() || cap(items) != tr.Count() {
+		t.Fatalf("expected %v, got %v", tr.Count(), len(items))
+	}
+	if !sort.SliceIsSorted(items, func(i, j int) bool {
+		return items[i].Cell < items[j].Cell
+	}) {
+		t.Fatal("not sorted")
+	}
+	for i := 0; i < len(items); i++ {
+		data := items[i].Data.(int)
+		if data < 0 {
+			// duplicates are after the first
+			if items[i-1].Cell != items[i].Cell ||
+				items[i-1].Data != -data {
+				t.Fatalf("invalid duplicate at %v", i)
+			}
+			data = -data
+		}
+		if ints[data] != items[i].Cell {
+			t.Fatalf("expected %v, got %v", ints[data], items[i].Cell)
+		}
+	}
+}
+
+func TestScanFrom(t *testing.T) {
+	var tr Tree
+	cursor := Cursor{Cell: 10, Seen: 1}
+	if next, done := tr.ScanFrom(cursor, 10, nil); next != cursor || !done {
+		t.Fatalf("expected %v/true, got %v/%v", cursor, next, done)
+	}
+	for i := 0; i < 20; i++ {
+		tr := Tree{}
+		N := rand.Int() % 20000
+		for j := 0; j < N; j++ {
+			// clustered cells with some long runs of duplicates
+			cell := rand.Uint64() >> (rand.Uint64() % 64)
+			tr.Insert(cell, j)
+			if j%100 == 0 {
+				for k := 0; k < rand.Int()%300; k++ {
+					tr.Insert(cell, -k)
+				}
+			}
+		}
+		if i%2 == 0 {
+			tr.Insert(0, nil)
+			tr.Insert(0, 1)
+			tr.Insert(math.MaxUint64, nil)
+			tr.Insert(math.MaxUint64, 1)
+		}
+		all := tr.ToSlice()
+		limit := rand.Int()%500 + 1
+		// stop some pages early, usually in the middle of a duplicate run
+		stopEarly := i%4 == 1
+		var cursor Cursor
+		var page []Item
+		var pages []Item
+		var npages int
+		for done := false; !done; {
+			page = page[:0]
+			cursor, done = tr.ScanFrom(cursor, limit,
+				func(cell uint64, data interface{}) bool {
+					page = append(page, Item{cell, data})
+					return !stopEarly || rand.Int()%50 != 0
+				},
+			)
+			if len(page) > limit {
+				t.Fatalf("page is over the limit")
+			}
+			if len(page) > 0 {
+				last := page[len(page)-1].Cell
+				if cursor.Cell != last {
+					t.Fatalf("expected %v, got %v", last, cursor.Cell)
+				}
+			}
+			if !done && len(page) == 0 {
+				t.Fatal("expected items")
+			}
+			pages = append(pages, page...)
+			npages++
+			if npages > len(all)+1 {
+				t.Fatal("too many pages")
+			}
+		}
+		// no gaps or repeats
+		if len(pages) != len(all) {
+			t.Fatalf("expected %v, got %v", len(all), len(pages))
+		}
+		for j := range all {
+			if all[j] != pages[j] {
+				t.Fatalf("expected %v, got %v", all[j], pages[j])
+			}
+		}
+		// the last page knows that it's the last
+		if _, done := tr.ScanFrom(cursor, limit, nil); !done {
+			t.Fatal("expected done")
+		}
+	}
+	// stop in the middle of a run of duplicates
+	tr.Insert(5, 1)
+	tr.Insert(5, 2)
+	tr.Insert(6, 3)
+	var items []Item
+	iter := func(cell uint64, data interface{}) bool {
+		items = append(items, Item{cell, data})
+		return false
+	}
+	next, done := tr.ScanFrom(Cursor{}, 0, iter)
+	if next != (Cursor{5, 1}) || done {
+		t.Fatalf("expected {5 1}/false, got %v/%v", next, done)
+	}
+	next, done = tr.ScanFrom(next, 0, iter)
+	if next != (Cursor{5, 2}) || done {
+		t.Fatalf("expected {5 2}/false, got %v/%v", next, done)
+	}
+	next, done = tr.ScanFrom(next, 0, iter)
+	if next != (Cursor{6, 1}) || !done {
+		t.Fatalf("expected {6 1}/true, got %v/%v", next, done)
+	}
+	expect := []Item{{5, 1}, {5, 2}, {6, 3}}
+	if fmt.Sprint(items) != fmt.Sprint(expect) {
+		t.Fatalf("expected %v, got %v", expect, items)
+	}
+}
+
+func TestRangeBetween(t *testing.T) {
+	var tr Tree
+	tr.RangeBetween(0, math.MaxUint64, nil)
+	N := 10000
+	for i := 0; i < N; i++ {
+		cell := rand.Uint64()
+		tr.Insert(cell, cell)
+	}
+	for i := 0; i < 1000; i++ {
+		start, end := rand.Uint64(), rand.Uint64()
+		if start > end {
+			start, end = end, start
+		}
+		if i%2 == 0 {
+			end = start + rand.Uint64()%(math.MaxUint64/1000)
+		}
+		var hits1 []uint64
+		tr.RangeBetween(start, end, func(cell uint64, data interface{}) bool {
+			hits1 = append(hits1, cell)
+			return true
+		})
+		var hits2 []uint64
+		tr.Range(start, func(cell uint64, data interface{}) bool {
+			if cell > end {
+				return false
+			}
+			hits2 = append(hits2, cell)
+			return true
+		})
+		if !cellsEqual(hits1, hits2) {
+			t.Fatalf("[%x,%x]: not equal", start, end)
+		}
+	}
+	// start is greater than end
+	tr.RangeBetween(1, 0, func(cell uint64, data interface{}) bool {
+		t.Fatal("expected nothing")
+		return true
+	})
+}
+
+// BenchmarkScan visits every item in a tree that has 1M cells.
+func BenchmarkScan(b *testing.B) {
+	tr := benchmarkScanTree()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var sum uint64
+		tr.Scan(func(cell uint64, data interface{}) bool {
+			sum += cell
+			return true
+		})
+	}
+}
+
+// BenchmarkScanBatch visits every item in a tree that has 1M cells, one
+// leaf at a time.
+func BenchmarkScanBatch(b *testing.B) {
+	tr := benchmarkScanTree()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var sum uint64
+		tr.ScanBatch(func(cells []uint64, data []interface{}) bool {
+			for _, cell := range cells {
+				sum += cell
+			}
+			return true
+		})
+	}
+}
+
+func benchmarkScanTree() *Tree {
+	rng := rand.New(rand.NewSource(1))
+	var tr Tree
+	for i := 0; i < 1000000; i++ {
+		tr.Insert(rng.Uint64(), nil)
+	}
+	return &tr
+}
+
+// BenchmarkTruncateBefore expires the oldest 10 cells of a time series that
+// has 1M cells.
+func BenchmarkTruncateBefore(b *testing.B) {
+	benchmarkExpire(b, func(tr *Tree, cell uint64) {
+		tr.TruncateBefore(cell)
+	})
+}
+
+// BenchmarkTruncateBeforeRangeDelete is the same as BenchmarkTruncateBefore,
+// but uses RangeDelete.
+func BenchmarkTruncateBeforeRangeDelete(b *testing.B) {
+	benchmarkExpire(b, func(tr *Tree, cell uint64) {
+		tr.RangeDelete(0, cell-1, nil)
+	})
+}
+
+func benchmarkExpire(b *testing.B, expire func(tr *Tree, cell uint64)) {
+	rng := rand.New(rand.NewSource(1))
+	items := make([]Item, 1000000)
+	next := uint64(1) << 60
+	for i := range items {
+		next += 1 + uint64(rng.Intn(1<<20))
+		items[i].Cell = next
+	}
+	var tr *Tree
+	var j int
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if j == 0 {
+			b.StopTimer()
+			tr = new(Tree)
+			for _, item := range items {
+				tr.Insert(item.Cell, nil)
+			}
+			b.StartTimer()
+		}
+		j = (j + 10) % len(items)
+		expire(tr, items[j].Cell)
+	}
+}
+
+// BenchmarkInsertIfAbsentPresent inserts cells that already exist in a tree
+// that has 1M cells.
+func BenchmarkInsertIfAbsentPresent(b *testing.B) {
+	rng := rand.New(rand.NewSource(1))
+	var tr Tree
+	cells := make([]uint64, 1000000)
+	for i := range cells {
+		cells[i] = rng.Uint64()
+		tr.Insert(cells[i], nil)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tr.InsertIfAbsent(cells[i%len(cells)], nil)
+	}
+}
+
+// BenchmarkRangeNarrow iterates small windows of cells in a large clustered
+// tree, using Range and stopping once a cell is past the end.
+func BenchmarkRangeNarrow(b *testing.B) {
+	benchmarkRangeNarrow(b, func(tr *Tree, start, end uint64,
+		iter func(cell uint64, data interface{}) bool) {
+		tr.Range(start, func(cell uint64, data interface{}) bool {
+			return cell <= end && iter(cell, data)
+		})
+	})
+}
+
+// BenchmarkRangeBetweenNarrow iterates small windows of cells in a large
+// clustered tree, using RangeBetween.
+func BenchmarkRangeBetweenNarrow(b *testing.B) {
+	benchmarkRangeNarrow(b, (*Tree).RangeBetween)
+}
+
+func benchmarkRangeNarrow(b *testing.B, rng func(tr *Tree, start, end uint64,
+	iter func(cell uint64, data interface{}) bool)) {
+	tr := benchmarkClusteredTree()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		start := rand.Uint64()
+		end := start + math.MaxUint64/100000
+		if end < start {
+			// the range wrapped around
+			end = math.MaxUint64
+		}
+		rng(tr, start, end,
+			func(cell uint64, data interface{}) bool {
+				return true
+			},
+		)
+	}
+}
+
+// BenchmarkMinMaxClustered finds the smallest and largest cells in a large
+// clustered tree.
+func BenchmarkMinMaxClustered(b *testing.B) {
+	tr := benchmarkClusteredTree()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tr.Min()
+		tr.Max()
+	}
+}
+
+// BenchmarkScanDescendingClustered visits every item in a large clustered
+// tree in descending order.
+func BenchmarkScanDescendingClustered(b *testing.B) {
+	tr := benchmarkClusteredTree()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tr.ScanDescending(func(cell uint64, data interface{}) bool {
+			return true
+		})
+	}
+}
+
+func benchmarkClusteredTree() *Tree {
+	rng := rand.New(rand.NewSource(1))
+	var tr Tree
+	// sparse clusters of cells, leaving large empty gaps in the tree
+	for i := 0; i < 1000; i++ {
+		base := rng.Uint64()
+		for j := 0; j < 1000; j++ {
+			tr.Insert(base+rng.Uint64()%(1<<32), nil)
+		}
+	}
+	return &tr
+}
+
+// randomCovering returns n random ranges that are clustered around a point,
+// similar to the cell ranges of a spatial covering.
+func randomCovering(rng *rand.Rand, n int) [][2]uint64 {
+	center := rng.Uint64()
+	ranges := make([][2]uint64, n)
+	for i := range ranges {
+		start := center + rng.Uint64()%(math.MaxUint64/1000)
+		end := start + rng.Uint64()%(math.MaxUint64/100000)
+		if end < start {
+			end = math.MaxUint64
+		}
+		ranges[i] = [2]uint64{start, end}
+	}
+	return ranges
+}
+
+func TestCountWhere(t *testing.T) {
+	var tr Tree
+	if tr.CountWhere(func(cell uint64, data interface{}) bool {
+		return true
+	}) != 0 {
+		t.Fatal("expected zero")
+	}
+	N := 100000
+	var expect int
+	for i := 0; i < N; i++ {
+		data := rand.Int() % 10
+		if data < 3 {
+			expect++
+		}
+		tr.Insert(rand.Uint64(), data)
+	}
+	pred := func(cell uint64, data interface{}) bool {
+		return data.(int) < 3
+	}
+	if n := tr.CountWhere(pred); n != expect {
+		t.Fatalf("expected %v, got %v", expect, n)
+	}
+	allocs := testing.AllocsPerRun(10, func() { tr.CountWhere(pred) })
+	if allocs != 0 {
+		t.Fatalf("expected %v, got %v", 0, allocs)
+	}
+}
+
+func TestReduce(t *testing.T) {
+	var tr Tree
+	if v := tr.Reduce(10, nil); v != 10 {
+		t.Fatalf("expected %v, got %v", 10, v)
+	}
+	N := 10000
+	ints := random(N, false)
+	for i := 0; i < N; i++ {
+		tr.Insert(ints[i], i)
+	}
+	var expect int
+	tr.Scan(func(cell uint64, data interface{}) bool {
+		expect += data.(int)
+		return true
+	})
+	sum := tr.Reduce(0,
+		func(acc interface{}, cell uint64, data interface{}) interface{} {
+			return acc.(int) + data.(int)
+		},
+	)
+	if sum != expect {
+		t.Fatalf("expected %v, got %v", expect, sum)
+	}
+	// the items are in ascending order
+	tr.Reduce(uint64(0),
+		func(acc interface{}, cell uint64, data interface{}) interface{} {
+			if cell < acc.(uint64) {
+				t.Fatalf("expected >= %v, got %v", acc, cell)
+			}
+			return cell
+		},
+	)
+}
+
+func TestReduceRange(t *testing.T) {
+	var tr Tree
+	if v := tr.ReduceRange(0, math.MaxUint64, 10, nil); v != 10 {
+		t.Fatalf("expected %v, got %v", 10, v)
+	}
+	N := 10000
+	for i := 0; i < N; i++ {
+		tr.Insert(uint64(i), i)
+	}
+	sum := tr.ReduceRange(100, 199, 0,
+		func(acc interface{}, cell uint64, data interface{}) interface{} {
+			return acc.(int) + data.(int)
+		},
+	)
+	if sum != 14950 {
+		t.Fatalf("expected %v, got %v", 14950, sum)
+	}
+	// the items are in ascending order
+	last := tr.ReduceRange(0, math.MaxUint64, -1,
+		func(acc interface{}, cell uint64, data interface{}) interface{} {
+			if data.(int) != acc.(int)+1 {
+				t.Fatalf("expected %v, got %v", acc.(int)+1, data)
+			}
+			return data
+		},
+	)
+	if last != N-1 {
+		t.Fatalf("expected %v, got %v", N-1, last)
+	}
+	if v := tr.ReduceRange(uint64(N), math.MaxUint64, "none", nil); v != "none" {
+		t.Fatalf("expected %v, got %v", "none", v)
+	}
+}
+
+func TestMultiRange(t *testing.T) {
+	var tr Tree
+	tr.MultiRange([][2]uint64{{0, math.MaxUint64}}, nil)
+	N := 100000
+	for i := 0; i < N; i++ {
+		cell := rand.Uint64()
+		if i%2 == 0 {
+			// clustered
+			cell = cell/1024 + math.MaxUint64/2
+		}
+		tr.Insert(cell, nil)
+		if i%10 == 0 {
+			// duplicate cell
+			tr.Insert(cell, nil)
+		}
+	}
+	rng := rand.New(rand.NewSource(rand.Int63()))
+	for i := 0; i < 200; i++ {
+		var ranges [][2]uint64
+		switch i % 4 {
+		case 0:
+			ranges = randomCovering(rng, rand.Int()%100+1)
+			if i%8 == 0 {
+				ranges = mergeRanges(ranges)
+			}
+		case 1:
+			// random ranges that may overlap
+			for j := 0; j < rand.Int()%20; j++ {
+				start, end := rand.Uint64(), rand.Uint64()
+				if j%2 == 0 {
+					end = start + rand.Uint64()%(math.MaxUint64/1000)
+				}
+				ranges = append(ranges, [2]uint64{start, end})
+			}
+		case 2:
+			// around the clustered cells
+			for j := 0; j < 20; j++ {
+				start := math.MaxUint64/2 + rand.Uint64()%(1<<54)
+				end := start + rand.Uint64()%(1<<50)
+				ranges = append(ranges, [2]uint64{start, end})
+			}
+		case 3:
+			ranges = [][2]uint64{{0, math.MaxUint64}, {5, 10}}
+		}
+		// the union of the individual ranges
+		var expect []uint64
+		tr.Scan(func(cell uint64, data interface{}) bool {
+			for _, r := range ranges {
+				if cell >= r[0] && cell <= r[1] {
+					expect = append(expect, cell)
+					break
+				}
+			}
+			return true
+		})
+		var cells []uint64
+		tr.MultiRange(ranges, func(cell uint64, data interface{}) bool {
+			cells = append(cells, cell)
+			return true
+		})
+		if !cellsEqual(cells, expect) {
+			t.Fatalf("expected %v cells, got %v", len(expect), len(cells))
+		}
+		// stop early
+		if len(expect) > 1 {
+			stop := rand.Int()%(len(expect)-1) + 1
+			var count int
+			tr.MultiRange(ranges, func(cell uint64, data interface{}) bool {
+				count++
+				return count < stop
+			})
+			if count != stop {
+				t.Fatalf("expected %v, got %v", stop, count)
+			}
+		}
+	}
+}
+
+func TestMultiRangeAdjacent(t *testing.T) {
+	var tr Tree
+	for i := 0; i < 1000; i++ {
+		tr.Insert(uint64(i), i)
+		if i%3 == 0 {
+			// duplicate cell
+			tr.Insert(uint64(i), -i)
+		}
+	}
+	for _, tc := range []struct {
+		ranges [][2]uint64
+		merged [][2]uint64
+	}{
+		{[][2]uint64{{20, 29}, {10, 19}}, [][2]uint64{{10, 29}}},
+		{[][2]uint64{{10, 20}, {15, 25}, {30, 40}},
+			[][2]uint64{{10, 25}, {30, 40}}},
+		{[][2]uint64{{50, 60}, {0, 100}, {70, 80}}, [][2]uint64{{0, 100}}},
+		{[][2]uint64{{900, 2000}, {5, 3}, {899, 899}, {10, 10}},
+			[][2]uint64{{10, 10}, {899, 2000}}},
+		{[][2]uint64{{math.MaxUint64, math.MaxUint64}, {0, math.MaxUint64}},
+			[][2]uint64{{0, math.MaxUint64}}},
+	} {
+		merged := mergeRanges(tc.ranges)
+		if fmt.Sprint(merged) != fmt.Sprint(tc.merged) {
+			t.Fatalf("expected %v, got %v", tc.merged, merged)
+		}
+		// the union of the individual ranges, with every item once
+		var expect []Item
+		tr.Scan(func(cell uint64, data interface{}) bool {
+			for _, r := range tc.ranges {
+				if cell >= r[0] && cell <= r[1] {
+					expect = append(expect, Item{cell, data})
+					break
+				}
+			}
+			return true
+		})
+		var items []Item
+		tr.MultiRange(tc.ranges, func(cell uint64, data interface{}) bool {
+			items = append(items, Item{cell, data})
+			return true
+		})
+		if fmt.Sprint(items) != fmt.Sprint(expect) {
+			t.Fatalf("%v: expected %v items, got %v", tc.ranges, len(expect),
+				len(items))
+		}
+	}
+}
+
+func BenchmarkMultiRange(b *testing.B) {
+	benchmarkMultiRange(b, func(tr *Tree, ranges [][2]uint64,
+		iter func(cell uint64, data interface{}) bool) {
+		tr.MultiRange(ranges, iter)
+	})
+}
+
+func BenchmarkMultiRangeLoop(b *testing.B) {
+	benchmarkMultiRange(b, func(tr *Tree, ranges [][2]uint64,
+		iter func(cell uint64, data interface{}) bool) {
+		for _, r := range ranges {
+			tr.RangeBetween(r[0], r[1], iter)
+		}
+	})
+}
+
+// benchmarkMultiRange iterates sorted coverings of about 50 ranges over a
+// tree that has 1M cells.
+func benchmarkMultiRange(b *testing.B, multiRange func(tr *Tree,
+	ranges [][2]uint64, iter func(cell uint64, data interface{}) bool)) {
+	rng := rand.New(rand.NewSource(1))
+	var tr Tree
+	for i := 0; i < 1000000; i++ {
+		tr.Insert(rng.Uint64(), nil)
+	}
+	coverings := make([][][2]uint64, 1000)
+	for i := range coverings {
+		// coverings are usually sorted
+		coverings[i] = mergeRanges(randomCovering(rng, 50))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		multiRange(&tr, coverings[i%len(coverings)],
+			func(cell uint64, data interface{}) bool {
+				return true
+			},
+		)
+	}
+}
+
+func TestRangeBetweenReverse(t *testing.T) {
+	for _, opts := range []Options{{}, {MaxItems: 8, FanoutBits: 3}} {
+		tr := NewTree(opts)
+		tr.RangeBetweenReverse(0, math.MaxUint64, nil)
+		for i := 0; i < 10000; i++ {
+			cell := rand.Uint64()
+			if i%2 == 0 {
+				// clustered
+				cell = cell/1024 + math.MaxUint64/2
+			}
+			tr.Insert(cell, i)
+			if i%10 == 0 {
+				// duplicate cell
+				tr.Insert(cell, -i)
+			}
+		}
+		for i := 0; i < 200; i++ {
+			start, end := rand.Uint64(), rand.Uint64()
+			if start > end {
+				start, end = end, start
+			}
+			switch i % 4 {
+			case 0:
+				start, end = 0, math.MaxUint64
+			case 1:
+				end = start + rand.Uint64()%(math.MaxUint64/1000)
+			}
+			var items1 []Item
+			tr.RangeBetween(start, end, func(cell uint64, data interface{}) bool {
+				items1 = append(items1, Item{cell, data})
+				return true
+			})
+			var items2 []Item
+			tr.RangeBetweenReverse(start, end,
+				func(cell uint64, data interface{}) bool {
+					items2 = append(items2, Item{cell, data})
+					return true
+				},
+			)
+			if len(items1) != len(items2) {
+				t.Fatalf("expected %v, got %v", len(items1), len(items2))
+			}
+			for j := range items1 {
+				if items1[j] != items2[len(items2)-j-1] {
+					t.Fatalf("[%x,%x]: not equal", start, end)
+				}
+			}
+		}
+		// stop early
+		var count int
+		tr.RangeBetweenReverse(0, math.MaxUint64,
+			func(cell uint64, data interface{}) bool {
+				count++
+				return count < 10
+			},
+		)
+		if count != 10 {
+			t.Fatalf("expected %v, got %v", 10, count)
+		}
+	}
+}
+
+func TestRangeWithIndex(t *testing.T) {
+	var tr Tree
+	tr.RangeWithIndex(0, func(index int, cell uint64, data interface{}) bool {
+		t.Fatal("expected no items")
+		return false
+	})
+	N := 10000
+	for i := 0; i < N; i++ {
+		tr.Insert(rand.Uint64(), i)
+	}
+	start := rand.Uint64()
+	var items []Item
+	tr.Range(start, func(cell uint64, data interface{}) bool {
+		items = append(items, Item{cell, data})
+		return true
+	})
+	var count int
+	tr.RangeWithIndex(start,
+		func(index int, cell uint64, data interface{}) bool {
+			if index != count {
+				t.Fatalf("expected %v, got %v", count, index)
+			}
+			if items[index] != (Item{cell, data}) {
+				t.Fatalf("expected %v, got %v", items[index],
+					Item{cell, data})
+			}
+			count++
+			return true
+		},
+	)
+	if count != len(items) {
+		t.Fatalf("expected %v, got %v", len(items), count)
+	}
+	// stop early
+	count = 0
+	tr.RangeWithIndex(0, func(index int, cell uint64, data interface{}) bool {
+		count++
+		return index < 9
+	})
+	if count != 10 {
+		t.Fatalf("expected %v, got %v", 10, count)
+	}
+}
+
+func TestRangeLimit(t *testing.T) {
+	var tr Tree
+	tr.RangeLimit(0, 10, nil)
+	N := 10000
+	for i := 0; i < N; i++ {
+		tr.Insert(rand.Uint64(), nil)
+	}
+	all := tr.ToSlice()
+	// the number of items in the first and second leaves
+	it := newLeafIter(tr.root)
+	leaf1, leaf2 := len(it.next()), len(it.next())
+	for _, limit := range []int{-1, 0, 1, 10, leaf1, leaf1 + leaf2, N - 1, N,
+		N + 1, N * 2} {
+		var cells []uint64
+		tr.RangeLimit(0, limit, func(cell uint64, data interface{}) bool {
+			cells = append(cells, cell)
+			return true
+		})
+		expect := limit
+		if limit <= 0 || limit > N {
+			expect = N
+		}
+		if len(cells) != expect {
+			t.Fatalf("limit %v: expected %v, got %v", limit, expect,
+				len(cells))
+		}
+		for i := range cells {
+			if cells[i] != all[i].Cell {
+				t.Fatalf("expected %v, got %v", all[i].Cell, cells[i])
+			}
+		}
+	}
+	// starting from a pivot
+	for i := 0; i < 100; i++ {
+		j := rand.Int() % N
+		limit := rand.Int()%100 + 1
+		expect := all[j:]
+		if len(expect) > limit {
+			expect = expect[:limit]
+		}
+		var count int
+		tr.RangeLimit(all[j].Cell, limit,
+			func(cell uint64, data interface{}) bool {
+				if cell != expect[count].Cell {
+					t.Fatalf("expected %v, got %v", expect[count].Cell, cell)
+				}
+				count++
+				return true
+			},
+		)
+		if count != len(expect) {
+			t.Fatalf("expected %v, got %v", len(expect), count)
+		}
+	}
+}
+
+func TestRangeSlice(t *testing.T) {
+	var tr Tree
+	if items := tr.RangeSlice(0, math.MaxUint64, 0); items != nil {
+		t.Fatal("expected nil")
+	}
+	N := 10000
+	ints := random(N, false)
+	for i := 0; i < N; i++ {
+		tr.Insert(ints[i], ints[i])
+	}
+	sortInts(ints)
+	for i := 0; i < 100; i++ {
+		start, end := rand.Uint64(), rand.Uint64()
+		if start > end {
+			start, end = end, start
+		}
+		var expect []uint64
+		for _, cell := range ints {
+			if cell >= start && cell <= end {
+				expect = append(expect, cell)
+			}
+		}
+		limit := rand.Int() % (len(expect) + 2)
+		if i%2 == 0 {
+			limit = 0
+		}
+		if limit > 0 && limit < len(expect) {
+			expect = expect[:limit]
+		}
+		items := tr.RangeSlice(start, end, limit)
+		if len(items) != len(expect) {
+			t.Fatalf("expected %v, got %v", len(expect), len(items))
+		}
+		for i := range items {
+			if items[i].Cell != expect[i] || items[i].Data != expect[i] {
+				t.Fatalf("expected %v, got %v", expect[i], items[i].Cell)
+			}
+		}
+	}
+	// empty ranges
+	if items := tr.RangeSlice(ints[1], ints[0], 0); items != nil {
+		t.Fatal("expected nil")
+	}
+	if items := tr.RangeSlice(ints[0]+1, ints[1]-1, 0); items != nil {
+		t.Fatal("expected nil")
+	}
+	if items := tr.RangeSlice(ints[0], ints[0], 0); len(items) != 1 {
+		t.Fatalf("expected %v, got %v", 1, len(items))
+	}
+}
+
+func TestRangeCount(t *testing.T) {
+	var tr Tree
+	tr.RangeCount(0, math.MaxUint64,
+		func(cell uint64, data interface{}, remaining int) bool {
+			t.Fatal("expected nothing")
+			return true
+		},
+	)
+	N := 10000
+	ints := random(N, false)
+	for i := 0; i < N; i++ {
+		tr.Insert(ints[i], nil)
+	}
+	for i := 0; i < 100; i++ {
+		start, end := rand.Uint64(), rand.Uint64()
+		if start > end {
+			start, end = end, start
+		}
+		if i == 0 {
+			start, end = 0, math.MaxUint64
+		}
+		items := tr.RangeSlice(start, end, 0)
+		expect := len(items)
+		var last uint64
+		tr.RangeCount(start, end,
+			func(cell uint64, data interface{}, remaining int) bool {
+				expect--
+				if remaining != expect {
+					t.Fatalf("expected %v, got %v", expect, remaining)
+				}
+				last = cell
+				return true
+			},
+		)
+		if expect != 0 {
+			t.Fatalf("expected %v, got %v", 0, expect)
+		}
+		if len(items) > 0 && last != items[len(items)-1].Cell {
+			t.Fatalf("expected %v, got %v", items[len(items)-1].Cell, last)
+		}
+	}
+	// stop early
+	var visited int
+	tr.RangeCount(0, math.MaxUint64,
+		func(cell uint64, data interface{}, remaining int) bool {
+			visited++
+			return remaining > N/2
+		},
+	)
+	if visited != N/2 {
+		t.Fatalf("expected %v, got %v", N/2, visited)
+	}
+}
+
+func TestEqual(t *testing.T) {
+	var tr1, tr2 Tree
+	if !tr1.Equal(&tr2, nil) {
+		t.Fatal("expected true")
+	}
+	N := 10000
+	ints := random(N, false)
+	for i := 0; i < N; i++ {
+		tr1.Insert(ints[i], ints[i])
+	}
+	shuffle(ints)
+	tr2 = *NewTree(Options{MaxItems: 16, FanoutBits: 3})
+	for i := 0; i < N; i++ {
+		tr2.Insert(ints[i], ints[i])
+	}
+	if !tr1.Equal(&tr2, nil) || !tr2.Equal(&tr1, nil) {
+		t.Fatal("expected true")
+	}
+	// differ by one item
+	tr2.Delete(ints[0], ints[0])
+	if tr1.Equal(&tr2, nil) {
+		t.Fatal("expected false")
+	}
+	tr2.Insert(ints[0]+1, ints[0])
+	if tr1.Equal(&tr2, nil) {
+		t.Fatal("expected false")
+	}
+	tr2.Delete(ints[0]+1, ints[0])
+	tr2.Insert(ints[0], ints[0])
+	if !tr1.Equal(&tr2, nil) {
+		t.Fatal("expected true")
+	}
+	// custom data comparison
+	tr2.InsertOrReplace(ints[1], nil,
+		func(data interface{}) (interface{}, bool) {
+			return int(data.(uint64)), true
+		},
+	)
+	if tr1.Equal(&tr2, nil) {
+		t.Fatal("expected false")
+	}
+	eq := func(a, b interface{}) bool {
+		if v, ok := b.(int); ok {
+			b = uint64(v)
+		}
+		return a == b
+	}
+	if !tr1.Equal(&tr2, eq) {
+		t.Fatal("expected true")
+	}
+}
+
+func TestEqualDataOnly(t *testing.T) {
+	var tr1, tr2 Tree
+	N := 1000
+	for i := 0; i < N; i++ {
+		tr1.Insert(uint64(i), i)
+		tr2.Insert(uint64(i), i)
+	}
+	// change only the data of the middle item
+	tr2.ReplaceAll(uint64(N/2), -1)
+	if tr1.Equal(&tr2, nil) {
+		t.Fatal("expected false")
+	}
+	// compare cells only
+	cellsOnly := func(a, b interface{}) bool { return true }
+	if !tr1.Equal(&tr2, cellsOnly) {
+		t.Fatal("expected true")
+	}
+	// stops at the first mismatch
+	var calls int
+	tr1.Equal(&tr2, func(a, b interface{}) bool {
+		calls++
+		return a == b
+	})
+	if calls != N/2+1 {
+		t.Fatalf("expected %v, got %v", N/2+1, calls)
+	}
+	// different counts are not compared item by item
+	tr2.Insert(uint64(N), N)
+	calls = 0
+	if tr1.Equal(&tr2, func(a, b interface{}) bool {
+		calls++
+		return true
+	}) || calls != 0 {
+		t.Fatal("expected false without any calls")
+	}
+}
+
+func TestNew(t *testing.T) {
+	tr := New()
+	if tr.numBits != numBits || tr.maxItems != maxItems {
+		t.Fatal("invalid defaults")
+	}
+	tr = New(WithMaxItems(32))
+	if tr.maxItems != 32 || tr.minItems != 32*40/100 {
+		t.Fatalf("expected %v, got %v", 32, tr.maxItems)
+	}
+	testRandomStepTree(t, tr, 5000)
+	for i := 0; i < 1000; i++ {
+		tr.Insert(rand.Uint64(), nil)
+	}
+	if stats := tr.Stats(); stats.LeafCount < 1000/32 {
+		t.Fatalf("expected at least %v leaves, got %v", 1000/32,
+			stats.LeafCount)
+	}
+}
+
+func TestFanoutBits(t *testing.T) {
+	for _, b := range []uint{2, 3, 4, 5, 6, 8} {
+		t.Run(fmt.Sprint(b), func(t *testing.T) {
+			tr := New(WithFanoutBits(b))
+			if tr.numBits != b {
+				t.Fatalf("expected %v, got %v", b, tr.numBits)
+			}
+			start := time.Now()
+			for time.Since(start) < time.Second/4 {
+				testRandomStepTree(t, New(WithFanoutBits(b)),
+					rand.Int()%10000)
+			}
+			for i := 0; i < 10000; i++ {
+				tr.Insert(rand.Uint64()>>(rand.Uint64()%64), nil)
+			}
+			tr.sane()
+			tr.RangeDelete(0, math.MaxUint64/2, nil)
+			tr.sane()
+		})
+	}
+}
+
+func TestInsertMany(t *testing.T) {
+	for _, opts := range []Options{{}, {MaxItems: 8, FanoutBits: 3}} {
+		for i := 0; i < 20; i++ {
+			tr1, tr2 := NewTree(opts), NewTree(opts)
+			if i%4 == 0 {
+				popts := opts
+				popts.NodePool = true
+				tr2 = NewTree(popts)
+			}
+			// start with some existing items
+			N := rand.Int() % 20000
+			for j := 0; j < N; j++ {
+				cell := rand.Uint64()
+				tr1.Insert(cell, j)
+				tr2.Insert(cell, j)
+			}
+			M := rand.Int() % 20000
+			cells := make([]uint64, M)
+			data := make([]interface{}, M)
+			for j := range cells {
+				cells[j] = rand.Uint64()
+				if i%2 == 0 {
+					// clustered
+					cells[j] = cells[j]/1024 + math.MaxUint64/2
+				}
+				if j > 0 && j%10 == 0 {
+					// duplicate cell
+					cells[j] = cells[j-1]
+				}
+				data[j] = N + j
+			}
+			if i%3 != 0 {
+				sortInts(cells)
+			}
+			for j := range cells {
+				tr1.Insert(cells[j], data[j])
+			}
+			tr2.InsertMany(cells, data)
+			tr2.sane()
+			if !tr1.Equal(tr2, nil) {
+				t.Fatal("trees not equal")
+			}
+		}
+	}
+	// nil data
+	var tr Tree
+	tr.InsertMany([]uint64{3, 1, 2}, nil)
+	tr.InsertMany([]uint64{2, 0}, nil)
+	if tr.Count() != 5 {
+		t.Fatalf("expected %v, got %v", 5, tr.Count())
+	}
+	tr.sane()
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic")
+		}
+	}()
+	tr.InsertMany([]uint64{1, 2}, []interface{}{1})
+}
+
+func BenchmarkInsertMany(b *testing.B) {
+	benchmarkInsertBatch(b, func(tr *Tree, cells []uint64) {
+		tr.InsertMany(cells, nil)
+	})
+}
+
+func BenchmarkInsertLoop(b *testing.B) {
+	benchmarkInsertBatch(b, func(tr *Tree, cells []uint64) {
+		for _, cell := range cells {
+			tr.Insert(cell, nil)
+		}
+	})
+}
+
+// benchmarkInsertBatch inserts a sorted batch of 10k clustered cells into a
+// tree that already has 1M cells.
+func benchmarkInsertBatch(
+	b *testing.B, insert func(tr *Tree, cells []uint64),
+) {
+	rng := rand.New(rand.NewSource(1))
+	var tr Tree
+	for i := 0; i < 1000000; i++ {
+		tr.Insert(rng.Uint64(), nil)
+	}
+	cells := make([]uint64, 10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		base := rng.Uint64()
+		for j := range cells {
+			cells[j] = base + rng.Uint64()%(1<<48)
+		}
+		sortInts(cells)
+		b.StartTimer()
+		insert(&tr, cells)
+	}
+}
+
+func TestDeleteMany(t *testing.T) {
+	var tr Tree
+	if tr.DeleteMany([]uint64{1}, nil) != 0 {
+		t.Fatal("expected zero")
+	}
+	for _, opts := range []Options{{}, {MaxItems: 8, FanoutBits: 3}} {
+		for i := 0; i < 20; i++ {
+			tr1, tr2 := NewTree(opts), NewTree(opts)
+			N := rand.Int() % 20000
+			var cells []uint64
+			var data []interface{}
+			for j := 0; j < N; j++ {
+				cell := rand.Uint64()
+				if i%2 == 0 {
+					// clustered
+					cell = cell/1024 + math.MaxUint64/2
+				}
+				if j > 0 && j%10 == 0 {
+					// duplicate cell
+					cell = cells[j-1]
+				}
+				cells = append(cells, cell)
+				data = append(data, j%3)
+				tr1.Insert(cell, j%3)
+				tr2.Insert(cell, j%3)
+			}
+			// delete a random subset along with some misses
+			var dcells []uint64
+			var ddata []interface{}
+			for j := 0; j < N; j++ {
+				switch rand.Int() % 4 {
+				case 0:
+					dcells = append(dcells, cells[j])
+					ddata = append(ddata, data[j])
+				case 1:
+					dcells = append(dcells, cells[j])
+					ddata = append(ddata, -1)
+				}
+			}
+			var expect int
+			for j := range dcells {
+				count := tr1.Count()
+				tr1.Delete(dcells[j], ddata[j])
+				expect += count - tr1.Count()
+			}
+			if n := tr2.DeleteMany(dcells, ddata); n != expect {
+				t.Fatalf("expected %v, got %v", expect, n)
+			}
+			tr2.sane()
+			if !tr1.Equal(tr2, nil) {
+				t.Fatal("trees not equal")
+			}
+		}
+	}
+	// nil data
+	tr = Tree{}
+	for i := 0; i < 1000; i++ {
+		tr.Insert(uint64(i%10), nil)
+	}
+	if n := tr.DeleteMany([]uint64{5, 5, 3, 11}, nil); n != 3 {
+		t.Fatalf("expected %v, got %v", 3, n)
+	}
+	tr.sane()
+	if tr.Count() != 997 {
+		t.Fatalf("expected %v, got %v", 997, tr.Count())
+	}
+	// nil data in a unique tree matches any data, just like Delete
+	tr1 := New(WithUniqueCells(), WithMaxItems(8))
+	tr2 := New(WithUniqueCells(), WithMaxItems(8))
+	var cells []uint64
+	for i := 0; i < 100; i++ {
+		tr1.Insert(uint64(i), i)
+		tr2.Insert(uint64(i), i)
+		if i < 50 {
+			cells = append(cells, uint64(i))
+		}
+	}
+	var expect int
+	for _, cell := range cells {
+		if tr1.Delete(cell, nil) {
+			expect++
+		}
+	}
+	if expect != 50 {
+		t.Fatalf("expected %v, got %v", 50, expect)
+	}
+	if n := tr2.DeleteMany(cells, nil); n != expect {
+		t.Fatalf("expected %v, got %v", expect, n)
+	}
+	tr2.sane()
+	if !tr1.Equal(tr2, nil) {
+		t.Fatal("trees not equal")
+	}
+}
+
+func TestFilter(t *testing.T) {
+	var tr Tree
+	if ftr := tr.Filter(nil); ftr.Count() != 0 {
+		t.Fatal("expected empty")
+	}
+	N := 50000
+	ints := random(N, false)
+	for i := 0; i < N; i++ {
+		tr.Insert(ints[i], i)
+		if i%10 == 0 {
+			// duplicate cell
+			tr.Insert(ints[i], -i)
+		}
+	}
+	keep := func(cell uint64, data interface{}) bool {
+		return data.(int)%3 != 0
+	}
+	var expect []Item
+	tr.Scan(func(cell uint64, data interface{}) bool {
+		if keep(cell, data) {
+			expect = append(expect, Item{cell, data})
+		}
+		return true
+	})
+	ftr := tr.Filter(keep)
+	ftr.sane()
+	if ftr.Count() != len(expect) {
+		t.Fatalf("expected %v, got %v", len(expect), ftr.Count())
+	}
+	var i int
+	ftr.Scan(func(cell uint64, data interface{}) bool {
+		if expect[i] != (Item{cell, data}) {
+			t.Fatalf("expected %v, got %v", expect[i], Item{cell, data})
+		}
+		i++
+		return true
+	})
+	// options are preserved
+	tr2 := New(WithFanoutBits(3), WithMaxItems(8))
+	for i := 0; i < 1000; i++ {
+		tr2.Insert(rand.Uint64(), i)
+	}
+	ftr = tr2.Filter(keep)
+	ftr.sane()
+	if ftr.numBits != 3 || ftr.maxItems != 8 {
+		t.Fatal("options not preserved")
+	}
+	// the original tree is unchanged
+	if tr.Count() != N+N/10 {
+		t.Fatalf("expected %v, got %v", N+N/10, tr.Count())
+	}
+}
+
+func TestCopyRange(t *testing.T) {
+	var tr Tree
+	if tr.CopyRange(0, math.MaxUint64).Count() != 0 {
+		t.Fatal("expected empty")
+	}
+	for i := 0; i < 50; i++ {
+		tr := New(WithMaxItems(rand.Int()%64 + 8))
+		N := rand.Int() % 20000
+		for j := 0; j < N; j++ {
+			// clustered cells with some duplicates
+			cell := rand.Uint64() >> (rand.Uint64() % 64)
+			tr.Insert(cell, j)
+			if j%10 == 0 {
+				tr.Insert(cell, -j)
+			}
+		}
+		start, end := rand.Uint64()>>(rand.Uint64()%64), rand.Uint64()
+		if start > end {
+			start, end = end, start
+		}
+		if i%10 == 0 {
+			start, end = 0, math.MaxUint64
+		}
+		before, _ := FromSortedSlice(tr.ToSlice())
+		ctr := tr.CopyRange(start, end)
+		ctr.sane()
+		if !tr.Equal(before, nil) {
+			t.Fatal("tree was modified")
+		}
+		if ctr.maxItems != tr.maxItems {
+			t.Fatal("expected the same options")
+		}
+		expect := tr.RangeSlice(start, end, 0)
+		if len(expect) != ctr.Count() {
+			t.Fatalf("expected %v, got %v", len(expect), ctr.Count())
+		}
+		var j int
+		ctr.Scan(func(cell uint64, data interface{}) bool {
+			if expect[j] != (Item{cell, data}) {
+				t.Fatalf("expected %v, got %v", expect[j], Item{cell, data})
+			}
+			j++
+			return true
+		})
+	}
+}
+
+func TestMoveRange(t *testing.T) {
+	var tr Tree
+	dst := New()
+	tr.MoveRange(dst, 0, math.MaxUint64)
+	if dst.Count() != 0 {
+		t.Fatal("expected empty")
+	}
+	for i := 0; i < 50; i++ {
+		tr := New(WithMaxItems(rand.Int()%64 + 8))
+		dst := New(WithFanoutBits(uint(rand.Int()%8 + 1)))
+		if i%3 != 0 {
+			// the same options, which moves whole nodes
+			dst = tr.emptyCopy()
+		}
+		N := rand.Int() % 20000
+		for j := 0; j < N; j++ {
+			// clustered cells with some duplicates
+			cell := rand.Uint64() >> (rand.Uint64() % 64)
+			tr.Insert(cell, j)
+			if j%10 == 0 {
+				tr.Insert(cell, -j)
+			}
+			if i%2 == 0 {
+				dst.Insert(rand.Uint64()>>(rand.Uint64()%64), -j)
+			}
+		}
+		start, end := rand.Uint64()>>(rand.Uint64()%64), rand.Uint64()
+		if start > end {
+			start, end = end, start
+		}
+		if i%10 == 0 {
+			start, end = 0, math.MaxUint64
+		}
+		moved := tr.RangeSlice(start, end, 0)
+		srcCount, dstCount := tr.Count(), dst.Count()
+		// the expected dst
+		expect := New()
+		dst.Scan(func(cell uint64, data interface{}) bool {
+			expect.Insert(cell, data)
+			return true
+		})
+		for _, it := range moved {
+			expect.Insert(it.Cell, it.Data)
+		}
+		if n := tr.MoveRange(dst, start, end); n != len(moved) {
+			t.Fatalf("expected %v, got %v", len(moved), n)
+		}
+		if err := tr.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		if err := dst.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		if tr.Count() != srcCount-len(moved) {
+			t.Fatalf("expected %v, got %v", srcCount-len(moved), tr.Count())
+		}
+		if dst.Count() != dstCount+len(moved) {
+			t.Fatalf("expected %v, got %v", dstCount+len(moved), dst.Count())
+		}
+		if tr.RangeDeleteCount(start, end, nil) != 0 {
+			t.Fatal("expected the range to be empty")
+		}
+		// compare the cells, the order of duplicate data may differ
+		var cells []uint64
+		dst.Scan(func(cell uint64, data interface{}) bool {
+			cells = append(cells, cell)
+			return true
+		})
+		var j int
+		expect.Scan(func(cell uint64, data interface{}) bool {
+			if cells[j] != cell {
+				t.Fatalf("expected %v, got %v", cell, cells[j])
+			}
+			j++
+			return true
+		})
+	}
+}
+
+func TestMoveRangePartition(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		opts := []Option{WithMaxItems(rand.Int()%64 + 8),
+			WithFanoutBits(uint(rand.Int()%8 + 1))}
+		if i%2 == 0 {
+			opts = append(opts, WithNodePool())
+		}
+		tr := New(opts...)
+		N := rand.Int() % 50000
+		for j := 0; j < N; j++ {
+			// clustered cells with some duplicates
+			cell := rand.Uint64() >> (rand.Uint64() % 64)
+			tr.Insert(cell, j)
+			if j%10 == 0 {
+				for k := 0; k < rand.Int()%20; k++ {
+					tr.Insert(cell, -k)
+				}
+			}
+		}
+		all := tr.ToSlice()
+		// partition the tree into 8 trees by the high 3 bits of the cells
+		var parts []*Tree
+		var moved int
+		for j := uint64(0); j < 8; j++ {
+			part := tr.emptyCopy()
+			moved += tr.MoveRange(part, j<<61, j<<61|(1<<61-1))
+			part.sane()
+			tr.sane()
+			parts = append(parts, part)
+		}
+		if moved != len(all) || tr.Count() != 0 {
+			t.Fatalf("expected %v/%v, got %v/%v", len(all), 0, moved,
+				tr.Count())
+		}
+		var j int
+		for _, part := range parts {
+			part.Scan(func(cell uint64, data interface{}) bool {
+				if all[j] != (Item{cell, data}) {
+					t.Fatalf("expected %v, got %v", all[j], Item{cell, data})
+				}
+				j++
+				return true
+			})
+		}
+		if j != len(all) {
+			t.Fatalf("expected %v, got %v", len(all), j)
+		}
+	}
+	// the leaves are moved as-is, without copying their items
+	var tr Tree
+	for i := 0; i < 100000; i++ {
+		tr.Insert(rand.Uint64(), i)
+	}
+	first := tr.root.first()
+	var dst Tree
+	tr.MoveRange(&dst, 0, math.MaxUint64)
+	dst.sane()
+	if dst.root.first() != first {
+		t.Fatal("expected the same leaf items")
+	}
+}
+
+func TestSplit(t *testing.T) {
+	var tr Tree
+	left, right := tr.Split(100)
+	if left.Count() != 0 || right.Count() != 0 {
+		t.Fatal("expected empty")
+	}
+	tr2 := New(WithMaxItems(8), WithFanoutBits(3))
+	N := 10000
+	for i := 0; i < N; i++ {
+		tr2.Insert(uint64(i)*1000, i)
+	}
+	for _, pivot := range []uint64{0, 5000 * 1000, 5000*1000 + 1,
+		math.MaxUint64} {
+		expect, _ := FromSortedSlice(tr2.ToSlice())
+		left, right := tr2.Split(pivot)
+		if tr2.Count() != 0 {
+			t.Fatalf("expected empty, got %v", tr2.Count())
+		}
+		tr2.sane()
+		left.sane()
+		right.sane()
+		if left.maxItems != 8 || right.numBits != 3 {
+			t.Fatal("expected the same options")
+		}
+		if max, ok := left.Max(); ok && max >= pivot {
+			t.Fatalf("cell %v is not less than pivot %v", max, pivot)
+		}
+		if min, ok := right.Min(); ok && min < pivot {
+			t.Fatalf("cell %v is less than pivot %v", min, pivot)
+		}
+		// join the trees back together
+		right.Scan(func(cell uint64, data interface{}) bool {
+			left.Insert(cell, data)
+			return true
+		})
+		if !left.Equal(expect, nil) {
+			t.Fatal("expected all items")
+		}
+		tr2 = left
+	}
+}
+
+func TestSplitAt(t *testing.T) {
+	var tr Tree
+	if rtr := tr.SplitAt(100); rtr.Count() != 0 || tr.Count() != 0 {
+		t.Fatal("expected empty")
+	}
+	for _, opts := range []Options{{}, {MaxItems: 8, FanoutBits: 3}} {
+		for i := 0; i < 50; i++ {
+			tr := NewTree(opts)
+			var all []Item
+			N := rand.Int() % 20000
+			for j := 0; j < N; j++ {
+				cell := rand.Uint64()
+				if i%2 == 0 {
+					// clustered
+					cell = cell/1024 + math.MaxUint64/2
+				}
+				if j%10 == 0 && len(all) > 0 {
+					// duplicate cell
+					cell = all[len(all)-1].Cell
+				}
+				all = append(all, Item{cell, j})
+				tr.Insert(cell, j)
+			}
+			tr.Scan(func(cell uint64, data interface{}) bool {
+				all[0] = Item{cell, data}
+				all = append(all[1:], all[0])
+				return true
+			})
+			var pivot uint64
+			switch {
+			case i%10 == 0:
+				pivot = 0
+			case i%10 == 1:
+				pivot = math.MaxUint64
+			case len(all) > 0 && i%2 == 0:
+				pivot = all[rand.Int()%len(all)].Cell
+			default:
+				pivot = rand.Uint64()
+			}
+			rtr := tr.SplitAt(pivot)
+			tr.sane()
+			rtr.sane()
+			if tr.Count()+rtr.Count() != len(all) {
+				t.Fatalf("expected %v, got %v", len(all),
+					tr.Count()+rtr.Count())
+			}
+			var j int
+			check := func(cell uint64, data interface{}) bool {
+				if all[j] != (Item{cell, data}) {
+					t.Fatalf("expected %v, got %v", all[j], Item{cell, data})
+				}
+				j++
+				return true
+			}
+			tr.Scan(func(cell uint64, data interface{}) bool {
+				if cell >= pivot {
+					t.Fatalf("cell %v is not less than pivot %v", cell, pivot)
+				}
+				return check(cell, data)
+			})
+			rtr.Scan(func(cell uint64, data interface{}) bool {
+				if cell < pivot {
+					t.Fatalf("cell %v is less than pivot %v", cell, pivot)
+				}
+				return check(cell, data)
+			})
+			// both trees are still usable
+			for _, tr := range []*Tree{tr, rtr} {
+				for j := 0; j < 1000; j++ {
+					tr.Insert(pivot^uint64(j), nil)
+				}
+				tr.sane()
+				tr.RangeDelete(0, math.MaxUint64, nil)
+				tr.sane()
+			}
+		}
+	}
+}
+
+func TestFromSortedSlice(t *testing.T) {
+	for _, N := range []int{0, 1, 100, 100000} {
+		items := make([]Item, N)
+		for i := range items {
+			items[i] = Item{rand.Uint64(), i}
+			if i > 0 && i%10 == 0 {
+				// duplicate cell
+				items[i].Cell = items[i-1].Cell
+			}
+		}
+		sort.SliceStable(items, func(i, j int) bool {
+			return items[i].Cell < items[j].Cell
+		})
+		tr, err := FromSortedSlice(items)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr.sane()
+		all := tr.ToSlice()
+		if len(all) != N {
+			t.Fatalf("expected %v, got %v", N, len(all))
+		}
+		for i := range all {
+			if all[i] != items[i] {
+				t.Fatalf("expected %v, got %v", items[i], all[i])
+			}
+		}
+		// the tree can be modified afterwards
+		tr.Insert(rand.Uint64(), nil)
+		tr.sane()
+		if N > 1 {
+			items[0], items[N-1] = items[N-1], items[0]
+			if _, err := FromSortedSlice(items); err == nil {
+				t.Fatal("expected an error")
+			}
+		}
+	}
+}
+
+func TestInsertItems(t *testing.T) {
+	for _, sorted := range []bool{true, false} {
+		for _, N := range []int{0, 1, 100, 100000} {
+			items := make([]Item, N)
+			for i := range items {
+				items[i].Cell = rand.Uint64()
+				if i > 0 && i%10 == 0 {
+					// duplicate cell
+					items[i].Cell = items[i-1].Cell
+				}
+				items[i].Data = i
+			}
+			if sorted {
+				sort.SliceStable(items, func(i, j int) bool {
+					return items[i].Cell < items[j].Cell
+				})
+			}
+			var tr1 Tree
+			tr1.InsertItems(items)
+			tr1.sane()
+			var tr2 Tree
+			for _, item := range items {
+				tr2.Insert(item.Cell, item.Data)
+			}
+			if !tr1.Equal(&tr2, nil) {
+				t.Fatal("not equal")
+			}
+			// insert into a non-empty tree
+			tr1.InsertItems(items)
+			tr1.sane()
+			for _, item := range items {
+				tr2.Insert(item.Cell, item.Data)
+			}
+			if !tr1.Equal(&tr2, nil) {
+				t.Fatal("not equal")
+			}
+		}
+	}
+}
+
+func TestCompact(t *testing.T) {
+	var tr Tree
+	tr.Compact()
+	N := 100000
+	ints := random(N, false)
+	for i := 0; i < N; i++ {
+		tr.Insert(ints[i], nil)
+	}
+	sortInts(ints)
+	var expect []uint64
+	for i := 0; i < N; i++ {
+		if i%8 != 0 {
+			tr.Delete(ints[i], nil)
+		} else {
+			expect = append(expect, ints[i])
+		}
+	}
+	size := tr.MemoryUsage()
+	tr.Compact()
+	tr.sane()
+	if tr.Count() != len(expect) {
+		t.Fatalf("expected %v, got %v", len(expect), tr.Count())
+	}
+	if tr.MemoryUsage() >= size {
+		t.Fatalf("expected less than %v, got %v", size, tr.MemoryUsage())
+	}
+	var cells []uint64
+	tr.Scan(func(cell uint64, data interface{}) bool {
+		cells = append(cells, cell)
+		return true
+	})
+	if !cellsEqual(cells, expect) {
+		t.Fatal("not equal")
+	}
+	var check func(n *node)
+	check = func(n *node) {
+		if n.branch {
+			if n.count <= tr.minItems {
+				t.Fatal("underfilled branch")
+			}
+			for i := range n.nodes {
+				check(&n.nodes[i])
+			}
+		} else if len(n.items) != cap(n.items) {
+			t.Fatal("leaf was not shrunk")
+		}
+	}
+	check(tr.root)
+
+	// a branch that is at or below the minItems is collapsed into a leaf.
+	tr = Tree{}
+	for i := 0; i < maxItems+1; i++ {
+		tr.Insert(uint64(i)<<50, nil)
+	}
+	for i := 0; i < 10; i++ {
+		tr.Delete(uint64(i)<<50, nil)
+	}
+	if !tr.root.branch {
+		t.Fatal("expected a branch")
+	}
+	tr.minItems = tr.count
+	tr.Compact()
+	tr.minItems = minItems
+	tr.sane()
+	if tr.root.branch || tr.Count() != maxItems-9 {
+		t.Fatal("expected a leaf")
+	}
+}
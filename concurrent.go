@@ -0,0 +1,249 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package celltree
+
+import "sync"
+
+// ConcurrentTree is a Tree that is safe for use by multiple goroutines.
+// Operations that read the tree take a read lock, and operations that modify
+// the tree take a write lock.
+//
+// The most common Tree methods are wrapped directly. All other methods are
+// available through View, which calls a func with the tree under a read
+// lock, and Modify, which calls a func with the tree under a write lock.
+//
+// The lock is held while the iterator and cond funcs are called, so these
+// funcs must not call back into the tree, otherwise it will deadlock.
+type ConcurrentTree struct {
+	mu sync.RWMutex
+	tr Tree
+}
+
+// NewConcurrentTree returns a new concurrent tree using the provided options.
+// A zero-value ConcurrentTree is the same as a tree returned by
+// NewConcurrentTree(Options{}).
+func NewConcurrentTree(opts Options) *ConcurrentTree {
+	return &ConcurrentTree{tr: *NewTree(opts)}
+}
+
+// View calls the fn func with the tree while holding a read lock. The fn
+// func must not modify the tree, and the tree must not be used after fn
+// returns.
+func (ct *ConcurrentTree) View(fn func(tr *Tree)) {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+	fn(&ct.tr)
+}
+
+// Modify calls the fn func with the tree while holding a write lock. The
+// tree must not be used after fn returns.
+func (ct *ConcurrentTree) Modify(fn func(tr *Tree)) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	fn(&ct.tr)
+}
+
+// Count returns the number of items in the tree.
+func (ct *ConcurrentTree) Count() int {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+	return ct.tr.Count()
+}
+
+// InsertOrReplace inserts an item into the tree. See Tree.InsertOrReplace.
+func (ct *ConcurrentTree) InsertOrReplace(
+	cell uint64, data interface{},
+	cond func(data interface{}) (newData interface{}, replace bool),
+) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.tr.InsertOrReplace(cell, data, cond)
+}
+
+// Insert inserts an item into the tree. See Tree.Insert.
+func (ct *ConcurrentTree) Insert(cell uint64, data interface{}) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.tr.Insert(cell, data)
+}
+
+// InsertIfAbsent inserts an item into the tree only when there are no items
+// with the same cell. See Tree.InsertIfAbsent.
+func (ct *ConcurrentTree) InsertIfAbsent(cell uint64, data interface{}) bool {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	return ct.tr.InsertIfAbsent(cell, data)
+}
+
+// GetOrInsert returns the data for a cell, inserting it when it does not
+// exist. See Tree.GetOrInsert.
+func (ct *ConcurrentTree) GetOrInsert(
+	cell uint64, create func() interface{},
+) (data interface{}, loaded bool) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	return ct.tr.GetOrInsert(cell, create)
+}
+
+// Replace sets the data for the first item that has the provided cell.
+// See Tree.Replace.
+func (ct *ConcurrentTree) Replace(cell uint64, data interface{}) bool {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	return ct.tr.Replace(cell, data)
+}
+
+// Update changes the data for the first item that has the provided cell.
+// See Tree.Update.
+func (ct *ConcurrentTree) Update(
+	cell uint64, fn func(data interface{}) (newData interface{}, ok bool),
+) bool {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	return ct.tr.Update(cell, fn)
+}
+
+// Delete removes an item from the tree. See Tree.Delete.
+func (ct *ConcurrentTree) Delete(cell uint64, data interface{}) bool {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	return ct.tr.Delete(cell, data)
+}
+
+// DeleteWhen removes an item from the tree. See Tree.DeleteWhen.
+func (ct *ConcurrentTree) DeleteWhen(
+	cell uint64, cond func(data interface{}) bool,
+) (data interface{}, deleted bool) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	return ct.tr.DeleteWhen(cell, cond)
+}
+
+// DeleteAll removes all items for a cell. See Tree.DeleteAll.
+func (ct *ConcurrentTree) DeleteAll(cell uint64) int {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	return ct.tr.DeleteAll(cell)
+}
+
+// RangeDelete iterates over the tree and deletes items. See Tree.RangeDelete.
+func (ct *ConcurrentTree) RangeDelete(
+	start, end uint64,
+	iter func(cell uint64, data interface{}) (shouldDelete bool, ok bool),
+) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.tr.RangeDelete(start, end, iter)
+}
+
+// Scan iterates over the entire tree. See Tree.Scan.
+func (ct *ConcurrentTree) Scan(iter func(cell uint64, data interface{}) bool) {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+	ct.tr.Scan(iter)
+}
+
+// ScanDescending iterates over the entire tree in descending order.
+// See Tree.ScanDescending.
+func (ct *ConcurrentTree) ScanDescending(
+	iter func(cell uint64, data interface{}) bool,
+) {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+	ct.tr.ScanDescending(iter)
+}
+
+// Range iterates over the tree starting with the start param.
+// See Tree.Range.
+func (ct *ConcurrentTree) Range(
+	start uint64, iter func(cell uint64, data interface{}) bool,
+) {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+	ct.tr.Range(start, iter)
+}
+
+// RangeBetween iterates over the items in the inclusive [start,end] range.
+// See Tree.RangeBetween.
+func (ct *ConcurrentTree) RangeBetween(
+	start, end uint64, iter func(cell uint64, data interface{}) bool,
+) {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+	ct.tr.RangeBetween(start, end, iter)
+}
+
+// RangeCount iterates over the items in the inclusive [start,end] range,
+// along with the number of items that follow. See Tree.RangeCount.
+func (ct *ConcurrentTree) RangeCount(
+	start, end uint64,
+	iter func(cell uint64, data interface{}, remaining int) bool,
+) {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+	ct.tr.RangeCount(start, end, iter)
+}
+
+// ScanErr iterates over the entire tree, stopping on the first error.
+// See Tree.ScanErr.
+func (ct *ConcurrentTree) ScanErr(
+	iter func(cell uint64, data interface{}) error,
+) error {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+	return ct.tr.ScanErr(iter)
+}
+
+// RangeErr iterates over the tree starting with the pivot param, stopping on
+// the first error. See Tree.RangeErr.
+func (ct *ConcurrentTree) RangeErr(
+	pivot uint64, iter func(cell uint64, data interface{}) error,
+) error {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+	return ct.tr.RangeErr(pivot, iter)
+}
+
+// PrefixScan iterates over all items sharing a prefix. See Tree.PrefixScan.
+func (ct *ConcurrentTree) PrefixScan(
+	prefix uint64, prefixBits uint,
+	iter func(cell uint64, data interface{}) bool,
+) {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+	ct.tr.PrefixScan(prefix, prefixBits, iter)
+}
+
+// ScanPrefix iterates over all items sharing a prefix. See Tree.ScanPrefix.
+func (ct *ConcurrentTree) ScanPrefix(
+	prefix uint64, prefixBits uint,
+	iter func(cell uint64, data interface{}) bool,
+) {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+	ct.tr.ScanPrefix(prefix, prefixBits, iter)
+}
+
+// CountPrefix returns the number of items sharing a prefix.
+// See Tree.CountPrefix.
+func (ct *ConcurrentTree) CountPrefix(prefix uint64, prefixBits uint) int {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+	return ct.tr.CountPrefix(prefix, prefixBits)
+}
+
+// Min returns the smallest cell in the tree. See Tree.Min.
+func (ct *ConcurrentTree) Min() (cell uint64, ok bool) {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+	return ct.tr.Min()
+}
+
+// Max returns the largest cell in the tree. See Tree.Max.
+func (ct *ConcurrentTree) Max() (cell uint64, ok bool) {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+	return ct.tr.Max()
+}
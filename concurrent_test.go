@@ -0,0 +1,162 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package celltree
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentTree(t *testing.T) {
+	N := 10000
+	W := 4
+	ints := random(N*W, rand.Int()%2 == 0)
+	ct := NewConcurrentTree(Options{MaxItems: 32})
+	var wg sync.WaitGroup
+	for w := 0; w < W; w++ {
+		wg.Add(2)
+		go func(ints []uint64) {
+			defer wg.Done()
+			for i := 0; i < len(ints); i++ {
+				ct.Insert(ints[i], i)
+			}
+		}(ints[w*N : (w+1)*N])
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				var last uint64
+				ct.Scan(func(cell uint64, data interface{}) bool {
+					if cell < last {
+						t.Error("out of order")
+						return false
+					}
+					last = cell
+					return true
+				})
+				last = 0
+				err := ct.ScanErr(func(cell uint64, data interface{}) error {
+					if cell < last {
+						return errors.New("out of order")
+					}
+					last = cell
+					return nil
+				})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				var count int
+				err = ct.RangeErr(ints[0], func(cell uint64,
+					data interface{}) error {
+					count++
+					if count == 10 {
+						return Stop
+					}
+					return nil
+				})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				ct.Count()
+				ct.Min()
+				ct.Max()
+			}
+		}()
+	}
+	wg.Wait()
+	if ct.Count() != N*W {
+		t.Fatalf("expected %v, got %v", N*W, ct.Count())
+	}
+	ct.tr.sane()
+	for w := 0; w < W; w++ {
+		wg.Add(1)
+		go func(ints []uint64) {
+			defer wg.Done()
+			for i := 0; i < len(ints); i++ {
+				if !ct.Delete(ints[i], i) {
+					t.Errorf("expected %v to be deleted", ints[i])
+					return
+				}
+			}
+		}(ints[w*N : (w+1)*N])
+	}
+	wg.Wait()
+	if ct.Count() != 0 {
+		t.Fatalf("expected %v, got %v", 0, ct.Count())
+	}
+	ct.tr.sane()
+}
+
+func TestConcurrentTreeAccess(t *testing.T) {
+	ct := NewConcurrentTree(Options{MaxItems: 32, UniqueCells: true})
+	W := 4
+	var wg sync.WaitGroup
+	for w := 0; w < W; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				data, _ := ct.GetOrInsert(uint64(i), func() interface{} {
+					return w
+				})
+				// every goroutine sees the data of the first insert
+				var found interface{}
+				ct.RangeBetween(uint64(i), uint64(i),
+					func(cell uint64, data interface{}) bool {
+						found = data
+						return false
+					},
+				)
+				if found != data {
+					t.Errorf("expected %v, got %v", data, found)
+					return
+				}
+				ct.View(func(tr *Tree) {
+					if tr.Count() <= i {
+						t.Errorf("expected more than %v, got %v", i,
+							tr.Count())
+					}
+				})
+			}
+		}(w)
+	}
+	wg.Wait()
+	if ct.Count() != 1000 {
+		t.Fatalf("expected %v, got %v", 1000, ct.Count())
+	}
+	if ct.InsertIfAbsent(10, -1) || !ct.Replace(10, -1) {
+		t.Fatal("expected an existing cell")
+	}
+	if !ct.Update(10, func(data interface{}) (interface{}, bool) {
+		return data.(int) - 1, true
+	}) {
+		t.Fatal("expected an existing cell")
+	}
+	ct.Modify(func(tr *Tree) {
+		tr.TruncateAfter(499)
+	})
+	var count, last int
+	ct.RangeCount(0, 999,
+		func(cell uint64, data interface{}, remaining int) bool {
+			count++
+			last = remaining
+			if cell == 10 && data != -2 {
+				t.Fatalf("expected %v, got %v", -2, data)
+			}
+			return true
+		},
+	)
+	if count != 500 || last != 0 {
+		t.Fatalf("expected %v/%v, got %v/%v", 500, 0, count, last)
+	}
+	ct.View(func(tr *Tree) {
+		if err := tr.Validate(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
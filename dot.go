@@ -0,0 +1,89 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package celltree
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// WriteDOT writes a Graphviz DOT description of the tree structure to w.
+// Branches are labeled with their count and the range of their non-empty
+// child indexes, and leaves are labeled with their count and the min and max
+// cells. The maxNodes param limits the number of tree nodes that are written,
+// in breadth-first order. Child nodes that do not fit are summarized by a
+// single elided node for each branch. A maxNodes of zero or less writes all
+// nodes.
+func (tr *Tree) WriteDOT(w io.Writer, maxNodes int) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "digraph celltree {\n")
+	fmt.Fprintf(bw, "  node [shape=box, fontname=monospace];\n")
+	if tr.root != nil {
+		type entry struct {
+			n  *node
+			id int
+		}
+		var ids int
+		writeNode := func(n *node) int {
+			id := ids
+			ids++
+			if n.branch {
+				first, last, children := -1, -1, 0
+				for i := 0; i < len(n.nodes); i++ {
+					if n.nodes[i].count > 0 {
+						if first == -1 {
+							first = int(n.nodes[i].index)
+						}
+						last = int(n.nodes[i].index)
+						children++
+					}
+				}
+				fmt.Fprintf(bw, "  n%d [label=\"branch\\ncount=%d\\n"+
+					"children=%d [%d-%d]\"];\n",
+					id, n.count, children, first, last)
+			} else if len(n.items) == 0 {
+				fmt.Fprintf(bw, "  n%d [label=\"leaf\\ncount=0\"];\n", id)
+			} else {
+				fmt.Fprintf(bw, "  n%d [label=\"leaf\\ncount=%d\\n"+
+					"min=%016x\\nmax=%016x\"];\n",
+					id, len(n.items), n.items[0].cell,
+					n.items[len(n.items)-1].cell)
+			}
+			return id
+		}
+		queue := []entry{{tr.root, writeNode(tr.root)}}
+		for len(queue) > 0 {
+			e := queue[0]
+			queue = queue[1:]
+			if !e.n.branch {
+				continue
+			}
+			var elided, elidedCount int
+			for i := 0; i < len(e.n.nodes); i++ {
+				child := &e.n.nodes[i]
+				if child.count == 0 {
+					continue
+				}
+				if maxNodes > 0 && ids >= maxNodes {
+					elided++
+					elidedCount += child.count
+					continue
+				}
+				id := writeNode(child)
+				fmt.Fprintf(bw, "  n%d -> n%d [label=\"%d\"];\n", e.id, id,
+					child.index)
+				queue = append(queue, entry{child, id})
+			}
+			if elided > 0 {
+				fmt.Fprintf(bw, "  e%d [label=\"%d nodes elided\\ncount=%d\", "+
+					"style=dashed];\n", e.id, elided, elidedCount)
+				fmt.Fprintf(bw, "  n%d -> e%d [style=dashed];\n", e.id, e.id)
+			}
+		}
+	}
+	fmt.Fprintf(bw, "}\n")
+	return bw.Flush()
+}
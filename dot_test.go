@@ -0,0 +1,91 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package celltree
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func testDOT(t *testing.T, tr *Tree, maxNodes int, expect string) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := tr.WriteDOT(&buf, maxNodes); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != expect {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expect, buf.String())
+	}
+}
+
+type errWriter struct{}
+
+func (errWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("write error")
+}
+
+func TestWriteDOT(t *testing.T) {
+	tr := NewTree(Options{MaxItems: 2, FanoutBits: 2})
+	testDOT(t, tr, 0, ""+
+		"digraph celltree {\n"+
+		"  node [shape=box, fontname=monospace];\n"+
+		"}\n")
+	tr.Insert(0x1000000000000000, nil)
+	tr.Insert(0x2000000000000000, nil)
+	testDOT(t, tr, 0, ""+
+		"digraph celltree {\n"+
+		"  node [shape=box, fontname=monospace];\n"+
+		"  n0 [label=\"leaf\\ncount=2\\nmin=1000000000000000\\n"+
+		"max=2000000000000000\"];\n"+
+		"}\n")
+	tr.Insert(0x4000000000000000, nil)
+	tr.Insert(0xC000000000000000, nil)
+	tr.Insert(0xD000000000000000, nil)
+	expect := "" +
+		"digraph celltree {\n" +
+		"  node [shape=box, fontname=monospace];\n" +
+		"  n0 [label=\"branch\\ncount=5\\nchildren=3 [0-3]\"];\n" +
+		"  n1 [label=\"leaf\\ncount=2\\nmin=1000000000000000\\n" +
+		"max=2000000000000000\"];\n" +
+		"  n0 -> n1 [label=\"0\"];\n" +
+		"  n2 [label=\"leaf\\ncount=1\\nmin=4000000000000000\\n" +
+		"max=4000000000000000\"];\n" +
+		"  n0 -> n2 [label=\"1\"];\n" +
+		"  n3 [label=\"leaf\\ncount=2\\nmin=c000000000000000\\n" +
+		"max=d000000000000000\"];\n" +
+		"  n0 -> n3 [label=\"3\"];\n" +
+		"}\n"
+	testDOT(t, tr, 0, expect)
+	testDOT(t, tr, 4, expect)
+	testDOT(t, tr, 2, ""+
+		"digraph celltree {\n"+
+		"  node [shape=box, fontname=monospace];\n"+
+		"  n0 [label=\"branch\\ncount=5\\nchildren=3 [0-3]\"];\n"+
+		"  n1 [label=\"leaf\\ncount=2\\nmin=1000000000000000\\n"+
+		"max=2000000000000000\"];\n"+
+		"  n0 -> n1 [label=\"0\"];\n"+
+		"  e0 [label=\"2 nodes elided\\ncount=3\", style=dashed];\n"+
+		"  n0 -> e0 [style=dashed];\n"+
+		"}\n")
+
+	// large trees are capped
+	tr = new(Tree)
+	for i := 0; i < 100000; i++ {
+		tr.Insert(uint64(i)*0x9E3779B97F4A7C15, nil)
+	}
+	var buf bytes.Buffer
+	if err := tr.WriteDOT(&buf, 50); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(buf.String(), "[label=\"branch") +
+		strings.Count(buf.String(), "[label=\"leaf"); n != 50 {
+		t.Fatalf("expected %v, got %v", 50, n)
+	}
+	if err := tr.WriteDOT(errWriter{}, 0); err == nil {
+		t.Fatal("expected an error")
+	}
+}
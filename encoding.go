@@ -0,0 +1,212 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package celltree
+
+import (
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+const binaryVersion = 1
+
+// data types
+const (
+	binaryNil    = 0
+	binaryUint64 = 1
+)
+
+var errInvalidBinary = errors.New("celltree: invalid binary data")
+
+// MarshalBinary encodes the tree into a binary form. The tree options and
+// all of the items are written in sorted order. Only nil and uint64 data
+// values are supported, other data types will return an error.
+func (tr *Tree) MarshalBinary() ([]byte, error) {
+	bits, max := tr.numBits, tr.maxItems
+	if bits == 0 {
+		// zero-value tree
+		bits, max = numBits, maxItems
+	}
+	var dst []byte
+	dst = append(dst, binaryVersion, byte(bits))
+	dst = appendUvarint(dst, uint64(max))
+	dst = appendUvarint(dst, uint64(tr.count))
+	var err error
+	var last uint64
+	tr.Scan(func(cell uint64, data interface{}) bool {
+		// cells are in order, so each cell is stored as the difference from
+		// the previous cell.
+		dst = appendUvarint(dst, cell-last)
+		last = cell
+		switch data := data.(type) {
+		case nil:
+			dst = append(dst, binaryNil)
+		case uint64:
+			dst = append(dst, binaryUint64)
+			dst = appendUvarint(dst, data)
+		default:
+			err = fmt.Errorf("celltree: unsupported data type %T", data)
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
+
+func appendUvarint(dst []byte, x uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], x)
+	return append(dst, buf[:n]...)
+}
+
+// UnmarshalBinary decodes the binary form from MarshalBinary into the tree,
+// replacing all existing items and options.
+func (tr *Tree) UnmarshalBinary(data []byte) error {
+	if len(data) < 2 || data[0] != binaryVersion || data[1] < 1 ||
+		data[1] > 8 {
+		return errInvalidBinary
+	}
+	numBits := uint(data[1])
+	data = data[2:]
+	maxItems, n := binary.Uvarint(data)
+	if n <= 0 || maxItems == 0 || maxItems > math.MaxInt32 {
+		return errInvalidBinary
+	}
+	data = data[n:]
+	count, n := binary.Uvarint(data)
+	// each item takes up at least two bytes
+	if n <= 0 || count > uint64(len(data)-n)/2 {
+		return errInvalidBinary
+	}
+	data = data[n:]
+	items := make([]item, count)
+	var cell uint64
+	for i := range items {
+		delta, n := binary.Uvarint(data)
+		if n <= 0 || len(data) == n || cell+delta < cell {
+			return errInvalidBinary
+		}
+		cell += delta
+		items[i].cell = cell
+		data = data[n:]
+		switch data[0] {
+		case binaryNil:
+			data = data[1:]
+		case binaryUint64:
+			v, n := binary.Uvarint(data[1:])
+			if n <= 0 {
+				return errInvalidBinary
+			}
+			items[i].data = v
+			data = data[1+n:]
+		default:
+			return errInvalidBinary
+		}
+	}
+	if len(data) != 0 {
+		return errInvalidBinary
+	}
+	*tr = Tree{numBits: numBits, maxItems: int(maxItems), pool: tr.pool,
+		unique: tr.unique, agg: tr.agg}
+	tr.init()
+	tr.load(items)
+	return nil
+}
+
+// gobHeader is the first value in a gob stream.
+type gobHeader struct {
+	FanoutBits uint
+	MaxItems   int
+	Count      int
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	if err == nil && n < len(p) {
+		err = io.ErrShortWrite
+	}
+	return n, err
+}
+
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// WriteTo writes the tree to w as a gob stream. The data values are encoded
+// as interface values, so the concrete data type must be registered using
+// gob.Register prior to calling WriteTo and ReadFrom.
+func (tr *Tree) WriteTo(w io.Writer) (int64, error) {
+	cw := &countWriter{w: w}
+	enc := gob.NewEncoder(cw)
+	bits, max := tr.numBits, tr.maxItems
+	if bits == 0 {
+		// zero-value tree
+		bits, max = numBits, maxItems
+	}
+	err := enc.Encode(gobHeader{FanoutBits: bits, MaxItems: max,
+		Count: tr.count})
+	if err != nil {
+		return cw.n, err
+	}
+	tr.Scan(func(cell uint64, data interface{}) bool {
+		err = enc.Encode(&Item{Cell: cell, Data: data})
+		return err == nil
+	})
+	return cw.n, err
+}
+
+// ReadFrom reads a gob stream that was written by WriteTo, replacing all
+// existing items and options in the tree. Any data types must be registered
+// using gob.Register.
+func (tr *Tree) ReadFrom(r io.Reader) (int64, error) {
+	cr := &countReader{r: r}
+	dec := gob.NewDecoder(cr)
+	var hdr gobHeader
+	if err := dec.Decode(&hdr); err != nil {
+		return cr.n, err
+	}
+	if hdr.FanoutBits < 1 || hdr.FanoutBits > 8 || hdr.MaxItems < 1 ||
+		hdr.Count < 0 {
+		return cr.n, errors.New("celltree: invalid gob header")
+	}
+	var items []item
+	for i := 0; i < hdr.Count; i++ {
+		var it Item
+		if err := dec.Decode(&it); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return cr.n, err
+		}
+		if len(items) > 0 && it.Cell < items[len(items)-1].cell {
+			return cr.n, errors.New("celltree: gob items out of order")
+		}
+		items = append(items, item{cell: it.Cell, data: it.Data})
+	}
+	*tr = Tree{numBits: hdr.FanoutBits, maxItems: hdr.MaxItems,
+		pool: tr.pool, unique: tr.unique, agg: tr.agg}
+	tr.init()
+	tr.load(items)
+	return cr.n, nil
+}
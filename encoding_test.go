@@ -0,0 +1,204 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package celltree
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func testTreesEqual(t *testing.T, tr1, tr2 *Tree) {
+	t.Helper()
+	if tr1.Count() != tr2.Count() {
+		t.Fatalf("expected %v, got %v", tr1.Count(), tr2.Count())
+	}
+	var items1, items2 []item
+	tr1.Scan(func(cell uint64, data interface{}) bool {
+		items1 = append(items1, item{cell, data})
+		return true
+	})
+	tr2.Scan(func(cell uint64, data interface{}) bool {
+		items2 = append(items2, item{cell, data})
+		return true
+	})
+	if len(items1) != len(items2) {
+		t.Fatal("not equal")
+	}
+	for i := range items1 {
+		if items1[i] != items2[i] {
+			t.Fatalf("not equal at index %d", i)
+		}
+	}
+}
+
+func TestBinary(t *testing.T) {
+	for _, opts := range []Options{{}, {MaxItems: 8, FanoutBits: 3}} {
+		for _, N := range []int{0, 1, 100, 10000} {
+			tr := NewTree(opts)
+			for i := 0; i < N; i++ {
+				cell := rand.Uint64()
+				switch i % 3 {
+				case 0:
+					tr.Insert(cell, nil)
+				case 1:
+					tr.Insert(cell, cell)
+				case 2:
+					tr.Insert(cell>>32, uint64(i))
+					tr.Insert(cell>>32, uint64(i))
+				}
+			}
+			data, err := tr.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var tr2 Tree
+			tr2.Insert(1, nil)
+			if err := tr2.UnmarshalBinary(data); err != nil {
+				t.Fatal(err)
+			}
+			tr2.sane()
+			if tr2.numBits != tr.numBits || tr2.maxItems != tr.maxItems {
+				t.Fatal("options not equal")
+			}
+			testTreesEqual(t, tr, &tr2)
+
+			if N > 100 {
+				continue
+			}
+			// truncated data must fail
+			for i := 0; i < len(data); i++ {
+				if tr2.UnmarshalBinary(data[:i]) == nil {
+					t.Fatalf("expected an error at length %d", i)
+				}
+			}
+			if tr2.UnmarshalBinary(append(data, 0)) == nil {
+				t.Fatal("expected an error")
+			}
+		}
+	}
+	var tr Tree
+	data, err := tr.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	tr.sane()
+	// malformed headers must fail
+	for _, hdr := range [][2]byte{
+		{data[0] + 1, data[1]}, // unknown version
+		{data[0], 0},           // fanout below 1
+		{data[0], 9},           // fanout above 8
+	} {
+		bad := append([]byte{hdr[0], hdr[1]}, data[2:]...)
+		if tr.UnmarshalBinary(bad) == nil {
+			t.Fatalf("expected an error for header %v", hdr)
+		}
+	}
+	tr.Insert(1, "hello")
+	if _, err := tr.MarshalBinary(); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestBinaryCorrupt(t *testing.T) {
+	tr := New(WithMaxItems(8), WithFanoutBits(3))
+	for i := 0; i < 1000; i++ {
+		tr.Insert(rand.Uint64()>>(rand.Uint64()%64), uint64(i))
+	}
+	data, err := tr.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// corrupted data must either fail to decode or make a valid tree
+	corrupt := make([]byte, len(data))
+	for i := 0; i < 1000; i++ {
+		copy(corrupt, data)
+		for j := 0; j < rand.Int()%4+1; j++ {
+			corrupt[rand.Int()%len(corrupt)] = byte(rand.Int())
+		}
+		var tr2 Tree
+		if tr2.UnmarshalBinary(corrupt) != nil {
+			continue
+		}
+		if err := tr2.Validate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+type gobPoint struct {
+	X, Y float64
+	Name string
+}
+
+func init() {
+	gob.Register(gobPoint{})
+}
+
+type shortWriter struct{ n int }
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		n := w.n
+		w.n = 0
+		return n, nil
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestGob(t *testing.T) {
+	for _, N := range []int{0, 1, 10000} {
+		tr := NewTree(Options{MaxItems: 64, FanoutBits: 4})
+		for i := 0; i < N; i++ {
+			cell := rand.Uint64()
+			if i%10 == 0 {
+				tr.Insert(cell, nil)
+			} else {
+				tr.Insert(cell, gobPoint{float64(i), -float64(i),
+					fmt.Sprint(i)})
+			}
+		}
+		var buf bytes.Buffer
+		n, err := tr.WriteTo(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(buf.Len()) {
+			t.Fatalf("expected %v, got %v", buf.Len(), n)
+		}
+		data := buf.Bytes()
+		var tr2 Tree
+		tr2.Insert(1, nil)
+		n, err = tr2.ReadFrom(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(len(data)) {
+			t.Fatalf("expected %v, got %v", len(data), n)
+		}
+		tr2.sane()
+		if tr2.numBits != 4 || tr2.maxItems != 64 {
+			t.Fatal("options not equal")
+		}
+		testTreesEqual(t, tr, &tr2)
+
+		// short reads
+		_, err = tr2.ReadFrom(bytes.NewReader(data[:len(data)-1]))
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+		// short writes
+		_, err = tr.WriteTo(&shortWriter{n: len(data) - 1})
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+	}
+}
@@ -0,0 +1,432 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package celltree
+
+// gitem has the data field first, which allows for a zero-sized T, such as
+// struct{}, to not take up any extra space in the leaf items.
+type gitem[T any] struct {
+	data T
+	cell uint64
+}
+
+type gnode[T any] struct {
+	branch bool       // is a branch (not a leaf)
+	items  []gitem[T] // leaf items
+	nodes  []gnode[T] // child nodes
+	count  int        // count of all cells for this node and children
+}
+
+// TreeG is a uint64 prefix tree that stores data of type T. It behaves
+// exactly like Tree, but avoids boxing data into an interface{}.
+type TreeG[T any] struct {
+	count int       // number of items in tree
+	root  *gnode[T] // root node
+}
+
+// gequal compares two data values in the same way that Tree compares its
+// interface{} data. It panics when T is not comparable.
+func gequal[T any](a, b T) bool {
+	return any(a) == any(b)
+}
+
+// Count returns the number of items in the tree.
+func (tr *TreeG[T]) Count() int {
+	return tr.count
+}
+
+// InsertOrReplace inserts an item into the tree. Items are ordered by it's
+// cell. The cond function is used to allow for replacing an existing cell
+// with a new cell. When the 'replace' return value is set to false, then the
+// original data is inserted. When the 'replace' value is true the existing
+// cell data is replace with newData.
+func (tr *TreeG[T]) InsertOrReplace(
+	cell uint64, data T,
+	cond func(data T) (newData T, replace bool),
+) {
+	if tr.root == nil {
+		tr.root = new(gnode[T])
+	}
+	if tr.root.insert(cell, data, 64-numBits, cond) {
+		tr.count++
+	}
+}
+
+// Insert inserts an item into the tree. Items are ordered by it's cell.
+func (tr *TreeG[T]) Insert(cell uint64, data T) {
+	tr.InsertOrReplace(cell, data, nil)
+}
+
+func (n *gnode[T]) splitLeaf(bits uint) {
+	n.branch = true
+	n.count = 0
+	n.nodes = make([]gnode[T], numNodes)
+	for i := 0; i < len(n.items); i++ {
+		n.insert(n.items[i].cell, n.items[i].data, bits, nil)
+	}
+	n.items = nil
+}
+
+func (n *gnode[T]) insert(
+	cell uint64, data T, bits uint,
+	cond func(data T) (newData T, replace bool),
+) (inserted bool) {
+	if !n.branch {
+		// leaf node
+		atcap := !maxDepth(bits) && len(n.items) >= maxItems
+	insertAgain:
+		if atcap && cond == nil {
+			// split leaf. it's at capacity
+			n.splitLeaf(bits)
+			n.insert(cell, data, bits, nil)
+			n.count--
+		} else {
+			if len(n.items) == 0 || n.items[len(n.items)-1].cell < cell {
+				if atcap {
+					cond = nil
+					goto insertAgain
+				}
+				n.items = append(n.items, gitem[T]{cell: cell, data: data})
+			} else {
+				index := n.findLeafItemSeqIns(cell)
+				if cond != nil {
+					// find a duplicate cell
+					for i := index - 1; i >= 0; i-- {
+						if n.items[i].cell != cell {
+							break
+						}
+						newData, replace := cond(n.items[i].data)
+						if replace {
+							n.items[i].data = newData
+							return false
+						}
+					}
+					if atcap {
+						cond = nil
+						goto insertAgain
+					}
+				}
+				n.items = append(n.items, gitem[T]{})
+				copy(n.items[index+1:], n.items[index:len(n.items)-1])
+				n.items[index] = gitem[T]{cell: cell, data: data}
+			}
+		}
+	} else {
+		// branch node
+		index := cellIndex(cell, bits)
+		if !n.nodes[index].insert(cell, data, bits-numBits, cond) {
+			return false
+		}
+	}
+	n.count++
+	return true
+}
+
+func (n *gnode[T]) findLeafItemSeqIns(cell uint64) int {
+	for i := len(n.items) - 1; i >= 0; i-- {
+		if cell >= n.items[i].cell {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func (n *gnode[T]) findLeafItemBin(cell uint64) int {
+	i, j := 0, len(n.items)
+	for i < j {
+		h := i + (j-i)/2
+		if cell >= n.items[h].cell {
+			i = h + 1
+		} else {
+			j = h
+		}
+	}
+	return i
+}
+
+func (tr *TreeG[T]) contains(cell uint64) bool {
+	if tr.root == nil {
+		return false
+	}
+	n := tr.root
+	bits := uint(64 - numBits)
+	for n.branch {
+		n = &n.nodes[cellIndex(cell, bits)]
+		bits -= numBits
+	}
+	i := n.findLeafItemBin(cell)
+	return i > 0 && n.items[i-1].cell == cell
+}
+
+// Delete removes an item from the tree based on it's cell and data values.
+// The data is compared using ==, which panics when T is not comparable, such
+// as a slice, map, or func type. Use DeleteWhen for those types.
+func (tr *TreeG[T]) Delete(cell uint64, data T) {
+	if tr.root == nil {
+		return
+	}
+	if tr.root.nodeDelete(cell, data, 64-numBits, nil) {
+		tr.count--
+	}
+}
+
+// DeleteWhen removes an item from the tree based on it's cell and when the
+// cond func returns true. It will delete at most a maximum of one item.
+func (tr *TreeG[T]) DeleteWhen(cell uint64, cond func(data T) bool) {
+	if tr.root == nil {
+		return
+	}
+	var data T
+	if tr.root.nodeDelete(cell, data, 64-numBits, cond) {
+		tr.count--
+	}
+}
+
+func (n *gnode[T]) nodeDelete(
+	cell uint64, data T, bits uint, cond func(data T) bool,
+) (deleted bool) {
+	if !n.branch {
+		// leaf node
+		i := n.findLeafItemBin(cell) - 1
+		for ; i >= 0; i-- {
+			if n.items[i].cell != cell {
+				break
+			}
+			if (cond == nil && gequal(n.items[i].data, data)) ||
+				(cond != nil && cond(n.items[i].data)) {
+				if len(n.items) == 1 {
+					n.items = nil
+				} else {
+					min := cap(n.items) * 40 / 100
+					if len(n.items)-1 <= min {
+						items := make([]gitem[T], len(n.items)-1,
+							cap(n.items)/2)
+						copy(items[:i], n.items[:i])
+						copy(items[i:], n.items[i+1:len(n.items)])
+						n.items = items
+					} else {
+						n.items[i] = gitem[T]{}
+						copy(n.items[i:len(n.items)-1], n.items[i+1:])
+						n.items = n.items[:len(n.items)-1]
+					}
+				}
+				deleted = true
+				break
+			}
+		}
+	} else {
+		// branch node
+		index := cellIndex(cell, bits)
+		deleted = n.nodes[index].nodeDelete(cell, data, bits-numBits, cond)
+	}
+	if deleted {
+		n.count--
+		if n.branch && n.count <= minItems {
+			n.compactBranch()
+		}
+	}
+	return deleted
+}
+
+func (n *gnode[T]) flatten(items []gitem[T]) []gitem[T] {
+	if !n.branch {
+		items = append(items, n.items...)
+	} else {
+		for _, child := range n.nodes {
+			if child.count > 0 {
+				items = child.flatten(items)
+			}
+		}
+	}
+	return items
+}
+
+func (n *gnode[T]) compactBranch() {
+	n.items = n.flatten(nil)
+	n.branch = false
+	n.nodes = nil
+	n.count = len(n.items)
+}
+
+// Scan iterates over the entire tree. Return false from iter function to stop.
+func (tr *TreeG[T]) Scan(iter func(cell uint64, data T) bool) {
+	if tr.root == nil {
+		return
+	}
+	tr.root.scan(iter)
+}
+
+func (n *gnode[T]) scan(iter func(cell uint64, data T) bool) bool {
+	if !n.branch {
+		for i := 0; i < len(n.items); i++ {
+			if !iter(n.items[i].cell, n.items[i].data) {
+				return false
+			}
+		}
+	} else {
+		for i := 0; i < len(n.nodes); i++ {
+			if n.nodes[i].count > 0 {
+				if !n.nodes[i].scan(iter) {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// Range iterates over the tree starting with the start param.
+func (tr *TreeG[T]) Range(start uint64, iter func(cell uint64, data T) bool) {
+	if tr.root != nil {
+		tr.root.nodeRange(start, 64-numBits, false, iter)
+	}
+}
+
+func (n *gnode[T]) nodeRange(
+	start uint64, bits uint, hit bool, iter func(cell uint64, data T) bool,
+) (hitout bool, ok bool) {
+	if !n.branch {
+		for _, item := range n.items {
+			if item.cell < start {
+				continue
+			}
+			if !iter(item.cell, item.data) {
+				return false, false
+			}
+		}
+		return true, true
+	}
+	var index int
+	if hit {
+		index = 0
+	} else {
+		index = cellIndex(start, bits)
+	}
+	for ; index < len(n.nodes); index++ {
+		if n.nodes[index].count == 0 {
+			hit = true
+		} else {
+			hit, ok = n.nodes[index].nodeRange(start, bits-numBits, hit, iter)
+			if !ok {
+				return false, false
+			}
+		}
+	}
+	return hit, true
+}
+
+// RangeDelete iterates over the tree starting with the start param and "asks"
+// the iterator if the item should be deleted. Only items in the inclusive
+// [start,end] range are visited, and when start is greater than end nothing
+// is visited or deleted. A nil iter deletes all items in the range.
+func (tr *TreeG[T]) RangeDelete(
+	start, end uint64,
+	iter func(cell uint64, data T) (shouldDelete bool, ok bool),
+) {
+	if tr.root == nil || start > end {
+		return
+	}
+	_, deleted, _ := tr.root.nodeRangeDelete(
+		start, end, 64-numBits, 0, false, iter)
+	tr.count -= deleted
+}
+
+func (n *gnode[T]) nodeRangeDelete(
+	start, end uint64, bits uint, base uint64, hit bool,
+	iter func(cell uint64, data T) (shouldDelete bool, ok bool),
+) (hitout bool, deleted int, ok bool) {
+	if !n.branch {
+		ok = true
+		var skipIterator bool
+		if iter == nil && len(n.items) > 0 {
+			if n.items[0].cell >= start &&
+				n.items[len(n.items)-1].cell <= end {
+				deleted = len(n.items)
+				skipIterator = true
+			}
+		}
+		for i := 0; !skipIterator && i < len(n.items); i++ {
+			if n.items[i].cell < start {
+				continue
+			}
+			var shouldDelete bool
+			if ok {
+				if n.items[i].cell > end {
+					ok = false
+				} else if iter == nil {
+					shouldDelete = true
+				} else {
+					shouldDelete, ok = iter(n.items[i].cell, n.items[i].data)
+				}
+			}
+			if shouldDelete {
+				deleted++
+			} else if deleted > 0 {
+				n.items[i-deleted] = n.items[i]
+				n.items[i] = gitem[T]{}
+			} else if !ok {
+				break
+			}
+		}
+		if deleted > 0 {
+			n.items = n.items[:len(n.items)-deleted]
+			n.shrinkItems()
+		}
+		hit = true
+	} else {
+		ok = true
+		var index int
+		if !hit {
+			index = cellIndex(start, bits)
+		}
+		for ; index < len(n.nodes); index++ {
+			if n.nodes[index].count == 0 {
+				hit = true
+				continue
+			}
+			cellStart := base | uint64(index)<<bits
+			if hit && iter == nil {
+				cellEnd := cellStart | (uint64(1)<<bits - 1)
+				if cellStart >= start && cellEnd <= end {
+					// drop the node altogether
+					deleted += n.nodes[index].count
+					n.nodes[index] = gnode[T]{}
+					continue
+				}
+			}
+			var ndeleted int
+			hit, ndeleted, ok = n.nodes[index].nodeRangeDelete(
+				start, end, bits-numBits, cellStart, hit, iter)
+			deleted += ndeleted
+			if !ok {
+				break
+			}
+		}
+	}
+	if deleted > 0 {
+		n.count -= deleted
+		if n.branch && n.count <= minItems {
+			n.compactBranch()
+		}
+	}
+	return hit, deleted, ok
+}
+
+func (n *gnode[T]) shrinkItems() {
+	if len(n.items) == 0 {
+		n.items = nil
+		return
+	}
+	ncap := cap(n.items)
+	min := ncap * 40 / 100
+	if len(n.items) <= min {
+		for len(n.items) <= min {
+			ncap /= 2
+			min = ncap * 40 / 100
+		}
+		items := make([]gitem[T], len(n.items), ncap)
+		copy(items, n.items)
+		n.items = items
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package celltree
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// sane tests the sanity of the tree. Any problems will panic.
+func (tr *TreeG[T]) sane() {
+	if tr.root == nil {
+		if tr.count != 0 {
+			panic(fmt.Sprintf("sane: expected %d, got %d", 0, tr.count))
+		}
+		return
+	}
+	count, _ := tr.root.saneCount(0, 64-numBits)
+	if tr.count != count {
+		panic(fmt.Sprintf("sane: expected %d, got %d", count, tr.count))
+	}
+}
+
+func (n *gnode[T]) saneCount(cell uint64, bits uint) (int, uint64) {
+	if !n.branch {
+		if n.count != len(n.items) {
+			panic(fmt.Sprintf("leaf has a count of %d, but %d items in array",
+				n.count, len(n.items)))
+		}
+		if n.count > maxItems && !maxDepth(bits) {
+			panic(fmt.Sprintf("leaf has a count of %d, but maxItems is %d",
+				n.count, maxItems))
+		}
+		if len(n.items) == 0 && n.items != nil {
+			panic("leaf has zero items, but a non-nil items array")
+		}
+		for i := 0; i < len(n.items); i++ {
+			if n.items[i].cell < cell {
+				panic(fmt.Sprintf("leaf out of order at index: %d", i))
+			}
+			cell = n.items[i].cell
+		}
+		min := cap(n.items) * 40 / 100
+		if len(n.items) <= min && len(n.items) > 0 {
+			panic("leaf is underfilled")
+		}
+		return len(n.items), cell
+	}
+	if n.count <= 0 {
+		panic(fmt.Sprintf("branch has a count of %d", n.count))
+	}
+	if n.items != nil {
+		panic("branch has non-nil items")
+	}
+	var count int
+	for i := 0; i < len(n.nodes); i++ {
+		ncount, ncell := n.nodes[i].saneCount(cell, bits-numBits)
+		count += ncount
+		if ncell < cell {
+			panic(fmt.Sprintf("branch out of order at index: %d", i))
+		}
+		cell = ncell
+	}
+	if n.count != count {
+		panic(fmt.Sprintf("branch has wrong count, expected %d, got %d",
+			count, n.count))
+	}
+	return count, cell
+}
+
+func TestGenericRandom(t *testing.T) {
+	N := 50000
+	ints := random(N, rand.Int()%2 == 0)
+	var tr TreeG[int]
+	for i := 0; i < N; i++ {
+		tr.Insert(ints[i], i)
+	}
+	tr.sane()
+	if tr.Count() != N {
+		t.Fatalf("expected %v, got %v", N, tr.Count())
+	}
+	var all []uint64
+	tr.Scan(func(cell uint64, data int) bool {
+		if ints[data] != cell {
+			t.Fatalf("expected %v, got %v", ints[data], cell)
+		}
+		all = append(all, cell)
+		return true
+	})
+	testEquals(t, append([]uint64(nil), ints...), all)
+
+	pivot := ints[len(ints)/2]
+	var rangeCells []uint64
+	tr.Range(pivot, func(cell uint64, data int) bool {
+		rangeCells = append(rangeCells, cell)
+		return true
+	})
+	var scanCells []uint64
+	for _, cell := range all {
+		if cell >= pivot {
+			scanCells = append(scanCells, cell)
+		}
+	}
+	testEquals(t, scanCells, rangeCells)
+
+	for i := 0; i < N; i++ {
+		// deleting with the wrong data is a noop
+		tr.Delete(ints[i], -1)
+		if tr.Count() != N-i {
+			t.Fatalf("expected %v, got %v", N-i, tr.Count())
+		}
+		tr.Delete(ints[i], i)
+		if tr.Count() != N-i-1 {
+			t.Fatalf("expected %v, got %v", N-i-1, tr.Count())
+		}
+	}
+	tr.sane()
+}
+
+func TestGenericStruct(t *testing.T) {
+	type point struct{ x, y float64 }
+	var tr TreeG[point]
+	tr.Insert(10, point{1, 2})
+	tr.Insert(5, point{3, 4})
+	tr.Insert(10, point{5, 6})
+	tr.InsertOrReplace(10, point{7, 8},
+		func(data point) (point, bool) {
+			return point{9, 9}, data == point{5, 6}
+		},
+	)
+	tr.sane()
+	if tr.Count() != 3 {
+		t.Fatalf("expected %v, got %v", 3, tr.Count())
+	}
+	var pts []point
+	tr.Scan(func(cell uint64, data point) bool {
+		pts = append(pts, data)
+		return true
+	})
+	if fmt.Sprint(pts) != "[{3 4} {1 2} {9 9}]" {
+		t.Fatalf("unexpected points: %v", pts)
+	}
+	tr.DeleteWhen(10, func(data point) bool {
+		return data.x == 1
+	})
+	tr.Delete(5, point{3, 4})
+	tr.sane()
+	if tr.Count() != 1 {
+		t.Fatalf("expected %v, got %v", 1, tr.Count())
+	}
+}
+
+func TestGenericNotComparable(t *testing.T) {
+	var tr TreeG[[]byte]
+	tr.Insert(10, []byte("a"))
+	tr.Insert(10, []byte("b"))
+	// DeleteWhen works for any T
+	tr.DeleteWhen(10, func(data []byte) bool {
+		return string(data) == "a"
+	})
+	tr.sane()
+	if tr.Count() != 1 {
+		t.Fatalf("expected %v, got %v", 1, tr.Count())
+	}
+	// Delete panics because a slice is not comparable
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected a panic")
+			}
+		}()
+		tr.Delete(10, []byte("b"))
+	}()
+}
+
+func TestGenericDupCells(t *testing.T) {
+	N := 100000
+	cell := uint64(388098102398102938)
+	var tr TreeG[int]
+	for i := 0; i < N; i++ {
+		tr.Insert(cell, i)
+	}
+	tr.sane()
+	for i := N - 1; i >= 0; i-- {
+		tr.Delete(cell, i)
+	}
+	tr.sane()
+	if tr.Count() != 0 {
+		t.Fatalf("expected %v, got %v", 0, tr.Count())
+	}
+}
+
+func TestGenericRangeDelete(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		N := rand.Int() % 20000
+		var tr1 Tree
+		var tr2 TreeG[int]
+		for j := 0; j < N; j++ {
+			cell := rand.Uint64()
+			if i%2 == 0 {
+				// clustered
+				cell = cell/1024 + math.MaxUint64/2
+			}
+			tr1.Insert(cell, j)
+			tr2.Insert(cell, j)
+		}
+		start, end := rand.Uint64(), rand.Uint64()
+		if start > end {
+			start, end = end, start
+		}
+		if i%10 == 0 {
+			start, end = 0, math.MaxUint64
+		}
+		stop := rand.Int() % (N + 1)
+		if i%3 == 0 {
+			tr1.RangeDelete(start, end, nil)
+			tr2.RangeDelete(start, end, nil)
+		} else {
+			var n1, n2 int
+			tr1.RangeDelete(start, end,
+				func(cell uint64, data interface{}) (bool, bool) {
+					n1++
+					return data.(int)%2 == 0, n1 < stop
+				},
+			)
+			tr2.RangeDelete(start, end,
+				func(cell uint64, data int) (bool, bool) {
+					n2++
+					return data%2 == 0, n2 < stop
+				},
+			)
+		}
+		tr2.sane()
+		if tr1.Count() != tr2.Count() {
+			t.Fatalf("expected %v, got %v", tr1.Count(), tr2.Count())
+		}
+		var items []Item
+		tr1.Scan(func(cell uint64, data interface{}) bool {
+			items = append(items, Item{cell, data})
+			return true
+		})
+		var j int
+		tr2.Scan(func(cell uint64, data int) bool {
+			if items[j].Cell != cell || items[j].Data != data {
+				t.Fatalf("expected %v, got %v", items[j], Item{cell, data})
+			}
+			j++
+			return true
+		})
+	}
+}
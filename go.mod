@@ -1,6 +1,6 @@
 module github.com/tidwall/celltree
 
-go 1.15
+go 1.18
 
 require (
 	github.com/google/btree v1.0.0
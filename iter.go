@@ -0,0 +1,58 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.23
+
+package celltree
+
+import "iter"
+
+// All returns an iterator over all items in the tree in ascending order.
+func (tr *Tree) All() iter.Seq2[uint64, interface{}] {
+	return func(yield func(cell uint64, data interface{}) bool) {
+		tr.Scan(yield)
+	}
+}
+
+// Backward returns an iterator over all items in the tree in descending
+// order.
+func (tr *Tree) Backward() iter.Seq2[uint64, interface{}] {
+	return func(yield func(cell uint64, data interface{}) bool) {
+		tr.ScanDescending(yield)
+	}
+}
+
+// From returns an iterator over the items in the tree in ascending order,
+// starting with the pivot param.
+func (tr *Tree) From(pivot uint64) iter.Seq2[uint64, interface{}] {
+	return func(yield func(cell uint64, data interface{}) bool) {
+		tr.Range(pivot, yield)
+	}
+}
+
+// All returns an iterator over all items in the tree in ascending order. The
+// read lock is held until the iteration is done. See Tree.All.
+func (ct *ConcurrentTree) All() iter.Seq2[uint64, interface{}] {
+	return func(yield func(cell uint64, data interface{}) bool) {
+		ct.Scan(yield)
+	}
+}
+
+// Backward returns an iterator over all items in the tree in descending
+// order. The read lock is held until the iteration is done.
+// See Tree.Backward.
+func (ct *ConcurrentTree) Backward() iter.Seq2[uint64, interface{}] {
+	return func(yield func(cell uint64, data interface{}) bool) {
+		ct.ScanDescending(yield)
+	}
+}
+
+// From returns an iterator over the items in the tree in ascending order,
+// starting with the pivot param. The read lock is held until the iteration
+// is done. See Tree.From.
+func (ct *ConcurrentTree) From(pivot uint64) iter.Seq2[uint64, interface{}] {
+	return func(yield func(cell uint64, data interface{}) bool) {
+		ct.Range(pivot, yield)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.23
+
+package celltree
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestIter(t *testing.T) {
+	var tr Tree
+	for range tr.All() {
+		t.Fatal("expected no items")
+	}
+	N := 10000
+	ints := random(N, rand.Int()%2 == 0)
+	for i := 0; i < N; i++ {
+		tr.Insert(ints[i], ints[i])
+	}
+	sortInts(ints)
+
+	var cells []uint64
+	for cell, data := range tr.All() {
+		if data.(uint64) != cell {
+			t.Fatalf("expected %v, got %v", cell, data)
+		}
+		cells = append(cells, cell)
+	}
+	if !cellsEqual(cells, ints) {
+		t.Fatal("not equal")
+	}
+
+	cells = nil
+	for cell := range tr.Backward() {
+		cells = append(cells, cell)
+	}
+	for i, j := 0, len(cells)-1; i < j; i, j = i+1, j-1 {
+		cells[i], cells[j] = cells[j], cells[i]
+	}
+	if !cellsEqual(cells, ints) {
+		t.Fatal("not equal")
+	}
+
+	pivot := ints[N/2]
+	cells = nil
+	for cell := range tr.From(pivot) {
+		cells = append(cells, cell)
+	}
+	if !cellsEqual(cells, ints[N/2:]) {
+		t.Fatal("not equal")
+	}
+
+	// break early
+	var count int
+	for range tr.All() {
+		count++
+		if count == 100 {
+			break
+		}
+	}
+	if count != 100 {
+		t.Fatalf("expected %v, got %v", 100, count)
+	}
+	count = 0
+	for range tr.Backward() {
+		count++
+		if count == 100 {
+			break
+		}
+	}
+	if count != 100 {
+		t.Fatalf("expected %v, got %v", 100, count)
+	}
+	count = 0
+	for range tr.From(pivot) {
+		count++
+		if count == 100 {
+			break
+		}
+	}
+	if count != 100 {
+		t.Fatalf("expected %v, got %v", 100, count)
+	}
+}
+
+func TestConcurrentIter(t *testing.T) {
+	ct := NewConcurrentTree(Options{})
+	N := 10000
+	ints := random(N, rand.Int()%2 == 0)
+	for i := 0; i < N; i++ {
+		ct.Insert(ints[i], ints[i])
+	}
+	sortInts(ints)
+	var cells []uint64
+	for cell := range ct.All() {
+		cells = append(cells, cell)
+	}
+	if !cellsEqual(cells, ints) {
+		t.Fatal("not equal")
+	}
+	cells = nil
+	for cell := range ct.Backward() {
+		cells = append(cells, cell)
+	}
+	for i, j := 0, len(cells)-1; i < j; i, j = i+1, j-1 {
+		cells[i], cells[j] = cells[j], cells[i]
+	}
+	if !cellsEqual(cells, ints) {
+		t.Fatal("not equal")
+	}
+	cells = nil
+	for cell := range ct.From(ints[N/2]) {
+		cells = append(cells, cell)
+	}
+	if !cellsEqual(cells, ints[N/2:]) {
+		t.Fatal("not equal")
+	}
+	// the lock is released after breaking early
+	for range ct.All() {
+		break
+	}
+	ct.Insert(0, uint64(0))
+	if ct.Count() != N+1 {
+		t.Fatalf("expected %v, got %v", N+1, ct.Count())
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package celltree
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// ScanParallel iterates over the entire tree using multiple goroutines. The
+// child nodes of the root are divided among the workers, and because each
+// child node covers a different range of cells, every item is passed to iter
+// exactly once. The items are not in order and the iter function is called
+// from multiple goroutines at the same time, so it must be safe for
+// concurrent use. A workers param of zero or less uses GOMAXPROCS workers.
+//
+// The tree must not be modified until ScanParallel returns.
+func (tr *Tree) ScanParallel(
+	workers int, iter func(cell uint64, data interface{}),
+) {
+	if tr.root == nil {
+		return
+	}
+	fn := func(cell uint64, data interface{}) bool {
+		iter(cell, data)
+		return true
+	}
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers == 1 || !tr.root.branch {
+		tr.root.scan(fn)
+		return
+	}
+	if workers > len(tr.root.nodes) {
+		workers = len(tr.root.nodes)
+	}
+	// each worker takes the next unscanned child node until there are none
+	// left, which balances the work when the children are uneven.
+	var next int64 = -1
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for {
+				index := int(atomic.AddInt64(&next, 1))
+				if index >= len(tr.root.nodes) {
+					return
+				}
+				if tr.root.nodes[index].count > 0 {
+					tr.root.nodes[index].scan(fn)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,75 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package celltree
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestScanParallel(t *testing.T) {
+	var tr Tree
+	tr.ScanParallel(4, func(cell uint64, data interface{}) {
+		t.Error("expected no items")
+	})
+	N := 100000
+	ints := random(N, false)
+	for i := 0; i < N; i++ {
+		tr.Insert(ints[i], i)
+	}
+	// a few duplicates
+	for i := 1; i < N; i += 100 {
+		tr.Insert(ints[i], -i)
+	}
+	for _, workers := range []int{0, 1, 3, 8, 1000} {
+		var mu sync.Mutex
+		seen := make(map[Item]int)
+		tr.ScanParallel(workers, func(cell uint64, data interface{}) {
+			mu.Lock()
+			seen[Item{Cell: cell, Data: data}]++
+			mu.Unlock()
+		})
+		if len(seen) != tr.Count() {
+			t.Fatalf("workers %d: expected %v, got %v", workers, tr.Count(),
+				len(seen))
+		}
+		tr.Scan(func(cell uint64, data interface{}) bool {
+			if n := seen[Item{Cell: cell, Data: data}]; n != 1 {
+				t.Fatalf("workers %d: expected %v once, got %v", workers,
+					cell, n)
+			}
+			return true
+		})
+	}
+	// a tree with only a root leaf
+	tr = Tree{}
+	for i := 0; i < 10; i++ {
+		tr.Insert(uint64(i), i)
+	}
+	var mu sync.Mutex
+	var count int
+	tr.ScanParallel(4, func(cell uint64, data interface{}) {
+		mu.Lock()
+		count++
+		mu.Unlock()
+	})
+	if count != 10 {
+		t.Fatalf("expected %v, got %v", 10, count)
+	}
+}
+
+// BenchmarkScanParallel visits every item in a tree that has 1M cells using
+// GOMAXPROCS workers. Compare with BenchmarkScan.
+func BenchmarkScanParallel(b *testing.B) {
+	tr := benchmarkScanTree()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var sum uint64
+		tr.ScanParallel(0, func(cell uint64, data interface{}) {
+			atomic.AddUint64(&sum, cell)
+		})
+	}
+}
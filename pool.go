@@ -0,0 +1,125 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package celltree
+
+import "math/bits"
+
+// nodePool is a free-list of branch child node arrays and leaf item arrays.
+// The arrays are grouped by capacity, and only arrays that have a power of two
+// capacity are pooled.
+type nodePool struct {
+	nodes [9][][]node
+	items [64][][]item
+}
+
+// WithNodePool enables reusing the memory of branch nodes and leaf items that
+// are released by splits, compactions, and deletes. This cuts down on
+// allocations for trees with heavy insert/delete cycles. The pooled memory
+// is never returned to the OS, even when the tree is empty.
+func WithNodePool() Option {
+	return func(opts *Options) {
+		opts.NodePool = true
+	}
+}
+
+// allocNodes returns a child nodes array with a length of n. When the pool is
+// enabled the capacity is the next power of two.
+func (tr *Tree) allocNodes(n int) []node {
+	if tr.pool == nil {
+		return make([]node, n)
+	}
+	if n == 0 {
+		return nil
+	}
+	class := bits.Len(uint(n - 1))
+	if free := tr.pool.nodes[class]; len(free) > 0 {
+		nodes := free[len(free)-1]
+		free[len(free)-1] = nil
+		tr.pool.nodes[class] = free[:len(free)-1]
+		return nodes[:n]
+	}
+	return make([]node, n, 1<<class)
+}
+
+// growNodes makes room in the branch for one more child node, drawing a
+// larger array from the pool and releasing the old one.
+func (tr *Tree) growNodes(nodes []node) []node {
+	nnodes := tr.allocNodes(len(nodes) + 1)[:len(nodes)]
+	copy(nnodes, nodes)
+	tr.releaseNodes(nodes)
+	return nnodes
+}
+
+// releaseNodes returns a child nodes array to the pool. The nodes are cleared
+// first, but the memory that they hold is not released.
+func (tr *Tree) releaseNodes(nodes []node) {
+	if tr.pool == nil || cap(nodes) == 0 || cap(nodes)&(cap(nodes)-1) != 0 {
+		return
+	}
+	nodes = nodes[:cap(nodes)]
+	for i := range nodes {
+		nodes[i] = node{}
+	}
+	class := bits.Len(uint(cap(nodes) - 1))
+	tr.pool.nodes[class] = append(tr.pool.nodes[class], nodes)
+}
+
+// allocItems returns an items array with a length of n. When the pool is
+// enabled the capacity is the next power of two.
+func (tr *Tree) allocItems(n int) []item {
+	if tr.pool == nil {
+		return make([]item, n)
+	}
+	if n == 0 {
+		return nil
+	}
+	class := bits.Len(uint(n - 1))
+	if free := tr.pool.items[class]; len(free) > 0 {
+		items := free[len(free)-1]
+		free[len(free)-1] = nil
+		tr.pool.items[class] = free[:len(free)-1]
+		return items[:n]
+	}
+	return make([]item, n, 1<<class)
+}
+
+// growItems makes room in the leaf for one more item, drawing a larger
+// array from the pool and releasing the old one.
+func (tr *Tree) growItems(items []item) []item {
+	nitems := tr.allocItems(len(items) + 1)[:len(items)]
+	copy(nitems, items)
+	tr.releaseItems(items)
+	return nitems
+}
+
+// releaseItems returns an items array to the pool. The data for all items is
+// cleared first to avoid holding onto user data.
+func (tr *Tree) releaseItems(items []item) {
+	if tr.pool == nil || cap(items) == 0 || cap(items)&(cap(items)-1) != 0 {
+		return
+	}
+	items = items[:cap(items)]
+	for i := range items {
+		items[i] = item{}
+	}
+	class := bits.Len(uint(cap(items) - 1))
+	tr.pool.items[class] = append(tr.pool.items[class], items)
+}
+
+// releaseNode returns the memory for a node and all of it's children to the
+// pool. The node itself is not modified.
+func (tr *Tree) releaseNode(n *node) {
+	if tr.pool == nil {
+		return
+	}
+	if !n.branch {
+		tr.releaseItems(n.items)
+		return
+	}
+	for i := range n.nodes {
+		tr.releaseNode(&n.nodes[i])
+	}
+	tr.releaseNodes(n.nodes)
+}
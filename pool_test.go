@@ -0,0 +1,132 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package celltree
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestNodePool(t *testing.T) {
+	start := time.Now()
+	for time.Since(start) < time.Second/2 {
+		testRandomStepTree(t, New(WithNodePool()), rand.Int()%10000)
+	}
+	tr := New(WithNodePool(), WithMaxItems(16))
+	for i := 0; i < 10; i++ {
+		testRandomStepTree(t, tr, rand.Int()%1000)
+	}
+	N := 100000
+	for i := 0; i < N; i++ {
+		tr.Insert(rand.Uint64(), i)
+	}
+	tr.sane()
+	tr.RangeDelete(0, math.MaxUint64/2, nil)
+	tr.sane()
+	for i := 0; i < N/2; i++ {
+		tr.Insert(rand.Uint64()/2, i)
+	}
+	tr.sane()
+	tr.RangeDelete(0, math.MaxUint64, nil)
+	tr.sane()
+	if tr.Count() != 0 {
+		t.Fatalf("expected %v, got %v", 0, tr.Count())
+	}
+	// pooled memory must not hold onto any user data
+	var pooled int
+	for class, free := range tr.pool.nodes {
+		for _, nodes := range free {
+			if cap(nodes) != 1<<class {
+				t.Fatalf("expected %v, got %v", 1<<class, cap(nodes))
+			}
+			for _, n := range nodes[:cap(nodes)] {
+				if n.branch || n.index != 0 || n.items != nil ||
+					n.nodes != nil || n.count != 0 {
+					t.Fatal("expected empty node")
+				}
+			}
+			pooled++
+		}
+	}
+	if pooled == 0 {
+		t.Fatal("expected pooled nodes")
+	}
+	pooled = 0
+	for class, free := range tr.pool.items {
+		for _, items := range free {
+			if cap(items) != 1<<class {
+				t.Fatalf("expected %v, got %v", 1<<class, cap(items))
+			}
+			for _, item := range items[:cap(items)] {
+				if item.data != nil {
+					t.Fatal("expected nil data")
+				}
+			}
+			pooled++
+		}
+	}
+	if pooled == 0 {
+		t.Fatal("expected pooled items")
+	}
+}
+
+func TestNodePoolAllocs(t *testing.T) {
+	cells := make([]uint64, 10000)
+	for i := range cells {
+		cells[i] = rand.Uint64()
+	}
+	cycle := func(tr *Tree) {
+		for _, cell := range cells {
+			tr.Insert(cell, nil)
+		}
+		for _, cell := range cells {
+			tr.Delete(cell, nil)
+		}
+	}
+	tr1 := New()
+	allocs1 := testing.AllocsPerRun(10, func() { cycle(tr1) })
+	tr2 := New(WithNodePool())
+	allocs2 := testing.AllocsPerRun(10, func() { cycle(tr2) })
+	if allocs2 >= allocs1/10 {
+		t.Fatalf("expected far fewer allocations, got %v vs %v",
+			allocs2, allocs1)
+	}
+}
+
+// BenchmarkChurn deletes and reinserts a quarter of the items in a tree
+// that has 1M items, like TestPerfLongTime.
+func BenchmarkChurn(b *testing.B) {
+	benchmarkChurn(b, New())
+}
+
+// BenchmarkChurnNodePool is the same as BenchmarkChurn, but uses a tree with
+// a node pool.
+func BenchmarkChurnNodePool(b *testing.B) {
+	benchmarkChurn(b, New(WithNodePool()))
+}
+
+func benchmarkChurn(b *testing.B, tr *Tree) {
+	rng := rand.New(rand.NewSource(1))
+	N := 1024 * 1024
+	ints := randomRand(rng, N, true)
+	for i := 0; i < N; i++ {
+		tr.Insert(ints[i], nil)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		x := i % 4
+		opp := rng.Uint64()
+		for j := x; j < N; j += 4 {
+			tr.Delete(ints[j], nil)
+			ints[j] ^= opp
+		}
+		for j := x; j < N; j += 4 {
+			tr.Insert(ints[j], nil)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package celltree
+
+// Set is a uint64 prefix tree that stores unique cells without any data.
+type Set struct {
+	tr TreeG[struct{}]
+}
+
+func setReplace(struct{}) (struct{}, bool) {
+	return struct{}{}, true
+}
+
+// Count returns the number of cells in the set.
+func (s *Set) Count() int {
+	return s.tr.Count()
+}
+
+// Insert adds a cell to the set. Inserting a cell that already exists in the
+// set does nothing.
+func (s *Set) Insert(cell uint64) {
+	s.tr.InsertOrReplace(cell, struct{}{}, setReplace)
+}
+
+// Delete removes a cell from the set.
+func (s *Set) Delete(cell uint64) {
+	s.tr.Delete(cell, struct{}{})
+}
+
+// Contains returns true if the cell exists in the set.
+func (s *Set) Contains(cell uint64) bool {
+	return s.tr.contains(cell)
+}
+
+// Scan iterates over the entire set. Return false from iter function to stop.
+func (s *Set) Scan(iter func(cell uint64) bool) {
+	s.tr.Scan(func(cell uint64, _ struct{}) bool {
+		return iter(cell)
+	})
+}
+
+// Range iterates over the set starting with the start param.
+func (s *Set) Range(start uint64, iter func(cell uint64) bool) {
+	s.tr.Range(start, func(cell uint64, _ struct{}) bool {
+		return iter(cell)
+	})
+}
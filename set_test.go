@@ -0,0 +1,69 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package celltree
+
+import (
+	"math/rand"
+	"testing"
+	"unsafe"
+)
+
+func TestSet(t *testing.T) {
+	if sz := unsafe.Sizeof(gitem[struct{}]{}); sz != 8 {
+		t.Fatalf("expected %v, got %v", 8, sz)
+	}
+	N := 50000
+	ints := random(N, rand.Int()%2 == 0)
+	var s Set
+	for i := 0; i < N; i++ {
+		s.Insert(ints[i])
+		// inserting twice is a noop
+		s.Insert(ints[i])
+	}
+	s.tr.sane()
+	if s.Count() != N {
+		t.Fatalf("expected %v, got %v", N, s.Count())
+	}
+	for i := 0; i < N; i++ {
+		if !s.Contains(ints[i]) {
+			t.Fatalf("expected %v to exist", ints[i])
+		}
+	}
+	var all []uint64
+	s.Scan(func(cell uint64) bool {
+		all = append(all, cell)
+		return true
+	})
+	testEquals(t, append([]uint64(nil), ints...), all)
+
+	pivot := ints[len(ints)/2]
+	var rangeCells []uint64
+	s.Range(pivot, func(cell uint64) bool {
+		rangeCells = append(rangeCells, cell)
+		return true
+	})
+	var scanCells []uint64
+	for _, cell := range all {
+		if cell >= pivot {
+			scanCells = append(scanCells, cell)
+		}
+	}
+	testEquals(t, scanCells, rangeCells)
+
+	shuffle(ints)
+	for i := 0; i < N; i++ {
+		s.Delete(ints[i])
+		if s.Contains(ints[i]) {
+			t.Fatalf("expected %v to not exist", ints[i])
+		}
+	}
+	s.tr.sane()
+	if s.Count() != 0 {
+		t.Fatalf("expected %v, got %v", 0, s.Count())
+	}
+	if s.Contains(0) {
+		t.Fatal("expected false")
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package celltree
+
+// The set operations treat each tree as a set of cells. When a tree has
+// duplicate cells, only the first item for that cell is used, and the
+// resulting tree never has duplicate cells.
+//
+// The resolve function is called when a cell exists in both trees, and
+// returns the data for the resulting item. When resolve is nil the data from
+// the a tree is used. The resulting tree uses the same options as the a tree.
+
+// Union returns a new tree that has the cells that are in either tree.
+func Union(a, b *Tree,
+	resolve func(cell uint64, a, b interface{}) interface{},
+) *Tree {
+	return merge(a, b, true, true, true, resolve)
+}
+
+// Intersect returns a new tree that has the cells that are in both trees.
+func Intersect(a, b *Tree,
+	resolve func(cell uint64, a, b interface{}) interface{},
+) *Tree {
+	return merge(a, b, false, false, true, resolve)
+}
+
+// Difference returns a new tree that has the cells in the a tree that are not
+// in the b tree. The data is always from the a tree.
+func Difference(a, b *Tree) *Tree {
+	return merge(a, b, true, false, false, nil)
+}
+
+// cellCursor iterates over the distinct cells of a tree, in order.
+type cellCursor struct {
+	it    leafIter
+	items []item
+}
+
+func newCellCursor(tr *Tree) *cellCursor {
+	c := &cellCursor{it: newLeafIter(tr.root)}
+	c.items = c.it.next()
+	return c
+}
+
+// item returns the first item for the current cell, or nil when there are
+// no more cells.
+func (c *cellCursor) item() *item {
+	if len(c.items) == 0 {
+		return nil
+	}
+	return &c.items[0]
+}
+
+// next moves to the next distinct cell.
+func (c *cellCursor) next() {
+	cell := c.items[0].cell
+	for len(c.items) > 0 && c.items[0].cell == cell {
+		c.items = c.items[1:]
+		if len(c.items) == 0 {
+			// duplicate cells may continue in the next leaf
+			c.items = c.it.next()
+		}
+	}
+}
+
+// merge walks both trees in order and collects the cells for a new tree.
+// The keep params choose which cells are kept, those only in a, only in b,
+// or in both trees.
+func merge(a, b *Tree, keepA, keepB, keepBoth bool,
+	resolve func(cell uint64, a, b interface{}) interface{},
+) *Tree {
+	var items []item
+	ca, cb := newCellCursor(a), newCellCursor(b)
+	for {
+		ia, ib := ca.item(), cb.item()
+		if (ia == nil && ib == nil) || (ia == nil && !keepB) ||
+			(ib == nil && !keepA) {
+			// nothing more to keep
+			break
+		}
+		switch {
+		case ib == nil || (ia != nil && ia.cell < ib.cell):
+			if keepA {
+				items = append(items, *ia)
+			}
+			ca.next()
+		case ia == nil || ib.cell < ia.cell:
+			if keepB {
+				items = append(items, *ib)
+			}
+			cb.next()
+		default:
+			if keepBoth {
+				data := ia.data
+				if resolve != nil {
+					data = resolve(ia.cell, ia.data, ib.data)
+				}
+				items = append(items, item{cell: ia.cell, data: data})
+			}
+			ca.next()
+			cb.next()
+		}
+	}
+	ntr := a.emptyCopy()
+	ntr.load(items)
+	return ntr
+}
@@ -0,0 +1,95 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package celltree
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// randomSetTree returns a tree with random cells and some duplicates, along
+// with a map of the first data for each cell.
+func randomSetTree(N int, space uint64) (*Tree, map[uint64]interface{}) {
+	tr := New(WithMaxItems(rand.Int()%64 + 8))
+	m := make(map[uint64]interface{})
+	for i := 0; i < N; i++ {
+		cell := rand.Uint64() % space
+		data := rand.Int()
+		tr.Insert(cell, data)
+		if _, ok := m[cell]; !ok {
+			m[cell] = data
+		}
+	}
+	return tr, m
+}
+
+func testSetResult(t *testing.T, tr *Tree, expect map[uint64]interface{}) {
+	t.Helper()
+	tr.sane()
+	if tr.Count() != len(expect) {
+		t.Fatalf("expected %v, got %v", len(expect), tr.Count())
+	}
+	var last uint64
+	var i int
+	tr.Scan(func(cell uint64, data interface{}) bool {
+		if i > 0 && cell <= last {
+			t.Fatalf("duplicate or out of order cell %v", cell)
+		}
+		if expect[cell] != data {
+			t.Fatalf("cell %v: expected %v, got %v", cell, expect[cell], data)
+		}
+		last = cell
+		i++
+		return true
+	})
+}
+
+func TestSetOps(t *testing.T) {
+	resolve := func(cell uint64, a, b interface{}) interface{} {
+		return a.(int) + b.(int)
+	}
+	for i := 0; i < 100; i++ {
+		// a small space makes for more overlap and duplicates
+		space := uint64(rand.Int()%10000 + 1)
+		if i%2 == 0 {
+			space = ^uint64(0)
+		}
+		a, ma := randomSetTree(rand.Int()%5000, space)
+		b, mb := randomSetTree(rand.Int()%5000, space)
+
+		union := make(map[uint64]interface{})
+		inter := make(map[uint64]interface{})
+		diff := make(map[uint64]interface{})
+		for cell, data := range ma {
+			if bdata, ok := mb[cell]; ok {
+				union[cell] = resolve(cell, data, bdata)
+				inter[cell] = data
+			} else {
+				union[cell] = data
+				diff[cell] = data
+			}
+		}
+		for cell, data := range mb {
+			if _, ok := ma[cell]; !ok {
+				union[cell] = data
+			}
+		}
+		testSetResult(t, Union(a, b, resolve), union)
+		testSetResult(t, Intersect(a, b, nil), inter)
+		testSetResult(t, Difference(a, b), diff)
+		// the source trees are unchanged
+		a.sane()
+		b.sane()
+	}
+	// empty trees
+	var a, b Tree
+	for _, tr := range []*Tree{
+		Union(&a, &b, nil), Intersect(&a, &b, nil), Difference(&a, &b),
+	} {
+		if tr.Count() != 0 {
+			t.Fatal("expected empty")
+		}
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package celltree
+
+import (
+	"fmt"
+	"strings"
+	"unsafe"
+)
+
+// TreeStats describes the structure of a tree.
+type TreeStats struct {
+	BranchCount int     // number of branch nodes
+	LeafCount   int     // number of non-empty leaf nodes
+	TotalItems  int     // number of items
+	MaxDepth    int     // number of levels from the root to the deepest leaf
+	AvgLeafFill float64 // average number of items per leaf over max items
+	// AvgBranchFill is the average number of non-empty child nodes per
+	// branch over the number of child nodes. A low value means that the
+	// cells are sparse and the branches are mostly empty.
+	AvgBranchFill float64
+	// LeafHistogram is the number of leaves by fill, where each bucket is
+	// a 10% step of the max items. Leaves at the maximum depth of the tree
+	// that exceed the max items are in the last bucket.
+	LeafHistogram [10]int
+}
+
+// Stats returns structural information about the tree.
+func (tr *Tree) Stats() TreeStats {
+	var stats TreeStats
+	if tr.count == 0 {
+		return stats
+	}
+	tr.root.stats(tr, &stats, 1)
+	stats.AvgLeafFill = float64(stats.TotalItems) /
+		float64(stats.LeafCount*tr.maxItems)
+	if stats.BranchCount > 0 {
+		// the number of non-empty children is one less than the number of
+		// nodes, which excludes the root.
+		stats.AvgBranchFill = float64(stats.BranchCount+stats.LeafCount-1) /
+			float64(stats.BranchCount<<tr.numBits)
+	}
+	return stats
+}
+
+func (n *node) stats(tr *Tree, stats *TreeStats, depth int) {
+	if depth > stats.MaxDepth {
+		stats.MaxDepth = depth
+	}
+	if !n.branch {
+		stats.LeafCount++
+		stats.TotalItems += len(n.items)
+		bucket := len(n.items) * 10 / tr.maxItems
+		if bucket >= len(stats.LeafHistogram) {
+			bucket = len(stats.LeafHistogram) - 1
+		}
+		stats.LeafHistogram[bucket]++
+		return
+	}
+	stats.BranchCount++
+	for i := 0; i < len(n.nodes); i++ {
+		if n.nodes[i].count > 0 {
+			n.nodes[i].stats(tr, stats, depth+1)
+		}
+	}
+}
+
+// String returns a human-readable representation of the stats.
+func (stats TreeStats) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "branches:      %d\n", stats.BranchCount)
+	fmt.Fprintf(&sb, "leaves:        %d\n", stats.LeafCount)
+	fmt.Fprintf(&sb, "items:         %d\n", stats.TotalItems)
+	fmt.Fprintf(&sb, "max depth:     %d\n", stats.MaxDepth)
+	fmt.Fprintf(&sb, "avg leaf fill: %.1f%%\n", stats.AvgLeafFill*100)
+	fmt.Fprintf(&sb, "branch fill:   %.1f%%\n", stats.AvgBranchFill*100)
+	fmt.Fprintf(&sb, "leaf fill histogram:\n")
+	for i, count := range stats.LeafHistogram {
+		fmt.Fprintf(&sb, "  %3d-%3d%%: %d\n", i*10, i*10+10, count)
+	}
+	return sb.String()
+}
+
+// Height returns the number of levels from the root to the deepest leaf,
+// where a tree with only a root leaf has a height of one. Returns zero for an
+// empty tree.
+func (tr *Tree) Height() int {
+	if tr.count == 0 {
+		return 0
+	}
+	return tr.root.height()
+}
+
+func (n *node) height() int {
+	if !n.branch {
+		return 1
+	}
+	var height int
+	for i := 0; i < len(n.nodes); i++ {
+		if n.nodes[i].count > 0 {
+			if h := n.nodes[i].height(); h > height {
+				height = h
+			}
+		}
+	}
+	return height + 1
+}
+
+// MaxLeafDepthReached returns true if any leaf in the tree is at the maximum
+// depth, where the cells can no longer be split into child nodes. These
+// leaves are allowed to have more than the max items.
+func (tr *Tree) MaxLeafDepthReached() bool {
+	if tr.count == 0 {
+		return false
+	}
+	return tr.root.maxLeafDepthReached(tr, 64-tr.numBits)
+}
+
+func (n *node) maxLeafDepthReached(tr *Tree, bits uint) bool {
+	if !n.branch {
+		return tr.maxDepth(bits)
+	}
+	for i := 0; i < len(n.nodes); i++ {
+		if n.nodes[i].count > 0 &&
+			n.nodes[i].maxLeafDepthReached(tr, bits-tr.numBits) {
+			return true
+		}
+	}
+	return false
+}
+
+// Walk visits each node in the tree in pre-order. The fn is passed the depth
+// of the node, where the root is zero, whether the node is a leaf, the number
+// of items in the node and all of it's children, and the first possible cell
+// for the node. Return false from fn to skip the children of the node.
+func (tr *Tree) Walk(
+	fn func(depth int, isLeaf bool, count int, cellPrefix uint64) bool,
+) {
+	if tr.count == 0 {
+		return
+	}
+	tr.root.walk(tr, 0, 64-tr.numBits, 0, fn)
+}
+
+func (n *node) walk(
+	tr *Tree, depth int, bits uint, base uint64,
+	fn func(depth int, isLeaf bool, count int, cellPrefix uint64) bool,
+) {
+	if !fn(depth, !n.branch, n.count, base) || !n.branch {
+		return
+	}
+	for i := 0; i < len(n.nodes); i++ {
+		if n.nodes[i].count > 0 {
+			n.nodes[i].walk(tr, depth+1, bits-tr.numBits,
+				base|uint64(n.nodes[i].index)<<bits, fn)
+		}
+	}
+}
+
+// Leaves visits each non-empty leaf in the tree, in order. The fn is passed
+// the first possible cell for the leaf and a copy of it's items. The items
+// slice is reused and is only valid until fn returns. Return false from fn to
+// stop.
+func (tr *Tree) Leaves(fn func(prefix uint64, items []Item) bool) {
+	if tr.count == 0 {
+		return
+	}
+	var buf []Item
+	tr.root.leaves(tr, 64-tr.numBits, 0, &buf, fn)
+}
+
+func (n *node) leaves(
+	tr *Tree, bits uint, base uint64, buf *[]Item,
+	fn func(prefix uint64, items []Item) bool,
+) bool {
+	if !n.branch {
+		items := (*buf)[:0]
+		for i := 0; i < len(n.items); i++ {
+			items = append(items, Item{Cell: n.items[i].cell,
+				Data: n.items[i].data})
+		}
+		*buf = items
+		return fn(base, items)
+	}
+	for i := 0; i < len(n.nodes); i++ {
+		if n.nodes[i].count > 0 {
+			if !n.nodes[i].leaves(tr, bits-tr.numBits,
+				base|uint64(n.nodes[i].index)<<bits, buf, fn) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// MemoryUsage returns an estimate of the number of bytes used by the tree's
+// nodes and item arrays. It does not include the memory used by the data
+// payloads of the items.
+func (tr *Tree) MemoryUsage() int {
+	size := int(unsafe.Sizeof(*tr))
+	if tr.root != nil {
+		size += int(unsafe.Sizeof(*tr.root)) + tr.root.memoryUsage()
+	}
+	return size
+}
+
+func (n *node) memoryUsage() int {
+	if !n.branch {
+		return cap(n.items) * int(unsafe.Sizeof(item{}))
+	}
+	size := cap(n.nodes) * int(unsafe.Sizeof(node{}))
+	for i := 0; i < len(n.nodes); i++ {
+		size += n.nodes[i].memoryUsage()
+	}
+	return size
+}
@@ -0,0 +1,271 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package celltree
+
+import (
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	var tr Tree
+	if tr.Stats() != (TreeStats{}) {
+		t.Fatal("expected empty stats")
+	}
+	for i := 0; i < maxItems; i++ {
+		tr.Insert(uint64(i), nil)
+	}
+	stats := tr.Stats()
+	if stats.BranchCount != 0 || stats.LeafCount != 1 ||
+		stats.TotalItems != maxItems || stats.MaxDepth != 1 ||
+		stats.AvgLeafFill != 1 || stats.LeafHistogram[9] != 1 ||
+		stats.AvgBranchFill != 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	// three items in each root child leaf
+	tr = Tree{}
+	for i := 0; i < numNodes; i++ {
+		for j := 0; j < 3; j++ {
+			tr.Insert(uint64(i)<<(64-numBits)+uint64(j), nil)
+		}
+	}
+	stats = tr.Stats()
+	if stats.BranchCount != 1 || stats.LeafCount != numNodes ||
+		stats.TotalItems != numNodes*3 || stats.MaxDepth != 2 ||
+		stats.LeafHistogram[0] != numNodes {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	if stats.AvgLeafFill != 3.0/maxItems {
+		t.Fatalf("expected %v, got %v", 3.0/maxItems, stats.AvgLeafFill)
+	}
+	if stats.AvgBranchFill != 1 {
+		t.Fatalf("expected %v, got %v", 1, stats.AvgBranchFill)
+	}
+
+	// duplicate cells create a deep chain of branches
+	tr = Tree{}
+	for i := 0; i < maxItems*2; i++ {
+		tr.Insert(388098102398102938, nil)
+	}
+	stats = tr.Stats()
+	if stats.BranchCount != 8 || stats.LeafCount != 1 ||
+		stats.MaxDepth != 9 || stats.LeafHistogram[9] != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	// each branch in the chain has a single child
+	if stats.AvgBranchFill != 1.0/numNodes {
+		t.Fatalf("expected %v, got %v", 1.0/numNodes, stats.AvgBranchFill)
+	}
+	if !strings.Contains(stats.String(), "max depth:     9\n") {
+		t.Fatalf("unexpected string: %s", stats.String())
+	}
+}
+
+func TestWalk(t *testing.T) {
+	var tr Tree
+	tr.Walk(func(depth int, isLeaf bool, count int, cellPrefix uint64) bool {
+		t.Fatal("expected no nodes")
+		return true
+	})
+	N := 100000
+	ints := random(N, false)
+	for i := 0; i < N; i++ {
+		tr.Insert(ints[i], nil)
+	}
+	var leafCount, branchCount, nodes int
+	tr.Walk(func(depth int, isLeaf bool, count int, cellPrefix uint64) bool {
+		nodes++
+		if depth == 0 && (cellPrefix != 0 || count != N) {
+			t.Fatalf("invalid root: %v %v", cellPrefix, count)
+		}
+		if isLeaf {
+			leafCount += count
+			// all cells in the leaf must be under the prefix
+			shift := 64 - uint(depth)*numBits
+			tr.PrefixScan(cellPrefix, uint(depth)*numBits,
+				func(cell uint64, data interface{}) bool {
+					count--
+					return true
+				},
+			)
+			if count != 0 || cellPrefix<<(64-shift) != 0 {
+				t.Fatalf("invalid leaf prefix %x", cellPrefix)
+			}
+		} else {
+			branchCount++
+		}
+		return true
+	})
+	if leafCount != tr.Count() {
+		t.Fatalf("expected %v, got %v", tr.Count(), leafCount)
+	}
+	stats := tr.Stats()
+	if branchCount != stats.BranchCount ||
+		nodes != stats.BranchCount+stats.LeafCount {
+		t.Fatal("stats mismatch")
+	}
+	// prune all children of the root
+	nodes = 0
+	tr.Walk(func(depth int, isLeaf bool, count int, cellPrefix uint64) bool {
+		nodes++
+		return false
+	})
+	if nodes != 1 {
+		t.Fatalf("expected %v, got %v", 1, nodes)
+	}
+}
+
+func TestLeaves(t *testing.T) {
+	var tr Tree
+	tr.Leaves(func(prefix uint64, items []Item) bool {
+		t.Fatal("expected no leaves")
+		return true
+	})
+	N := 100000
+	ints := random(N, false)
+	for i := 0; i < N; i++ {
+		tr.Insert(ints[i], i)
+		if i%10 == 0 {
+			// duplicate cell
+			tr.Insert(ints[i], -i)
+		}
+	}
+	var all []Item
+	var leaves int
+	tr.Leaves(func(prefix uint64, items []Item) bool {
+		if len(items) == 0 {
+			t.Fatal("expected items")
+		}
+		// all cells in the leaf must be under the prefix
+		if items[0].Cell < prefix {
+			t.Fatalf("%x is before the prefix %x", items[0].Cell, prefix)
+		}
+		if leaves > 0 && all[len(all)-1].Cell >= prefix {
+			t.Fatalf("%x is after the prefix %x", all[len(all)-1].Cell,
+				prefix)
+		}
+		all = append(all, items...)
+		leaves++
+		return true
+	})
+	if leaves != tr.Stats().LeafCount {
+		t.Fatalf("expected %v, got %v", tr.Stats().LeafCount, leaves)
+	}
+	expect := tr.ToSlice()
+	if len(all) != len(expect) {
+		t.Fatalf("expected %v, got %v", len(expect), len(all))
+	}
+	for i := range all {
+		if all[i] != expect[i] {
+			t.Fatalf("expected %v, got %v", expect[i], all[i])
+		}
+	}
+	// stop early
+	leaves = 0
+	tr.Leaves(func(prefix uint64, items []Item) bool {
+		leaves++
+		return leaves < 3
+	})
+	if leaves != 3 {
+		t.Fatalf("expected %v, got %v", 3, leaves)
+	}
+}
+
+func TestMemoryUsage(t *testing.T) {
+	var tr Tree
+	empty := tr.MemoryUsage()
+	if empty == 0 {
+		t.Fatal("expected non-zero")
+	}
+	tr.Insert(1, nil)
+	if tr.MemoryUsage() <= empty {
+		t.Fatal("expected growth")
+	}
+	N := 100000
+	for i := 0; i < N; i++ {
+		tr.Insert(rand.Uint64(), nil)
+	}
+	size := tr.MemoryUsage()
+	// each item is at least 24 bytes and leaves are at least 40% full
+	if size < N*24 || size > N*24*100/40+numNodes*48*(N/maxItems+1) {
+		t.Fatalf("unexpected memory usage %v", size)
+	}
+	tr.RangeDelete(0, math.MaxUint64, nil)
+	if tr.MemoryUsage() >= size/10 {
+		t.Fatalf("expected shrink, got %v", tr.MemoryUsage())
+	}
+}
+
+func TestMemoryUsageClustered(t *testing.T) {
+	// clusters of cells leave most of the child indexes of a branch unused,
+	// which must not cost any memory because only the non-empty child nodes
+	// are stored.
+	rng := rand.New(rand.NewSource(1))
+	tr := New()
+	for i := 0; i < 100; i++ {
+		base := rng.Uint64()
+		for j := 0; j < 1000; j++ {
+			tr.Insert(base+rng.Uint64()%(1<<32), nil)
+		}
+	}
+	if tr.Stats().AvgBranchFill > 0.1 {
+		t.Fatalf("expected sparse branches, got %v", tr.Stats().AvgBranchFill)
+	}
+	// the items of the leaves take 24 bytes each, and leaves are at least
+	// 40% full.
+	if perItem := tr.MemoryUsage() / tr.Count(); perItem > 64 {
+		t.Fatalf("expected at most 64 bytes per item, got %v", perItem)
+	}
+}
+
+func TestHeight(t *testing.T) {
+	var tr Tree
+	if tr.Height() != 0 || tr.MaxLeafDepthReached() {
+		t.Fatal("expected an empty tree")
+	}
+	for _, tc := range []struct {
+		cell    func(i int) uint64
+		count   int
+		height  int
+		reached bool
+	}{
+		// a single root leaf
+		{func(i int) uint64 { return uint64(i) }, maxItems, 1, false},
+		// 125 leaves of 8 items under the branch for bits 43
+		{func(i int) uint64 { return uint64(i) << 40 }, 1000, 4, false},
+		// spread across the root branch
+		{func(i int) uint64 { return uint64(i) << 57 }, 1000, 2, false},
+		// the low bits reach the leaves at the maximum depth
+		{func(i int) uint64 { return uint64(i) }, 1000, 9, true},
+		// duplicates are never split
+		{func(i int) uint64 { return 12345 }, 1000, 9, true},
+	} {
+		tr := Tree{}
+		for i := 0; i < tc.count; i++ {
+			tr.Insert(tc.cell(i), i)
+		}
+		if tr.Height() != tc.height {
+			t.Fatalf("expected %v, got %v", tc.height, tr.Height())
+		}
+		if tr.Height() != tr.Stats().MaxDepth {
+			t.Fatalf("expected %v, got %v", tr.Stats().MaxDepth, tr.Height())
+		}
+		if tr.MaxLeafDepthReached() != tc.reached {
+			t.Fatalf("expected %v, got %v", tc.reached,
+				tr.MaxLeafDepthReached())
+		}
+	}
+	// a smaller fanout makes for a deeper tree
+	tr2 := New(WithFanoutBits(4))
+	for i := 0; i < 1000; i++ {
+		tr2.Insert(12345, i)
+	}
+	if tr2.Height() != 16 || !tr2.MaxLeafDepthReached() {
+		t.Fatalf("expected %v, got %v", 16, tr2.Height())
+	}
+}
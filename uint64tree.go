@@ -0,0 +1,51 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package celltree
+
+// Uint64Tree is a uint64 prefix tree that stores uint64 data, such as object
+// ids. Each item is 16 bytes, which is half the size of a Tree item, and the
+// data is compared as a plain integer.
+type Uint64Tree struct {
+	tr TreeG[uint64]
+}
+
+// Count returns the number of items in the tree.
+func (tr *Uint64Tree) Count() int {
+	return tr.tr.Count()
+}
+
+// Insert inserts an item into the tree. Items are ordered by it's cell.
+func (tr *Uint64Tree) Insert(cell uint64, data uint64) {
+	tr.tr.Insert(cell, data)
+}
+
+// Delete removes an item from the tree based on it's cell and data values.
+func (tr *Uint64Tree) Delete(cell uint64, data uint64) {
+	tr.tr.DeleteWhen(cell, func(other uint64) bool {
+		return other == data
+	})
+}
+
+// Scan iterates over the entire tree. Return false from iter function to stop.
+func (tr *Uint64Tree) Scan(iter func(cell uint64, data uint64) bool) {
+	tr.tr.Scan(iter)
+}
+
+// Range iterates over the tree starting with the start param.
+func (tr *Uint64Tree) Range(
+	start uint64, iter func(cell uint64, data uint64) bool,
+) {
+	tr.tr.Range(start, iter)
+}
+
+// RangeDelete iterates over the tree starting with the start param and "asks"
+// the iterator if the item should be deleted. Only items in the inclusive
+// [start,end] range are visited. A nil iter deletes all items in the range.
+func (tr *Uint64Tree) RangeDelete(
+	start, end uint64,
+	iter func(cell uint64, data uint64) (shouldDelete bool, ok bool),
+) {
+	tr.tr.RangeDelete(start, end, iter)
+}
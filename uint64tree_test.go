@@ -0,0 +1,74 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package celltree
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"unsafe"
+)
+
+func TestUint64Tree(t *testing.T) {
+	if sz := unsafe.Sizeof(gitem[uint64]{}); sz != 16 {
+		t.Fatalf("expected %v, got %v", 16, sz)
+	}
+	N := 50000
+	ints := random(N, rand.Int()%2 == 0)
+	var tr Uint64Tree
+	for i := 0; i < N; i++ {
+		tr.Insert(ints[i], uint64(i))
+	}
+	tr.tr.sane()
+	if tr.Count() != N {
+		t.Fatalf("expected %v, got %v", N, tr.Count())
+	}
+	var all []uint64
+	tr.Scan(func(cell uint64, data uint64) bool {
+		if ints[data] != cell {
+			t.Fatalf("expected %v, got %v", ints[data], cell)
+		}
+		all = append(all, cell)
+		return true
+	})
+	testEquals(t, append([]uint64(nil), ints...), all)
+
+	pivot := all[len(all)/2]
+	var rangeCells []uint64
+	tr.Range(pivot, func(cell uint64, data uint64) bool {
+		rangeCells = append(rangeCells, cell)
+		return true
+	})
+	testEquals(t, all[len(all)/2:], rangeCells)
+
+	for i := 0; i < N/2; i++ {
+		// deleting with the wrong data is a noop
+		tr.Delete(ints[i], math.MaxUint64)
+		tr.Delete(ints[i], uint64(i))
+		if tr.Count() != N-i-1 {
+			t.Fatalf("expected %v, got %v", N-i-1, tr.Count())
+		}
+	}
+	tr.tr.sane()
+
+	// delete all odd data
+	tr.RangeDelete(0, math.MaxUint64,
+		func(cell uint64, data uint64) (bool, bool) {
+			return data%2 == 1, true
+		},
+	)
+	tr.tr.sane()
+	tr.Scan(func(cell uint64, data uint64) bool {
+		if data%2 == 1 {
+			t.Fatalf("expected even data, got %v", data)
+		}
+		return true
+	})
+	tr.RangeDelete(0, math.MaxUint64, nil)
+	tr.tr.sane()
+	if tr.Count() != 0 {
+		t.Fatalf("expected %v, got %v", 0, tr.Count())
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package celltree
+
+import "fmt"
+
+// Validate checks the internal structure of the tree, such as the item
+// counts, the order of the cells, and the fill of the leaves. This is useful
+// for detecting a tree that was corrupted by misuse, like unsynchronized
+// writes from multiple goroutines. Returns nil if the tree is valid,
+// otherwise the error describes the first problem found. The path of a node
+// is the child indexes starting from the root.
+func (tr *Tree) Validate() error {
+	if tr.root == nil {
+		if tr.count != 0 {
+			return fmt.Errorf("celltree: empty tree has a count of %d",
+				tr.count)
+		}
+		return nil
+	}
+	// the path has room for the deepest possible node, so that appending
+	// to it does not allocate.
+	path := make([]int, 0, 64/tr.numBits+1)
+	count, _, err := tr.root.validate(tr, path, 0, 64-tr.numBits)
+	if err != nil {
+		return err
+	}
+	if tr.count != count {
+		return fmt.Errorf("celltree: tree has a count of %d, but %d items",
+			tr.count, count)
+	}
+	return nil
+}
+
+func (n *node) validate(tr *Tree, path []int, cell uint64, bits uint,
+) (count int, cellout uint64, err error) {
+	if !n.branch {
+		// all leaves count should match the number of items.
+		if n.count != len(n.items) {
+			return 0, 0, fmt.Errorf(
+				"celltree: leaf %v has a count of %d, but %d items",
+				path, n.count, len(n.items))
+		}
+		// leaves should never go above max items unless they are at max
+		// depth.
+		if n.count > tr.maxItems && !tr.maxDepth(bits) {
+			return 0, 0, fmt.Errorf(
+				"celltree: leaf %v has a count of %d, but maxItems is %d",
+				path, n.count, tr.maxItems)
+		}
+		// empty leaves should have a nil items array
+		if len(n.items) == 0 && n.items != nil {
+			return 0, 0, fmt.Errorf(
+				"celltree: leaf %v has zero items, but a non-nil items array",
+				path)
+		}
+		// the items cells must be in order
+		for i := 0; i < len(n.items); i++ {
+			if n.items[i].cell < cell {
+				return 0, 0, fmt.Errorf(
+					"celltree: leaf %v is out of order at index %d",
+					path, i)
+			}
+			// unique trees must have strictly increasing cells
+			if tr.unique && i > 0 && n.items[i].cell == cell {
+				return 0, 0, fmt.Errorf(
+					"celltree: leaf %v has a duplicate cell at index %d",
+					path, i)
+			}
+			cell = n.items[i].cell
+		}
+		// leaves should not fall to 40% of capacity or below
+		min := cap(n.items) * 40 / 100
+		if len(n.items) <= min && len(n.items) > 0 {
+			return 0, 0, fmt.Errorf(
+				"celltree: leaf %v is underfilled with %d items and a "+
+					"capacity of %d", path, len(n.items), cap(n.items))
+		}
+		return len(n.items), cell, nil
+	}
+	// all branches should have a count of at least 1
+	if n.count <= 0 {
+		return 0, 0, fmt.Errorf("celltree: branch %v has a count of %d",
+			path, n.count)
+	}
+	// all branches should have a nil items array
+	if n.items != nil {
+		return 0, 0, fmt.Errorf("celltree: branch %v has non-nil items", path)
+	}
+	// check each node
+	for i := 0; i < len(n.nodes); i++ {
+		index := int(n.nodes[i].index)
+		// the child nodes should be sorted by index and not be empty
+		if index >= 1<<tr.numBits ||
+			(i > 0 && index <= int(n.nodes[i-1].index)) {
+			return 0, 0, fmt.Errorf(
+				"celltree: branch %v has a child node with index %d at "+
+					"position %d", path, index, i)
+		}
+		if n.nodes[i].count == 0 {
+			return 0, 0, fmt.Errorf(
+				"celltree: branch %v has an empty child node at index %d",
+				path, index)
+		}
+		ncount, ncell, err := n.nodes[i].validate(tr, append(path, index),
+			cell, bits-tr.numBits)
+		if err != nil {
+			return 0, 0, err
+		}
+		count += ncount
+		if ncell < cell {
+			return 0, 0, fmt.Errorf(
+				"celltree: branch %v is out of order at index %d", path, index)
+		}
+		cell = ncell
+	}
+	if n.count != count {
+		return 0, 0, fmt.Errorf(
+			"celltree: branch %v has a count of %d, but %d items",
+			path, n.count, count)
+	}
+	return count, cell, nil
+}
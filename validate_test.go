@@ -0,0 +1,108 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package celltree
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	var tr Tree
+	if err := tr.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	newTree := func() *Tree {
+		tr := New(WithMaxItems(16))
+		for i := 0; i < 1000; i++ {
+			tr.Insert(uint64(i)<<54, i)
+		}
+		if err := tr.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		return tr
+	}
+	// firstLeaf returns the first non-empty leaf and it's path
+	firstLeaf := func(tr *Tree) (*node, string) {
+		n := tr.root
+		path := []int{}
+		for n.branch {
+			for i := range n.nodes {
+				if n.nodes[i].count > 0 {
+					path = append(path, int(n.nodes[i].index))
+					n = &n.nodes[i]
+					break
+				}
+			}
+		}
+		return n, fmt.Sprint(path)
+	}
+	for _, tc := range []struct {
+		corrupt func(tr *Tree) string
+		expect  string
+	}{
+		{func(tr *Tree) string {
+			tr.count++
+			return ""
+		}, "tree has a count of 1001, but 1000 items"},
+		{func(tr *Tree) string {
+			n, path := firstLeaf(tr)
+			n.count++
+			return path
+		}, "leaf %s has a count of"},
+		{func(tr *Tree) string {
+			n, path := firstLeaf(tr)
+			n.items[0], n.items[1] = n.items[1], n.items[0]
+			return path
+		}, "leaf %s is out of order at index 1"},
+		{func(tr *Tree) string {
+			n, path := firstLeaf(tr)
+			n.items = make([]item, len(n.items), len(n.items)*3)
+			return path
+		}, "leaf %s is underfilled"},
+		{func(tr *Tree) string {
+			tr.root.count--
+			return "[]"
+		}, "branch %s has a count of 999, but 1000 items"},
+		{func(tr *Tree) string {
+			tr.root.items = []item{}
+			return "[]"
+		}, "branch %s has non-nil items"},
+		{func(tr *Tree) string {
+			tr.root.nodes[0], tr.root.nodes[1] =
+				tr.root.nodes[1], tr.root.nodes[0]
+			return "[]"
+		}, "branch %s has a child node with index 0 at position 1"},
+		{func(tr *Tree) string {
+			tr.root.nodes[0].count = 0
+			return "[]"
+		}, "branch %s has an empty child node at index 0"},
+	} {
+		tr := newTree()
+		path := tc.corrupt(tr)
+		expect := strings.Replace(tc.expect, "%s", path, 1)
+		err := tr.Validate()
+		if err == nil || !strings.Contains(err.Error(), expect) {
+			t.Fatalf("expected %q, got %v", expect, err)
+		}
+	}
+}
+
+func TestValidateAllocs(t *testing.T) {
+	tr := New(WithMaxItems(16))
+	for i := 0; i < 10000; i++ {
+		tr.Insert(rand.Uint64(), i)
+	}
+	allocs := testing.AllocsPerRun(10, func() {
+		if err := tr.Validate(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs > 1 {
+		t.Fatalf("expected at most 1 alloc, got %v", allocs)
+	}
+}